@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/libops/ppb/pkg/gcetest"
+)
+
+// instanceFlags collects repeated -instance project/zone/name[=STATUS] flags.
+type instanceFlags []gcetest.Instance
+
+func (f *instanceFlags) String() string {
+	names := make([]string, 0, len(*f))
+	for _, vm := range *f {
+		names = append(names, vm.Project+"/"+vm.Zone+"/"+vm.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+func (f *instanceFlags) Set(value string) error {
+	path, status, _ := strings.Cut(value, "=")
+	parts := strings.Split(path, "/")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return fmt.Errorf("instance %q must be project/zone/name[=STATUS]", value)
+	}
+	*f = append(*f, gcetest.Instance{Project: parts[0], Zone: parts[1], Name: parts[2], Status: strings.ToUpper(status)})
+	return nil
+}
+
+// emulateGCE runs the local Compute Engine emulator until SIGINT or SIGTERM.
+// Point a google_compute_engine machine at it with
+// `endpoint: http://127.0.0.1:8085/`.
+func emulateGCE(args []string) error {
+	flags := flag.NewFlagSet("emulate-gce", flag.ContinueOnError)
+	listen := flags.String("listen", "127.0.0.1:8085", "address to serve the emulated API on")
+	ip := flags.String("ip", "127.0.0.1", "internal and external IP reported for every instance")
+	startDelay := flags.Duration("start-delay", 5*time.Second, "time a start or resume spends in STAGING")
+	stopDelay := flags.Duration("stop-delay", 5*time.Second, "time a stop or suspend spends in STOPPING or SUSPENDING")
+	startError := flags.String("start-error", "", "fail every start with this operation error code, e.g. ZONE_RESOURCE_POOL_EXHAUSTED")
+	deny := flags.Bool("deny", false, "fail every call with 403 Forbidden")
+	var instances instanceFlags
+	flags.Var(&instances, "instance", "project/zone/name[=STATUS] to emulate, repeatable (default p/z/vm=TERMINATED)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if len(instances) == 0 {
+		instances = instanceFlags{{Project: "p", Zone: "z", Name: "vm"}}
+	}
+
+	emulator := gcetest.New(gcetest.Options{StartDelay: *startDelay, StopDelay: *stopDelay})
+	for _, vm := range instances {
+		vm.NetworkIP, vm.NatIP = *ip, *ip
+		vm.StartError, vm.Denied = *startError, *deny
+		if vm.Status == "" {
+			vm.Status = "TERMINATED"
+		}
+		emulator.Add(vm)
+		slog.Info("Emulating instance", "instance", vm.Project+"/"+vm.Zone+"/"+vm.Name, "status", vm.Status)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	slog.Info("Compute Engine emulator listening", "addr", *listen)
+	if err := gcetest.Serve(ctx, *listen, emulator); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
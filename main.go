@@ -1,19 +1,32 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"html"
+	"io"
 	"log/slog"
+	"math"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/libops/ppb/pkg/admin"
 	"github.com/libops/ppb/pkg/config"
+	"github.com/libops/ppb/pkg/machine"
+	"github.com/libops/ppb/pkg/progress"
 	"github.com/libops/ppb/pkg/proxy"
+	"github.com/libops/ppb/pkg/schedule"
 )
 
 func init() {
@@ -35,48 +48,306 @@ func init() {
 	slog.SetDefault(handler)
 }
 
-func startPingRoutine(ctx context.Context, wg *sync.WaitGroup, c *config.Config, interval time.Duration) {
+// startHeartbeatRoutine sends c.Machine's heartbeat every interval while the
+// machine has a cached host, and with onlyWithTraffic only after intervals in
+// which traffic was proxied to it.
+func startHeartbeatRoutine(ctx context.Context, wg *sync.WaitGroup, c *config.Config, interval time.Duration) {
 	defer wg.Done()
 
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: c.Heartbeat.TLSConfig(),
+		},
+	}
+	defer client.CloseIdleConnections()
 
-	slog.Info("Starting ping routine to GCE instance", "interval", interval)
+	slog.Info("Starting heartbeat routine", "machine", c.Machine.Describe(), "url", c.Heartbeat.URL, "interval", interval, "onlyWithTraffic", c.Heartbeat.OnlyWithTraffic)
 
 	for {
 		select {
 		case <-ctx.Done():
-			slog.Info("Ping routine shutting down")
+			slog.Info("Heartbeat routine shutting down", "machine", c.Machine.Describe())
 			return
 		case <-ticker.C:
-			host := c.Machine.Host()
-			if host == "" {
-				slog.Debug("No GCE host IP available for ping")
+			heartbeat(ctx, client, c, interval)
+		}
+	}
+}
+
+// heartbeatPayload is the JSON activity report sent with heartbeats when
+// heartbeat.payload is set. The request count and client addresses cover the
+// window since the previous heartbeat was sent. LastRequest is omitted until
+// PPB has proxied a client request.
+type heartbeatPayload struct {
+	Machine             string     `json:"machine"`
+	SentAt              time.Time  `json:"sentAt"`
+	LastRequest         *time.Time `json:"lastRequest,omitempty"`
+	OpenConnections     int        `json:"openConnections"`
+	UpgradedConnections int        `json:"upgradedConnections"`
+	WindowStart         time.Time  `json:"windowStart"`
+	Requests            int        `json:"requests"`
+	ClientIPs           []string   `json:"clientIps"`
+	ClientIPsTruncated  bool       `json:"clientIpsTruncated,omitempty"`
+}
+
+func newHeartbeatPayload(c *config.Config, now time.Time) heartbeatPayload {
+	payload := heartbeatPayload{Machine: c.Machine.Describe(), SentAt: now.UTC(), ClientIPs: []string{}}
+	if c.Activity == nil {
+		return payload
+	}
+	snapshot := c.Activity.Snapshot()
+	window := c.Activity.EndWindow()
+	if !snapshot.LastClientRequest.IsZero() {
+		lastRequest := snapshot.LastClientRequest.UTC()
+		payload.LastRequest = &lastRequest
+	}
+	payload.OpenConnections = snapshot.InFlight
+	payload.UpgradedConnections = snapshot.Upgraded
+	payload.WindowStart = window.Start.UTC()
+	payload.Requests = window.Requests
+	payload.ClientIPs = window.ClientIPs
+	payload.ClientIPsTruncated = window.Truncated
+	return payload
+}
+
+func heartbeat(ctx context.Context, client *http.Client, c *config.Config, interval time.Duration) {
+	if c.Heartbeat.OnlyWithTraffic && c.Activity != nil && c.Activity.Idle(interval) {
+		slog.Debug("Skipping heartbeat without recent traffic", "machine", c.Machine.Describe())
+		return
+	}
+	heartbeatURL, ok := c.HeartbeatURL()
+	if !ok {
+		slog.Debug("No machine host IP available for heartbeat", "machine", c.Machine.Describe())
+		return
+	}
+	slog.Debug("Sending heartbeat", "method", c.Heartbeat.Method, "url", heartbeatURL)
+
+	var body io.Reader
+	if c.Heartbeat.Payload {
+		payload, err := json.Marshal(newHeartbeatPayload(c, time.Now()))
+		if err != nil {
+			slog.Error("Unable to encode heartbeat payload", "error", err)
+			return
+		}
+		body = bytes.NewReader(payload)
+	}
+	request, err := http.NewRequestWithContext(ctx, c.Heartbeat.Method, heartbeatURL, body)
+	if err != nil {
+		slog.Debug("Unable to build heartbeat request", "url", heartbeatURL, "error", err)
+		return
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	for name, value := range c.Heartbeat.Headers {
+		request.Header.Set(name, value)
+	}
+	resp, err := client.Do(request)
+	if err != nil {
+		slog.Debug("Heartbeat failed", "url", heartbeatURL, "error", err)
+		return
+	}
+	if err := resp.Body.Close(); err != nil {
+		slog.Debug("Unable to close heartbeat response body", "error", err)
+	}
+
+	slog.Debug("Heartbeat successful", "url", heartbeatURL, "status", resp.StatusCode)
+}
+
+// startIdleRoutine powers off c.Machine once it has had no proxied traffic for
+// the idle window. Machines without a cached target are left alone, since PPB
+// has not seen them running.
+func startIdleRoutine(ctx context.Context, wg *sync.WaitGroup, c *config.Config, interval time.Duration) {
+	defer wg.Done()
+
+	stopper := c.Machine.(machine.Stopper)
+	quiet := time.Duration(c.Idle.After) * time.Second
+	stillIdle := func() bool { return c.Activity.Idle(quiet) }
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	slog.Info("Starting idle routine", "machine", c.Machine.Describe(), "action", c.Idle.Action, "after", quiet)
+
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Info("Idle routine shutting down", "machine", c.Machine.Describe())
+			return
+		case <-ticker.C:
+			if c.Machine.Host() == "" || !stillIdle() {
 				continue
 			}
+			err := stopper.PowerOff(ctx, c.Idle.Action == "suspend", stillIdle)
+			switch {
+			case errors.Is(err, machine.ErrNotIdle):
+				slog.Debug("Idle power-off cancelled by new traffic", "machine", c.Machine.Describe())
+			case err != nil:
+				slog.Error("Idle power-off failed", "machine", c.Machine.Describe(), "err", err)
+			default:
+				slog.Info("Powered off idle machine", "machine", c.Machine.Describe(), "action", c.Idle.Action)
+			}
+		}
+	}
+}
+
+// writeClosed renders the closed page with a Retry-After that points at the
+// end of the closed window when one is within reach.
+func writeClosed(w http.ResponseWriter, s *schedule.Schedule, now time.Time) {
+	if reopens, ok := s.ReopensAt(now); ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(reopens.Sub(now).Seconds()))))
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	_, _ = fmt.Fprintf(w, "<!doctype html>\n<html><head><title>Closed</title></head><body><h1>Closed</h1><p>%s</p></body></html>\n", html.EscapeString(s.ClosedMessage))
+}
 
-			pingURL := fmt.Sprintf("http://%s:8808/ping", host)
-			slog.Debug("Pinging GCE instance", "url", pingURL)
+// isBrowserNavigation reports whether r is a browser loading a page, as
+// opposed to an API client or a script fetching data.
+func isBrowserNavigation(r *http.Request) bool {
+	if r.Method != http.MethodGet || r.Header.Get("Upgrade") != "" {
+		return false
+	}
+	if mode := r.Header.Get("Sec-Fetch-Mode"); mode != "" {
+		return mode == "navigate"
+	}
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// startingPageData is the starting page for r with the machine's progress.
+func startingPageData(r *http.Request, c *config.Config, now time.Time) config.StartingPageData {
+	data := config.StartingPageData{
+		Title:          c.StartingPage.Title,
+		Message:        c.StartingPage.Message,
+		Status:         c.Machine.Status(),
+		RefreshSeconds: c.StartingPage.Refresh,
+	}
+	if c.Progress != nil {
+		data.StreamURL = progress.StreamPath + "?path=" + url.QueryEscape(r.URL.Path)
+	}
+	if started := c.Machine.LastAttempt(); !started.IsZero() {
+		data.ElapsedSeconds = max(0, int(now.Sub(started).Seconds()))
+	}
+	return data
+}
 
-			client := &http.Client{
-				Timeout: 5 * time.Second,
+// writeStarting renders the starting page. It is a 503 with Retry-After, so
+// crawlers and caches do not keep it.
+func writeStarting(w http.ResponseWriter, c *config.Config, data config.StartingPageData) {
+	w.Header().Set("Retry-After", strconv.Itoa(c.StartingPage.Refresh))
+	var page bytes.Buffer
+	if err := c.StartingPage.Render(&page, data); err != nil {
+		slog.Error("Unable to render starting page", "err", err)
+		http.Error(w, "Backend not available", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	_, _ = page.WriteTo(w)
+}
+
+// wakeInBackground powers c.Machine on for a starting page and, since no
+// request is waiting on the backend, brings it up to ready so the page's
+// stream can reload it straight away. It returns the power-on error, which
+// also ends the machine's progress stream unless PPB is shutting down.
+func wakeInBackground(ctx context.Context, c *config.Config, backend http.Handler) error {
+	powerCtx, powerCancel := context.WithTimeout(ctx, time.Duration(c.PowerOnTimeout)*time.Second)
+	defer powerCancel()
+	if err := c.Machine.PowerOnWithCooldown(powerCtx, c.PowerOnCooldown); err != nil {
+		slog.Error("Background power-on failed", "machine", c.Machine.Describe(), "status", c.Machine.Status(), "err", err)
+		if c.Progress != nil && ctx.Err() == nil {
+			c.Progress.Failed(err)
+		}
+		return err
+	}
+	if w, ok := backend.(warmer); ok {
+		if err := w.Warm(ctx); err != nil {
+			slog.Warn("Backend did not become ready after background power-on", "machine", c.Machine.Describe(), "err", err)
+			if c.Progress != nil && ctx.Err() == nil {
+				c.Progress.Failed(err)
 			}
+		}
+	}
+	return nil
+}
+
+// statusStreamHandler streams the wake progress of the machine serving the
+// request's Host to clients that could wake it. The path query parameter
+// selects a path route, e.g. ?path=/docs.
+func statusStreamHandler(c *config.Config, done <-chan struct{}) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Query().Get("path")
+		if !strings.HasPrefix(path, "/") {
+			path = "/"
+		}
+		target := c.Match(r.Host, path)
+		if target == nil || target.Progress == nil {
+			http.NotFound(w, r)
+			return
+		}
+		if _, err := target.AllowedClientIP(r); err != nil {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		progress.ServeStream(w, r, target.Progress, target.Machine.Describe(), done)
+	})
+}
+
+// startScheduleRoutine powers c.Machine on in the minutes selected by its
+// keep-warm expressions. A keep-warm wake counts as traffic, so an idle policy
+// does not power the machine straight back off.
+func startScheduleRoutine(ctx context.Context, wg *sync.WaitGroup, c *config.Config, interval time.Duration) {
+	defer wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	slog.Info("Starting schedule routine", "machine", c.Machine.Describe(), "timezone", c.Schedule.Timezone)
 
-			resp, err := client.Get(pingURL)
-			if err != nil {
-				slog.Debug("Ping failed", "url", pingURL, "error", err)
+	var lastWarm time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Info("Schedule routine shutting down", "machine", c.Machine.Describe())
+			return
+		case now := <-ticker.C:
+			minute := now.Truncate(time.Minute)
+			if minute.Equal(lastWarm) || !c.Schedule.KeepWarmDue(now) {
 				continue
 			}
-			if err := resp.Body.Close(); err != nil {
-				slog.Debug("Unable to close ping response body", "error", err)
+			lastWarm = minute
+			if c.Schedule.IsClosed(now) {
+				slog.Warn("Skipping keep-warm inside a closed window", "machine", c.Machine.Describe())
+				continue
 			}
 
-			slog.Debug("Ping successful", "url", pingURL, "status", resp.StatusCode)
+			slog.Info("Keeping machine warm", "machine", c.Machine.Describe())
+			if c.Activity != nil {
+				c.Activity.Begin(false)()
+			}
+			powerCtx, powerCancel := context.WithTimeout(ctx, time.Duration(c.PowerOnTimeout)*time.Second)
+			if err := c.Machine.PowerOnWithCooldown(powerCtx, c.PowerOnCooldown); err != nil {
+				slog.Error("Keep-warm power-on failed", "machine", c.Machine.Describe(), "status", c.Machine.Status(), "err", err)
+			}
+			powerCancel()
 		}
 	}
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "emulate-gce" {
+		if err := emulateGCE(os.Args[2:]); err != nil {
+			slog.Error("Compute Engine emulator failed", "err", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	c, err := config.LoadConfig()
 	if err != nil {
 		slog.Error("Unable to load config", "err", err)
@@ -90,21 +361,55 @@ func main() {
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGINT)
 	var wg sync.WaitGroup
-	wg.Add(1)
-	go startPingRoutine(ctx, &wg, c, 30*time.Second)
+	for _, owner := range c.Owners() {
+		if !owner.Heartbeat.Disabled {
+			wg.Add(1)
+			go startHeartbeatRoutine(ctx, &wg, owner, time.Duration(owner.Heartbeat.Interval)*time.Second)
+		}
+		if owner.Idle != nil {
+			wg.Add(1)
+			go startIdleRoutine(ctx, &wg, owner, time.Duration(owner.Idle.CheckInterval)*time.Second)
+		}
+		if owner.Schedule != nil && len(owner.Schedule.KeepWarm) > 0 {
+			wg.Add(1)
+			go startScheduleRoutine(ctx, &wg, owner, 15*time.Second)
+		}
+	}
 
-	p := proxy.New(c)
-	server := &http.Server{
+	mux := newHandler(ctx, &wg, c, func(target *config.Config) http.Handler {
+		return proxy.New(target)
+	})
+	mux.Handle("GET "+progress.StreamPath, statusStreamHandler(c, ctx.Done()))
+	servers := []*http.Server{{
 		Addr:              ":8080",
-		Handler:           newHandler(c, p),
+		Handler:           mux,
 		ReadHeaderTimeout: 10 * time.Second,
-	}
-	go func() {
-		slog.Info("Server listening on :8080")
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			slog.Error("Server error", "err", err)
+	}}
+	if c.Admin != nil {
+		adminHandler := admin.NewHandler(ctx, &wg, c)
+		if c.Admin.Listen == "" {
+			mux.Handle(admin.Prefix, adminHandler)
+		} else {
+			servers = append(servers, &http.Server{
+				Addr:              c.Admin.Listen,
+				Handler:           adminHandler,
+				ReadHeaderTimeout: 10 * time.Second,
+			})
 		}
-	}()
+	}
+	if c.ActivityEndpoint != nil {
+		activityHandler := admin.NewActivityHandler(c)
+		mux.Handle(admin.ActivityPath, activityHandler)
+		mux.Handle(admin.ActivityPath+"/", activityHandler)
+	}
+	for _, server := range servers {
+		go func() {
+			slog.Info("Server listening", "addr", server.Addr)
+			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				slog.Error("Server error", "addr", server.Addr, "err", err)
+			}
+		}()
+	}
 
 	<-sigChan
 	slog.Info("Received shutdown signal, gracefully shutting down...")
@@ -112,22 +417,57 @@ func main() {
 
 	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer shutdownCancel()
-	if err := server.Shutdown(shutdownCtx); err != nil {
-		slog.Error("Server shutdown error", "err", err)
+	for _, server := range servers {
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			slog.Error("Server shutdown error", "addr", server.Addr, "err", err)
+		}
 	}
 
 	wg.Wait()
 	slog.Info("Shutdown complete")
 }
 
-func newHandler(c *config.Config, backend http.Handler) http.Handler {
+// newHandler routes each request by Host and path to the configuration
+// serving it, using the backend newBackend builds for each target once, up
+// front. Wakes that outlive a request run on ctx and are tracked by wg.
+func newHandler(ctx context.Context, wg *sync.WaitGroup, c *config.Config, newBackend func(*config.Config) http.Handler) *http.ServeMux {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/healthcheck", func(w http.ResponseWriter, _ *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		_, _ = fmt.Fprintln(w, "OK")
 	})
 
+	handlers := map[*config.Config]http.Handler{}
+	for _, target := range c.Targets() {
+		handlers[target] = powerOnHandler(ctx, wg, target, newBackend(target))
+	}
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		target := c.Match(r.Host, r.URL.Path)
+		if target == nil {
+			slog.Debug("No route for request", "host", r.Host, "path", r.URL.Path)
+			http.NotFound(w, r)
+			return
+		}
+		handlers[target].ServeHTTP(w, r)
+	})
+	return mux
+}
+
+// warmer is implemented by backends that can be brought up to ready without
+// a request, such as the reverse proxy.
+type warmer interface {
+	Warm(ctx context.Context) error
+}
+
+// powerOnHandler admits allowed clients, powers on the target machine, and
+// then hands the request to backend.
+func powerOnHandler(ctx context.Context, wg *sync.WaitGroup, c *config.Config, backend http.Handler) http.Handler {
+	// waking is set while a wake started for a starting page runs, so page
+	// reloads do not queue further wakes behind it. wakeErr holds the error of
+	// the last such wake until a starting page has shown it.
+	var waking atomic.Bool
+	var wakeErr atomic.Pointer[string]
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		clientIP, err := c.AllowedClientIP(r)
 		if err != nil {
 			http.Error(w, "Forbidden", http.StatusForbidden)
@@ -144,14 +484,67 @@ func newHandler(c *config.Config, backend http.Handler) http.Handler {
 		}
 		r.Header.Set("X-Forwarded-For", clientIP.String())
 
+		// A closed schedule refuses wakes, but a machine that is already up
+		// keeps serving until it is powered off.
+		closed := c.Schedule != nil && c.Schedule.IsClosed(time.Now())
+		if closed && c.Machine.Host() == "" {
+			writeClosed(w, c.Schedule, time.Now())
+			return
+		}
+
+		// Count the request from before power-on until the proxied response or
+		// upgraded connection ends, so idle power-off never races a wake.
+		if c.Activity != nil {
+			done := c.Activity.BeginRequest(clientIP.String(), r.Header.Get("Upgrade") != "")
+			defer done()
+		}
+
+		// Browsers get the starting page at once instead of a blank tab, and
+		// its reloads are proxied once the machine is up. A failed wake is
+		// shown once without a reload, so the page does not keep retrying it;
+		// the next navigation starts a new wake.
+		if c.StartingPage != nil && c.Machine.Host() == "" && isBrowserNavigation(r) {
+			failure := wakeErr.Swap(nil)
+			if failure == nil && waking.CompareAndSwap(false, true) {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					defer waking.Store(false)
+					if err := wakeInBackground(ctx, c, backend); err != nil && ctx.Err() == nil {
+						message := err.Error()
+						wakeErr.Store(&message)
+					}
+				}()
+			}
+			data := startingPageData(r, c, time.Now())
+			if failure != nil {
+				data.Error = *failure
+			}
+			writeStarting(w, c, data)
+			return
+		}
+
 		// Attempt to power on the machine within the request lifetime. Waiting
 		// requests can then be cancelled cleanly during disconnect or shutdown.
+		// The cached host may be stale, so a closed window is enforced on the
+		// power-on itself: a machine stopped outside PPB is not started again.
 		powerCtx, powerCancel := context.WithTimeout(r.Context(), time.Duration(c.PowerOnTimeout)*time.Second)
+		if closed {
+			powerCtx = machine.RefuseStarts(powerCtx)
+		}
 		err = c.Machine.PowerOnWithCooldown(powerCtx, c.PowerOnCooldown)
 		powerTimedOut := powerCtx.Err() == context.DeadlineExceeded && r.Context().Err() == nil
 		powerCancel()
+		if errors.Is(err, machine.ErrStartRefused) {
+			writeClosed(w, c.Schedule, time.Now())
+			return
+		}
 		if err != nil {
-			slog.Error("Power-on attempt failed", "err", err)
+			slog.Error("Power-on attempt failed", "machine", c.Machine.Describe(), "status", c.Machine.Status(), "err", err)
+			// A client giving up does not end the wake for anyone else.
+			if c.Progress != nil && r.Context().Err() == nil {
+				c.Progress.Failed(err)
+			}
 			if powerTimedOut {
 				w.Header().Set("Retry-After", "5")
 			}
@@ -161,5 +554,4 @@ func newHandler(c *config.Config, backend http.Handler) http.Handler {
 
 		backend.ServeHTTP(w, r)
 	})
-	return mux
 }
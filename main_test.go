@@ -2,20 +2,31 @@ package main
 
 import (
 	"context"
-	"log/slog"
+	"encoding/json"
+	"errors"
 	"net"
 	"net/http"
 	"net/http/httptest"
-	"os"
+	"net/url"
 	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/libops/ppb/pkg/activity"
 	"github.com/libops/ppb/pkg/config"
+	"github.com/libops/ppb/pkg/gcetest"
 	"github.com/libops/ppb/pkg/machine"
+	"github.com/libops/ppb/pkg/progress"
+	"github.com/libops/ppb/pkg/proxy"
+	"github.com/libops/ppb/pkg/schedule"
 )
 
+// staticBackend serves every target with the same handler.
+func staticBackend(handler http.Handler) func(*config.Config) http.Handler {
+	return func(*config.Config) http.Handler { return handler }
+}
+
 func TestHandlerPermanentPowerFailureOmitsRetryAfter(t *testing.T) {
 	t.Parallel()
 
@@ -24,14 +35,16 @@ func TestHandlerPermanentPowerFailureOmitsRetryAfter(t *testing.T) {
 		t.Fatalf("net.ParseCIDR() error = %v", err)
 	}
 	backendCalled := false
-	handler := newHandler(&config.Config{
+	tracker := progress.NewTracker()
+	handler := newHandler(context.Background(), &sync.WaitGroup{}, &config.Config{
 		AllowedIps:      []config.IPNet{{IPNet: allowed}},
 		PowerOnCooldown: 30,
 		PowerOnTimeout:  1,
 		Machine:         &machine.GoogleComputeEngine{},
-	}, http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		Progress:        tracker,
+	}, staticBackend(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
 		backendCalled = true
-	}))
+	})))
 	request := httptest.NewRequest(http.MethodGet, "http://example.test/", nil)
 	request.RemoteAddr = "127.0.0.1:12345"
 	recorder := httptest.NewRecorder()
@@ -47,6 +60,11 @@ func TestHandlerPermanentPowerFailureOmitsRetryAfter(t *testing.T) {
 	if backendCalled {
 		t.Fatal("backend handler ran after power-on failure")
 	}
+	history, _, cancel := tracker.Subscribe()
+	defer cancel()
+	if len(history) == 0 || history[len(history)-1].Phase != progress.PhaseFailed || history[len(history)-1].Message == "" {
+		t.Fatalf("progress = %+v, want the wake to end with the failure", history)
+	}
 }
 
 func TestHandlerPowerTimeoutReturnsRetryableUnavailable(t *testing.T) {
@@ -63,14 +81,14 @@ func TestHandlerPowerTimeoutReturnsRetryableUnavailable(t *testing.T) {
 	defer machine.Lock.Release(1)
 
 	backendCalled := false
-	handler := newHandler(&config.Config{
+	handler := newHandler(context.Background(), &sync.WaitGroup{}, &config.Config{
 		AllowedIps:      []config.IPNet{{IPNet: allowed}},
 		PowerOnCooldown: 30,
 		PowerOnTimeout:  1,
 		Machine:         machine,
-	}, http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+	}, staticBackend(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
 		backendCalled = true
-	}))
+	})))
 	request := httptest.NewRequest(http.MethodPost, "http://example.test/", strings.NewReader("must-not-be-dispatched"))
 	request.RemoteAddr = "127.0.0.1:12345"
 	recorder := httptest.NewRecorder()
@@ -100,13 +118,13 @@ func TestHandlerCanonicalizesValidatedClientIdentity(t *testing.T) {
 	machine.LastPowerOnAttempt = time.Now()
 
 	backendCalled := false
-	handler := newHandler(&config.Config{
+	handler := newHandler(context.Background(), &sync.WaitGroup{}, &config.Config{
 		AllowedIps:        []config.IPNet{{IPNet: allowed}},
 		IpForwardedHeader: "X-Forwarded-For",
 		PowerOnCooldown:   30,
 		PowerOnTimeout:    1,
 		Machine:           machine,
-	}, http.HandlerFunc(func(_ http.ResponseWriter, request *http.Request) {
+	}, staticBackend(http.HandlerFunc(func(_ http.ResponseWriter, request *http.Request) {
 		backendCalled = true
 		if got := request.Header.Values("X-Forwarded-For"); len(got) != 1 || got[0] != "203.0.113.9" {
 			t.Errorf("X-Forwarded-For = %#v, want one validated client address", got)
@@ -117,7 +135,7 @@ func TestHandlerCanonicalizesValidatedClientIdentity(t *testing.T) {
 		if got := request.Header.Get("Forwarded"); got != "" {
 			t.Errorf("Forwarded = %q, want stripped", got)
 		}
-	}))
+	})))
 	request := httptest.NewRequest(http.MethodGet, "http://example.test/", nil)
 	request.Header.Add("X-Forwarded-For", "10.0.0.8")
 	request.Header.Add("X-Forwarded-For", "203.0.113.9")
@@ -135,56 +153,34 @@ func TestHandlerCanonicalizesValidatedClientIdentity(t *testing.T) {
 	}
 }
 
-func TestStartPingRoutine_Integration(t *testing.T) {
-	// Track ping requests
-	var pingCount int
-	var pingURLs []string
+func TestStartHeartbeatRoutine(t *testing.T) {
 	var mu sync.Mutex
-
-	mux := http.NewServeMux()
-	mux.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {
+	var heartbeats []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		mu.Lock()
 		defer mu.Unlock()
-		pingCount++
-		pingURLs = append(pingURLs, r.URL.Path)
-
-		w.WriteHeader(http.StatusOK)
-		_, err := w.Write([]byte("pong"))
-		if err != nil {
-			slog.Error("Unable to write ping response", "err", err)
-			os.Exit(1)
-		}
-	})
-	server := &http.Server{
-		Addr:    ":8808",
-		Handler: mux,
+		heartbeats = append(heartbeats, r.Method+" "+r.URL.Path+" "+r.Header.Get("Authorization"))
+		_, _ = w.Write([]byte("pong"))
+	}))
+	defer server.Close()
+	serverURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, port, err := net.SplitHostPort(serverURL.Host)
+	if err != nil {
+		t.Fatal(err)
 	}
-	go func() {
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			// Ignore "address already in use" errors during testing
-			if !strings.Contains(err.Error(), "address already in use") {
-				t.Errorf("Mock server error: %v", err)
-			}
-		}
-	}()
-
-	time.Sleep(1 * time.Second)
-
-	defer func() {
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
-		err := server.Shutdown(ctx)
-		if err != nil {
-			slog.Error("Server shutdown failed", "err", err)
-			os.Exit(1)
-		}
-	}()
 
 	mockMachine := machine.NewGceMachine()
-	mockMachine.SetHostForTesting("127.0.0.1")
-
+	mockMachine.SetHostForTesting(host)
 	config := &config.Config{
 		Machine: mockMachine,
+		Heartbeat: &config.Heartbeat{
+			URL:     "http://{machineHost}:" + port + "/lightsout/ping",
+			Method:  http.MethodPost,
+			Headers: map[string]string{"Authorization": "Bearer secret"},
+		},
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 350*time.Millisecond)
@@ -192,36 +188,150 @@ func TestStartPingRoutine_Integration(t *testing.T) {
 
 	var wg sync.WaitGroup
 	wg.Add(1)
-
-	go startPingRoutine(ctx, &wg, config, 100*time.Millisecond)
+	go startHeartbeatRoutine(ctx, &wg, config, 100*time.Millisecond)
 	wg.Wait()
 
 	mu.Lock()
 	defer mu.Unlock()
+	// Should have made multiple heartbeats (2-3 in 350ms with 100ms interval)
+	if len(heartbeats) < 2 {
+		t.Fatalf("heartbeats = %v, want at least 2", heartbeats)
+	}
+	for _, heartbeat := range heartbeats {
+		if heartbeat != "POST /lightsout/ping Bearer secret" {
+			t.Fatalf("heartbeat = %q, want the configured method, path, and header", heartbeat)
+		}
+	}
+}
+
+func TestHeartbeatOnlyWithTraffic(t *testing.T) {
+	var mu sync.Mutex
+	heartbeats := 0
+	server := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		heartbeats++
+	}))
+	defer server.Close()
+	serverURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, port, err := net.SplitHostPort(serverURL.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mockMachine := machine.NewGceMachine()
+	mockMachine.SetHostForTesting(host)
+	tracker := activity.NewTracker()
+	config := &config.Config{
+		Machine:   mockMachine,
+		Activity:  tracker,
+		Heartbeat: &config.Heartbeat{URL: "http://{machineHost}:" + port + "/ping", Method: http.MethodGet, OnlyWithTraffic: true},
+	}
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return heartbeats
+	}
 
-	if pingCount == 0 {
-		t.Error("Expected at least one ping request, got none")
+	interval := 50 * time.Millisecond
+	time.Sleep(interval)
+	heartbeat(context.Background(), server.Client(), config, interval)
+	if got := count(); got != 0 {
+		t.Fatalf("heartbeats = %d after a quiet interval, want 0", got)
 	}
 
-	// Verify all requests were to /ping endpoint
-	for _, url := range pingURLs {
-		if url != "/ping" {
-			t.Errorf("Expected ping to /ping endpoint, got %s", url)
+	tracker.Begin(false)()
+	heartbeat(context.Background(), server.Client(), config, interval)
+	if got := count(); got != 1 {
+		t.Fatalf("heartbeats = %d after proxied traffic, want 1", got)
+	}
+}
+
+func TestHeartbeatPayload(t *testing.T) {
+	received := make(chan *http.Request, 1)
+	bodies := make(chan heartbeatPayload, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload heartbeatPayload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Errorf("Decode() error = %v", err)
 		}
+		received <- r
+		bodies <- payload
+	}))
+	defer server.Close()
+	serverURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, port, err := net.SplitHostPort(serverURL.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mockMachine := machine.NewGceMachine()
+	mockMachine.SetHostForTesting(host)
+	tracker := activity.NewTracker()
+	tracker.BeginRequest("203.0.113.9", false)()
+	tracker.BeginRequest("198.51.100.4", false)()
+	closeSocket := tracker.BeginRequest("203.0.113.9", true)
+	defer closeSocket()
+	config := &config.Config{
+		Machine:   mockMachine,
+		Activity:  tracker,
+		Heartbeat: &config.Heartbeat{URL: "http://{machineHost}:" + port + "/activity", Method: http.MethodPost, Payload: true},
+	}
+
+	heartbeat(context.Background(), server.Client(), config, time.Minute)
+
+	request, payload := <-received, <-bodies
+	if request.Method != http.MethodPost || request.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("request = %s %q, want a JSON POST", request.Method, request.Header.Get("Content-Type"))
+	}
+	if payload.Requests != 3 || payload.OpenConnections != 1 || payload.UpgradedConnections != 1 {
+		t.Fatalf("payload = %+v, want three requests and one open WebSocket", payload)
+	}
+	if strings.Join(payload.ClientIPs, ",") != "198.51.100.4,203.0.113.9" || payload.LastRequest == nil {
+		t.Fatalf("payload = %+v, want both clients and the last request time", payload)
+	}
+
+	heartbeat(context.Background(), server.Client(), config, time.Minute)
+	<-received
+	if payload = <-bodies; payload.Requests != 0 || len(payload.ClientIPs) != 0 || payload.OpenConnections != 1 {
+		t.Fatalf("second payload = %+v, want only the still open connection", payload)
+	}
+}
+
+func TestHeartbeatPayloadOmitsLastRequestBeforeClientTraffic(t *testing.T) {
+	mockMachine := machine.NewGceMachine()
+	tracker := activity.NewTracker()
+	// A wake or keep-warm call is PPB's own traffic, not a client's.
+	tracker.Begin(false)()
+	config := &config.Config{Machine: mockMachine, Activity: tracker}
+
+	body, err := json.Marshal(newHeartbeatPayload(config, time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(body), "lastRequest") {
+		t.Fatalf("payload = %s, want no last request before a proxied request", body)
 	}
 
-	// Should have made multiple pings (at least 2-3 in 350ms with 100ms interval)
-	if pingCount < 2 {
-		t.Errorf("Expected at least 2 ping requests, got %d", pingCount)
+	tracker.BeginRequest("203.0.113.9", false)()
+	if payload := newHeartbeatPayload(config, time.Now()); payload.LastRequest == nil {
+		t.Fatal("payload has no last request after a proxied request")
 	}
 }
 
-func TestStartPingRoutine_ContextCancellation(t *testing.T) {
+func TestStartHeartbeatRoutine_ContextCancellation(t *testing.T) {
 	mockMachine := machine.NewGceMachine()
 	mockMachine.SetHostForTesting("127.0.0.1")
 
 	config := &config.Config{
-		Machine: mockMachine,
+		Machine:   mockMachine,
+		Heartbeat: &config.Heartbeat{URL: config.DefaultHeartbeatURL, Method: http.MethodGet},
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
@@ -231,7 +341,7 @@ func TestStartPingRoutine_ContextCancellation(t *testing.T) {
 	routineFinished := make(chan bool, 1)
 
 	go func() {
-		startPingRoutine(ctx, &wg, config, 50*time.Millisecond)
+		startHeartbeatRoutine(ctx, &wg, config, 50*time.Millisecond)
 		routineFinished <- true
 	}()
 
@@ -244,6 +354,594 @@ func TestStartPingRoutine_ContextCancellation(t *testing.T) {
 	select {
 	case <-routineFinished:
 	case <-time.After(1 * time.Second):
-		t.Error("Ping routine did not finish within expected time after context cancellation")
+		t.Error("Heartbeat routine did not finish within expected time after context cancellation")
+	}
+}
+
+func TestHandlerRoutesByHost(t *testing.T) {
+	t.Parallel()
+
+	_, allowed, err := net.ParseCIDR("127.0.0.1/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newRoute := func(host, ip string) *config.Route {
+		m := machine.NewGceMachine()
+		m.SetHostForTesting(ip)
+		m.LastPowerOnAttempt = time.Now()
+		return &config.Route{Hosts: []string{host}, Config: config.Config{
+			AllowedIps:      []config.IPNet{{IPNet: allowed}},
+			PowerOnCooldown: 30,
+			PowerOnTimeout:  1,
+			Machine:         m,
+		}}
+	}
+	c := &config.Config{Routes: []*config.Route{
+		newRoute("app.example.test", "10.0.0.1"),
+		newRoute("*.dev.example.test", "10.0.0.2"),
+	}}
+	handler := newHandler(context.Background(), &sync.WaitGroup{}, c, func(target *config.Config) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			_, _ = w.Write([]byte(target.Machine.Host()))
+		})
+	})
+
+	tests := []struct {
+		host       string
+		wantStatus int
+		wantBody   string
+	}{
+		{host: "app.example.test", wantStatus: http.StatusOK, wantBody: "10.0.0.1"},
+		{host: "feature.dev.example.test:8080", wantStatus: http.StatusOK, wantBody: "10.0.0.2"},
+		{host: "unknown.example.test", wantStatus: http.StatusNotFound},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest(http.MethodGet, "http://"+test.host+"/", nil)
+		request.RemoteAddr = "127.0.0.1:12345"
+		recorder := httptest.NewRecorder()
+
+		handler.ServeHTTP(recorder, request)
+
+		if recorder.Code != test.wantStatus {
+			t.Fatalf("%s: status = %d, want %d", test.host, recorder.Code, test.wantStatus)
+		}
+		if test.wantBody != "" && recorder.Body.String() != test.wantBody {
+			t.Fatalf("%s: body = %q, want %q", test.host, recorder.Body.String(), test.wantBody)
+		}
+	}
+}
+
+func TestHandlerWakesOnlyTheMachineForThePath(t *testing.T) {
+	t.Parallel()
+
+	_, allowed, err := net.ParseCIDR("127.0.0.1/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The idle machine holds its power-on lock, so any request routed to it
+	// would time out instead of reaching the backend.
+	idle := machine.NewGceMachine()
+	if err := idle.Lock.Acquire(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Lock.Release(1)
+	awake := machine.NewGceMachine()
+	awake.SetHostForTesting("10.0.0.7")
+	awake.LastPowerOnAttempt = time.Now()
+
+	route := func(prefix string, m machine.Machine) *config.Route {
+		return &config.Route{Config: config.Config{
+			AllowedIps:      []config.IPNet{{IPNet: allowed}},
+			PowerOnCooldown: 30,
+			PowerOnTimeout:  1,
+			PathPrefix:      prefix,
+			Machine:         m,
+		}}
+	}
+	c := &config.Config{Routes: []*config.Route{route("/api", idle), route("/jupyter", awake)}}
+	handler := newHandler(context.Background(), &sync.WaitGroup{}, c, func(target *config.Config) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			_, _ = w.Write([]byte(target.Machine.Host()))
+		})
+	})
+
+	request := httptest.NewRequest(http.MethodGet, "http://team.example.test/jupyter/lab", nil)
+	request.RemoteAddr = "127.0.0.1:12345"
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusOK || recorder.Body.String() != "10.0.0.7" {
+		t.Fatalf("response = %d %q, want the jupyter machine", recorder.Code, recorder.Body.String())
+	}
+	if !idle.LastPowerOnAttempt.IsZero() {
+		t.Fatal("request for /jupyter attempted to wake the /api machine")
+	}
+}
+
+// idleStopper records idle power-off calls for a machine with a cached host.
+type idleStopper struct {
+	*machine.GoogleComputeEngine
+	mu       sync.Mutex
+	suspends []bool
+}
+
+func (s *idleStopper) PowerOff(_ context.Context, suspend bool, stillIdle func() bool) error {
+	if !stillIdle() {
+		return machine.ErrNotIdle
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.suspends = append(s.suspends, suspend)
+	s.SetHostForTesting("")
+	return nil
+}
+
+func (s *idleStopper) calls() []bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]bool(nil), s.suspends...)
+}
+
+func TestStartIdleRoutineWaitsForOpenConnections(t *testing.T) {
+	stopper := &idleStopper{GoogleComputeEngine: machine.NewGceMachine()}
+	stopper.SetHostForTesting("10.0.0.5")
+	c := &config.Config{
+		Machine:  stopper,
+		Activity: activity.NewTracker(),
+		Idle:     &config.IdlePolicy{Action: "suspend"},
+	}
+	done := c.Activity.Begin(true)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go startIdleRoutine(ctx, &wg, c, 5*time.Millisecond)
+
+	time.Sleep(50 * time.Millisecond)
+	if calls := stopper.calls(); len(calls) != 0 {
+		t.Fatalf("idle routine powered off with an open upgraded connection: %v", calls)
+	}
+
+	done()
+	deadline := time.Now().Add(time.Second)
+	for len(stopper.calls()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	wg.Wait()
+
+	if calls := stopper.calls(); len(calls) != 1 || !calls[0] {
+		t.Fatalf("power-off calls = %v, want one suspend", calls)
+	}
+}
+
+// countingMachine records power-on calls and reports a fixed host.
+type countingMachine struct {
+	mu       sync.Mutex
+	host     string
+	powerOns int
+	// err, when set, is returned by every power-on.
+	err error
+	// block holds every power-on until its context ends.
+	block bool
+}
+
+func (m *countingMachine) PowerOnWithCooldown(ctx context.Context, _ int) error {
+	m.mu.Lock()
+	m.powerOns++
+	m.mu.Unlock()
+	if m.block {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return m.err
+}
+
+func (m *countingMachine) Host() string                  { return m.host }
+func (m *countingMachine) Status() string                { return "RUNNING" }
+func (m *countingMachine) Describe() string              { return "counting" }
+func (m *countingMachine) LastAttempt() time.Time        { return time.Time{} }
+func (m *countingMachine) Wakes() uint64                 { return 1 }
+func (m *countingMachine) Refresh(context.Context) error { return nil }
+
+func (m *countingMachine) calls() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.powerOns
+}
+
+func TestHandlerRefusesWakesWhileClosed(t *testing.T) {
+	t.Parallel()
+
+	_, allowed, err := net.ParseCIDR("127.0.0.1/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := &schedule.Schedule{Closed: []string{"* * * * *"}, ClosedMessage: "Closed for <maintenance>"}
+	if err := closed.Compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name       string
+		host       string
+		wantStatus int
+		wantCalls  int
+	}{
+		{name: "stopped machine", wantStatus: http.StatusServiceUnavailable},
+		{name: "running machine", host: "10.0.0.9", wantStatus: http.StatusOK, wantCalls: 1},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			m := &countingMachine{host: test.host}
+			handler := newHandler(context.Background(), &sync.WaitGroup{}, &config.Config{
+				AllowedIps:      []config.IPNet{{IPNet: allowed}},
+				PowerOnCooldown: 30,
+				PowerOnTimeout:  1,
+				Schedule:        closed,
+				Machine:         m,
+			}, staticBackend(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})))
+			request := httptest.NewRequest(http.MethodGet, "http://example.test/", nil)
+			request.RemoteAddr = "127.0.0.1:12345"
+			recorder := httptest.NewRecorder()
+
+			handler.ServeHTTP(recorder, request)
+
+			if recorder.Code != test.wantStatus {
+				t.Fatalf("status = %d, want %d", recorder.Code, test.wantStatus)
+			}
+			if m.calls() != test.wantCalls {
+				t.Fatalf("power-on calls = %d, want %d", m.calls(), test.wantCalls)
+			}
+			if test.wantStatus == http.StatusServiceUnavailable {
+				if !strings.Contains(recorder.Body.String(), "Closed for &lt;maintenance&gt;") {
+					t.Fatalf("body = %q, want the escaped closed message", recorder.Body.String())
+				}
+				if got := recorder.Header().Get("Retry-After"); got != "" {
+					t.Fatalf("Retry-After = %q, want omitted for an always-closed schedule", got)
+				}
+			}
+		})
+	}
+}
+
+func TestHandlerServesStartingPageToBrowsers(t *testing.T) {
+	t.Parallel()
+
+	_, allowed, err := net.ParseCIDR("127.0.0.1/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := &config.StartingPage{Title: "Waking <app>", Refresh: 3}
+	if err := page.Compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name        string
+		host        string
+		headers     map[string]string
+		wantStarted bool
+	}{
+		{name: "browser navigation", headers: map[string]string{"Sec-Fetch-Mode": "navigate", "Accept": "text/html"}, wantStarted: true},
+		{name: "browser without fetch metadata", headers: map[string]string{"Accept": "text/html,application/xhtml+xml"}, wantStarted: true},
+		{name: "script fetch", headers: map[string]string{"Sec-Fetch-Mode": "cors", "Accept": "text/html"}},
+		{name: "api client", headers: map[string]string{"Accept": "application/json"}},
+		{name: "running machine", host: "10.0.0.9", headers: map[string]string{"Accept": "text/html"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			m := &countingMachine{host: test.host}
+			var wg sync.WaitGroup
+			handler := newHandler(context.Background(), &wg, &config.Config{
+				AllowedIps:      []config.IPNet{{IPNet: allowed}},
+				PowerOnCooldown: 30,
+				PowerOnTimeout:  1,
+				StartingPage:    page,
+				Machine:         m,
+				Progress:        progress.NewTracker(),
+			}, staticBackend(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				_, _ = w.Write([]byte("proxied"))
+			})))
+			request := httptest.NewRequest(http.MethodGet, "http://example.test/", nil)
+			request.RemoteAddr = "127.0.0.1:12345"
+			for name, value := range test.headers {
+				request.Header.Set(name, value)
+			}
+			recorder := httptest.NewRecorder()
+
+			handler.ServeHTTP(recorder, request)
+
+			if !test.wantStarted {
+				if recorder.Code != http.StatusOK || recorder.Body.String() != "proxied" {
+					t.Fatalf("response = %d %q, want the proxied backend", recorder.Code, recorder.Body.String())
+				}
+				return
+			}
+			if recorder.Code != http.StatusServiceUnavailable {
+				t.Fatalf("status = %d, want %d", recorder.Code, http.StatusServiceUnavailable)
+			}
+			if got := recorder.Header().Get("Retry-After"); got != "3" {
+				t.Fatalf("Retry-After = %q, want 3", got)
+			}
+			body := recorder.Body.String()
+			for _, want := range []string{"Waking &lt;app&gt;", `content="3"`, `id="status">RUNNING<`, `EventSource("/.ppb/status/stream?path=%2F")`} {
+				if !strings.Contains(body, want) {
+					t.Fatalf("body = %q, want it to contain %q", body, want)
+				}
+			}
+			// The wake continues after the page is returned, tracked for
+			// shutdown.
+			wg.Wait()
+			if m.calls() != 1 {
+				t.Fatalf("power-on calls = %d, want a background wake", m.calls())
+			}
+		})
+	}
+}
+
+func TestHandlerStartingPageShowsFailedWake(t *testing.T) {
+	t.Parallel()
+
+	_, allowed, err := net.ParseCIDR("127.0.0.1/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := &config.StartingPage{Refresh: 3}
+	if err := page.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	m := &countingMachine{err: errors.New("ZONE_RESOURCE_POOL_EXHAUSTED")}
+	var wg sync.WaitGroup
+	handler := newHandler(context.Background(), &wg, &config.Config{
+		AllowedIps:      []config.IPNet{{IPNet: allowed}},
+		PowerOnCooldown: 30,
+		PowerOnTimeout:  1,
+		StartingPage:    page,
+		Machine:         m,
+	}, staticBackend(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})))
+	navigate := func() string {
+		t.Helper()
+		request := httptest.NewRequest(http.MethodGet, "http://example.test/", nil)
+		request.RemoteAddr = "127.0.0.1:12345"
+		request.Header.Set("Sec-Fetch-Mode", "navigate")
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		wg.Wait()
+		return recorder.Body.String()
+	}
+
+	if body := navigate(); !strings.Contains(body, `http-equiv="refresh"`) {
+		t.Fatalf("first page = %q, want a reloading page", body)
+	}
+	body := navigate()
+	if !strings.Contains(body, "ZONE_RESOURCE_POOL_EXHAUSTED") || strings.Contains(body, `http-equiv="refresh"`) {
+		t.Fatalf("page after the failed wake = %q, want the error without a reload", body)
+	}
+	if m.calls() != 1 {
+		t.Fatalf("power-on calls = %d, want the failed wake not retried by its own page", m.calls())
+	}
+	navigate()
+	if m.calls() != 2 {
+		t.Fatalf("power-on calls = %d, want the next navigation to wake again", m.calls())
+	}
+}
+
+func TestHandlerStartingPageWakeStopsOnShutdown(t *testing.T) {
+	t.Parallel()
+
+	_, allowed, err := net.ParseCIDR("127.0.0.1/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := &config.StartingPage{}
+	if err := page.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	m := &countingMachine{block: true}
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	handler := newHandler(ctx, &wg, &config.Config{
+		AllowedIps:      []config.IPNet{{IPNet: allowed}},
+		PowerOnCooldown: 30,
+		PowerOnTimeout:  60,
+		StartingPage:    page,
+		Machine:         m,
+	}, staticBackend(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})))
+	request := httptest.NewRequest(http.MethodGet, "http://example.test/", nil)
+	request.RemoteAddr = "127.0.0.1:12345"
+	request.Header.Set("Sec-Fetch-Mode", "navigate")
+	handler.ServeHTTP(httptest.NewRecorder(), request)
+
+	cancel()
+	stopped := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("background wake outlived shutdown")
+	}
+	if m.calls() != 1 {
+		t.Fatalf("power-on calls = %d, want one background wake", m.calls())
+	}
+}
+
+func TestStatusStreamHandler(t *testing.T) {
+	t.Parallel()
+
+	_, allowed, err := net.ParseCIDR("127.0.0.1/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker := progress.NewTracker()
+	tracker.Status("STAGING")
+	done := make(chan struct{})
+	close(done)
+	handler := statusStreamHandler(&config.Config{
+		AllowedIps: []config.IPNet{{IPNet: allowed}},
+		Machine:    &countingMachine{},
+		Progress:   tracker,
+	}, done)
+
+	for _, test := range []struct {
+		name       string
+		remoteAddr string
+		wantStatus int
+	}{
+		{name: "allowed client", remoteAddr: "127.0.0.1:12345", wantStatus: http.StatusOK},
+		{name: "other client", remoteAddr: "192.0.2.7:12345", wantStatus: http.StatusForbidden},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "http://example.test"+progress.StreamPath, nil)
+			request.RemoteAddr = test.remoteAddr
+			recorder := httptest.NewRecorder()
+
+			handler.ServeHTTP(recorder, request)
+
+			if recorder.Code != test.wantStatus {
+				t.Fatalf("status = %d, want %d", recorder.Code, test.wantStatus)
+			}
+			if test.wantStatus == http.StatusOK && !strings.Contains(recorder.Body.String(), "event: status\ndata: {\"machine\":\"counting\"") {
+				t.Fatalf("body = %q, want the current wake replayed", recorder.Body.String())
+			}
+		})
+	}
+}
+
+func TestStartScheduleRoutineKeepsMachineWarmOncePerMinute(t *testing.T) {
+	m := &countingMachine{}
+	warm := &schedule.Schedule{KeepWarm: []string{"* * * * *"}}
+	if err := warm.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	c := &config.Config{
+		PowerOnCooldown: 30,
+		PowerOnTimeout:  1,
+		Schedule:        warm,
+		Machine:         m,
+		Activity:        activity.NewTracker(),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go startScheduleRoutine(ctx, &wg, c, 5*time.Millisecond)
+	wg.Wait()
+
+	// The window may straddle a minute boundary.
+	if calls := m.calls(); calls < 1 || calls > 2 {
+		t.Fatalf("keep-warm power-ons = %d, want one per minute", calls)
+	}
+}
+
+func TestHandlerWakesEmulatedInstanceEndToEnd(t *testing.T) {
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("hello from the vm"))
+	}))
+	defer app.Close()
+	appURL, err := url.Parse(app.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	emulator := gcetest.New(gcetest.Options{StartDelay: 100 * time.Millisecond},
+		gcetest.Instance{Project: "p", Zone: "z", Name: "vm", NetworkIP: "127.0.0.1"})
+	api := httptest.NewServer(emulator)
+	defer api.Close()
+
+	t.Setenv("PPB_CONFIG_PATH", "")
+	t.Setenv("PPB_YAML", `type: google_compute_engine
+scheme: http
+port: `+appURL.Port()+`
+allowedIps: [127.0.0.1/32]
+powerOnTimeout: 30
+machineMetadata:
+  project_id: p
+  zone: z
+  name: vm
+  usePrivateIp: true
+  endpoint: `+api.URL)
+	c, err := config.LoadConfig()
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	handler := newHandler(context.Background(), &sync.WaitGroup{}, c, func(target *config.Config) http.Handler {
+		return proxy.New(target)
+	})
+
+	request := httptest.NewRequest(http.MethodGet, "http://example.test/", nil)
+	request.RemoteAddr = "127.0.0.1:12345"
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusOK || recorder.Body.String() != "hello from the vm" {
+		t.Fatalf("response = %d %q, want the proxied application", recorder.Code, recorder.Body.String())
+	}
+	if vm, _ := emulator.Instance("p", "z", "vm"); vm.Status != "RUNNING" {
+		t.Fatalf("emulated status = %s, want RUNNING", vm.Status)
+	}
+}
+
+func TestHandlerDoesNotRestartStoppedInstanceWhileClosed(t *testing.T) {
+	emulator := gcetest.New(gcetest.Options{},
+		gcetest.Instance{Project: "p", Zone: "z", Name: "vm", NetworkIP: "127.0.0.1"})
+	api := httptest.NewServer(emulator)
+	defer api.Close()
+
+	t.Setenv("PPB_CONFIG_PATH", "")
+	t.Setenv("PPB_YAML", `type: google_compute_engine
+allowedIps: [127.0.0.1/32]
+powerOnTimeout: 5
+schedule:
+  closed: ["* * * * *"]
+  closedMessage: Closed for maintenance
+machineMetadata:
+  project_id: p
+  zone: z
+  name: vm
+  usePrivateIp: true
+  endpoint: `+api.URL)
+	c, err := config.LoadConfig()
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	// The instance was stopped outside PPB after its last wake, so the cached
+	// host is stale and the power-on cooldown has passed.
+	c.Machine.(interface{ SetHostForTesting(string) }).SetHostForTesting("127.0.0.1")
+	handler := newHandler(context.Background(), &sync.WaitGroup{}, c, staticBackend(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})))
+
+	for range 2 {
+		request := httptest.NewRequest(http.MethodGet, "http://example.test/", nil)
+		request.RemoteAddr = "127.0.0.1:12345"
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+
+		if recorder.Code != http.StatusServiceUnavailable || !strings.Contains(recorder.Body.String(), "Closed for maintenance") {
+			t.Fatalf("response = %d %q, want the closed page", recorder.Code, recorder.Body.String())
+		}
+	}
+	if vm, _ := emulator.Instance("p", "z", "vm"); vm.Status != "TERMINATED" {
+		t.Fatalf("emulated status = %s, want TERMINATED", vm.Status)
+	}
+	if host := c.Machine.Host(); host != "" {
+		t.Fatalf("Host() = %q, want the stale host dropped", host)
+	}
+}
+
+func TestInstanceFlags(t *testing.T) {
+	t.Parallel()
+
+	var instances instanceFlags
+	if err := instances.Set("proj/us-central1-a/app=suspended"); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	if got := instances[0]; got.Project != "proj" || got.Zone != "us-central1-a" || got.Name != "app" || got.Status != "SUSPENDED" {
+		t.Fatalf("instance = %+v", got)
+	}
+	if err := instances.Set("proj/app"); err == nil {
+		t.Fatal("Set() accepted an instance without a zone")
 	}
 }
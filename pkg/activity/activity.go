@@ -0,0 +1,157 @@
+// Package activity records proxied traffic per machine so PPB can tell when a
+// machine has gone quiet.
+package activity
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// maxWindowClients bounds the distinct client addresses kept per window.
+const maxWindowClients = 1000
+
+// Tracker counts in-flight requests for one machine and remembers when
+// traffic last started or finished. Upgraded connections such as WebSockets
+// stay in flight until the proxied connection closes. It also counts client
+// requests and their addresses per window, which the heartbeat reports.
+type Tracker struct {
+	mu          sync.Mutex
+	lastRequest time.Time
+	inFlight    int
+	upgraded    int
+	windowStart time.Time
+	requests    int
+	clients     map[string]struct{}
+	truncated   bool
+	now         func() time.Time
+
+	// lastClientRequest only moves for proxied client requests, not PPB's own
+	// startup, wakes, or keep-warm calls. It is zero until the first one.
+	lastClientRequest time.Time
+}
+
+// NewTracker returns a tracker whose quiet period starts now, so a machine is
+// never considered idle before PPB has been up for the idle window.
+func NewTracker() *Tracker {
+	t := &Tracker{now: time.Now, clients: map[string]struct{}{}}
+	t.lastRequest = t.now()
+	t.windowStart = t.lastRequest
+	return t
+}
+
+// BeginRequest is Begin for a proxied client request, which is also counted
+// in the current window along with the client's address, and is the only
+// traffic that moves the last client request time.
+func (t *Tracker) BeginRequest(clientIP string, upgrade bool) func() {
+	t.mu.Lock()
+	t.requests++
+	if _, seen := t.clients[clientIP]; !seen {
+		if len(t.clients) < maxWindowClients {
+			t.clients[clientIP] = struct{}{}
+		} else {
+			t.truncated = true
+		}
+	}
+	t.mu.Unlock()
+	return t.begin(upgrade, true)
+}
+
+// Begin records the start of a request and returns the function that records
+// its end. upgrade marks a connection upgrade request.
+func (t *Tracker) Begin(upgrade bool) func() {
+	return t.begin(upgrade, false)
+}
+
+func (t *Tracker) begin(upgrade, client bool) func() {
+	t.mu.Lock()
+	t.lastRequest = t.now()
+	if client {
+		t.lastClientRequest = t.lastRequest
+	}
+	t.inFlight++
+	if upgrade {
+		t.upgraded++
+	}
+	t.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.lastRequest = t.now()
+			if client {
+				t.lastClientRequest = t.lastRequest
+			}
+			t.inFlight--
+			if upgrade {
+				t.upgraded--
+			}
+		})
+	}
+}
+
+// Idle reports whether nothing is in flight and no request has started or
+// finished within quiet.
+func (t *Tracker) Idle(quiet time.Duration) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.inFlight == 0 && t.now().Sub(t.lastRequest) >= quiet
+}
+
+// Snapshot is a point-in-time copy of a tracker.
+type Snapshot struct {
+	LastRequest time.Time
+	InFlight    int
+	Upgraded    int
+
+	// LastClientRequest is when a proxied client request last started or
+	// finished, zero when there has been none.
+	LastClientRequest time.Time
+}
+
+// Window is the client traffic counted between two EndWindow calls.
+type Window struct {
+	Start    time.Time
+	Requests int
+	// ClientIPs are the distinct client addresses, sorted. Truncated is set
+	// when there were more than fit.
+	ClientIPs []string
+	Truncated bool
+}
+
+// EndWindow returns the traffic counted since the previous call, or since the
+// tracker was created, and starts a new window.
+func (t *Tracker) EndWindow() Window {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	window := Window{
+		Start:     t.windowStart,
+		Requests:  t.requests,
+		ClientIPs: make([]string, 0, len(t.clients)),
+		Truncated: t.truncated,
+	}
+	for clientIP := range t.clients {
+		window.ClientIPs = append(window.ClientIPs, clientIP)
+	}
+	slices.Sort(window.ClientIPs)
+
+	t.windowStart = t.now()
+	t.requests = 0
+	t.clients = map[string]struct{}{}
+	t.truncated = false
+	return window
+}
+
+// Snapshot returns the tracker's current state.
+func (t *Tracker) Snapshot() Snapshot {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return Snapshot{
+		LastRequest:       t.lastRequest,
+		InFlight:          t.inFlight,
+		Upgraded:          t.upgraded,
+		LastClientRequest: t.lastClientRequest,
+	}
+}
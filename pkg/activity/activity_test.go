@@ -0,0 +1,100 @@
+package activity
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestTrackerIdle(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2026, 1, 5, 9, 0, 0, 0, time.UTC)
+	tracker := NewTracker()
+	tracker.now = func() time.Time { return now }
+	tracker.lastRequest = now
+
+	if tracker.Idle(time.Minute) {
+		t.Fatal("Idle() = true before the quiet period elapsed")
+	}
+
+	done := tracker.Begin(true)
+	now = now.Add(time.Hour)
+	if tracker.Idle(time.Minute) {
+		t.Fatal("Idle() = true while an upgraded connection is open")
+	}
+	if snapshot := tracker.Snapshot(); snapshot.InFlight != 1 || snapshot.Upgraded != 1 {
+		t.Fatalf("Snapshot() = %+v, want one upgraded connection in flight", snapshot)
+	}
+
+	done()
+	done()
+	if snapshot := tracker.Snapshot(); snapshot.InFlight != 0 || snapshot.Upgraded != 0 || !snapshot.LastRequest.Equal(now) {
+		t.Fatalf("Snapshot() = %+v, want the end of the connection recorded once", snapshot)
+	}
+	if tracker.Idle(time.Minute) {
+		t.Fatal("Idle() = true immediately after the connection closed")
+	}
+	now = now.Add(time.Minute)
+	if !tracker.Idle(time.Minute) {
+		t.Fatal("Idle() = false after a quiet minute")
+	}
+}
+
+func TestTrackerWindow(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2026, 1, 5, 9, 0, 0, 0, time.UTC)
+	tracker := NewTracker()
+	tracker.now = func() time.Time { return now }
+	tracker.windowStart = now
+
+	tracker.BeginRequest("203.0.113.9", false)()
+	tracker.BeginRequest("198.51.100.4", false)()
+	done := tracker.BeginRequest("203.0.113.9", true)
+	tracker.Begin(false)()
+
+	now = now.Add(30 * time.Second)
+	window := tracker.EndWindow()
+	if window.Requests != 3 || !window.Start.Equal(now.Add(-30*time.Second)) {
+		t.Fatalf("EndWindow() = %+v, want three client requests since the start", window)
+	}
+	if len(window.ClientIPs) != 2 || window.ClientIPs[0] != "198.51.100.4" || window.ClientIPs[1] != "203.0.113.9" {
+		t.Fatalf("ClientIPs = %v, want the two distinct addresses sorted", window.ClientIPs)
+	}
+
+	done()
+	window = tracker.EndWindow()
+	if window.Requests != 0 || len(window.ClientIPs) != 0 || !window.Start.Equal(now) {
+		t.Fatalf("EndWindow() = %+v, want an empty window starting at the previous end", window)
+	}
+
+	for i := range maxWindowClients + 1 {
+		tracker.BeginRequest(fmt.Sprintf("client-%d", i), false)()
+	}
+	if window = tracker.EndWindow(); len(window.ClientIPs) != maxWindowClients || !window.Truncated {
+		t.Fatalf("EndWindow() kept %d addresses truncated=%v, want the bounded list flagged", len(window.ClientIPs), window.Truncated)
+	}
+}
+
+func TestTrackerLastClientRequest(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2026, 1, 5, 9, 0, 0, 0, time.UTC)
+	tracker := NewTracker()
+	tracker.now = func() time.Time { return now }
+
+	tracker.Begin(false)()
+	if snapshot := tracker.Snapshot(); !snapshot.LastClientRequest.IsZero() {
+		t.Fatalf("LastClientRequest = %s, want none before a client request", snapshot.LastClientRequest)
+	}
+
+	done := tracker.BeginRequest("203.0.113.9", true)
+	now = now.Add(time.Minute)
+	done()
+	now = now.Add(time.Minute)
+	tracker.Begin(false)()
+	if snapshot := tracker.Snapshot(); !snapshot.LastClientRequest.Equal(now.Add(-time.Minute)) || !snapshot.LastRequest.Equal(now) {
+		t.Fatalf("Snapshot() = %+v, want the client request's end kept apart from PPB's own traffic", snapshot)
+	}
+}
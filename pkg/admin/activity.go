@@ -0,0 +1,82 @@
+package admin
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/libops/ppb/pkg/config"
+)
+
+// ActivityPath is where agents on the machines poll for recent traffic. It
+// is served on the proxy port, so an agent reaches it the same way clients
+// reach PPB and the machine needs no port open to PPB besides the app's.
+const ActivityPath = "/.ppb/activity"
+
+// MachineActivity is the traffic PPB has proxied to one machine. IDs match
+// the admin API's. LastRequest and SecondsSinceLastRequest are null until PPB
+// has proxied a client request to the machine.
+type MachineActivity struct {
+	ID                      int        `json:"id"`
+	Machine                 string     `json:"machine"`
+	Host                    string     `json:"host"`
+	LastRequest             *time.Time `json:"lastRequest"`
+	SecondsSinceLastRequest *int       `json:"secondsSinceLastRequest"`
+	OpenConnections         int        `json:"openConnections"`
+	UpgradedConnections     int        `json:"upgradedConnections"`
+}
+
+type activityHandler struct {
+	owners []*config.Config
+	now    func() time.Time
+}
+
+// NewActivityHandler serves the activity endpoint for c, protected by
+// c.ActivityEndpoint.Token.
+func NewActivityHandler(c *config.Config) http.Handler {
+	return newActivityHandler(c, time.Now)
+}
+
+func newActivityHandler(c *config.Config, now func() time.Time) http.Handler {
+	h := &activityHandler{owners: c.Owners(), now: now}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+ActivityPath, h.list)
+	mux.HandleFunc("GET "+ActivityPath+"/{id}", h.get)
+	return authorize([]byte(c.ActivityEndpoint.Token), "ppb-activity", mux)
+}
+
+func (h *activityHandler) list(w http.ResponseWriter, _ *http.Request) {
+	activity := make([]MachineActivity, 0, len(h.owners))
+	for id := range h.owners {
+		activity = append(activity, h.activity(id))
+	}
+	writeJSON(w, http.StatusOK, activity)
+}
+
+func (h *activityHandler) get(w http.ResponseWriter, r *http.Request) {
+	id, ok := machineID(w, r, h.owners)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, h.activity(id))
+}
+
+func (h *activityHandler) activity(id int) MachineActivity {
+	owner := h.owners[id]
+	activity := MachineActivity{
+		ID:      id,
+		Machine: owner.Machine.Describe(),
+		Host:    owner.Machine.Host(),
+	}
+	if owner.Activity == nil {
+		return activity
+	}
+	snapshot := owner.Activity.Snapshot()
+	if !snapshot.LastClientRequest.IsZero() {
+		lastRequest := snapshot.LastClientRequest.UTC()
+		seconds := max(0, int(h.now().Sub(lastRequest).Seconds()))
+		activity.LastRequest, activity.SecondsSinceLastRequest = &lastRequest, &seconds
+	}
+	activity.OpenConnections = snapshot.InFlight
+	activity.UpgradedConnections = snapshot.Upgraded
+	return activity
+}
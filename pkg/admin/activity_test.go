@@ -0,0 +1,71 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/libops/ppb/pkg/activity"
+	"github.com/libops/ppb/pkg/config"
+)
+
+func TestActivityReportsTraffic(t *testing.T) {
+	t.Parallel()
+
+	tracker := activity.NewTracker()
+	closeSocket := tracker.BeginRequest("203.0.113.9", true)
+	defer closeSocket()
+	now := tracker.Snapshot().LastClientRequest.Add(90 * time.Second)
+	h := newActivityHandler(&config.Config{
+		ActivityEndpoint: &config.ActivityEndpoint{Token: "agent"},
+		Admin:            &config.AdminConfig{Token: "secret"},
+		Machine:          &fakeMachine{},
+		Activity:         tracker,
+	}, func() time.Time { return now })
+
+	if recorder := serve(h, http.MethodGet, ActivityPath, "secret"); recorder.Code != http.StatusUnauthorized {
+		t.Fatalf("admin token: status = %d, want %d", recorder.Code, http.StatusUnauthorized)
+	}
+
+	recorder := serve(h, http.MethodGet, ActivityPath, "agent")
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", recorder.Code, http.StatusOK)
+	}
+	var list []MachineActivity
+	if err := json.NewDecoder(recorder.Body).Decode(&list); err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	if len(list) != 1 || list[0].SecondsSinceLastRequest == nil || *list[0].SecondsSinceLastRequest != 90 || list[0].OpenConnections != 1 || list[0].UpgradedConnections != 1 || list[0].Host != "10.0.0.5" {
+		t.Fatalf("activity = %+v, want one machine quiet for 90s with an open WebSocket", list)
+	}
+
+	if recorder := serve(h, http.MethodGet, ActivityPath+"/0", "agent"); recorder.Code != http.StatusOK {
+		t.Fatalf("GET %s/0 status = %d, want %d", ActivityPath, recorder.Code, http.StatusOK)
+	}
+	if recorder := serve(h, http.MethodGet, ActivityPath+"/1", "agent"); recorder.Code != http.StatusNotFound {
+		t.Fatalf("GET %s/1 status = %d, want %d", ActivityPath, recorder.Code, http.StatusNotFound)
+	}
+}
+
+func TestActivityReportsNoRequestBeforeClientTraffic(t *testing.T) {
+	t.Parallel()
+
+	tracker := activity.NewTracker()
+	// A wake is PPB's own traffic, not a client's.
+	tracker.Begin(false)()
+	h := newActivityHandler(&config.Config{
+		ActivityEndpoint: &config.ActivityEndpoint{Token: "agent"},
+		Machine:          &fakeMachine{},
+		Activity:         tracker,
+	}, time.Now)
+
+	recorder := serve(h, http.MethodGet, ActivityPath+"/0", "agent")
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", recorder.Code, http.StatusOK)
+	}
+	if body := recorder.Body.String(); !strings.Contains(body, `"lastRequest":null`) || !strings.Contains(body, `"secondsSinceLastRequest":null`) {
+		t.Fatalf("activity = %s, want no last request before a proxied request", body)
+	}
+}
@@ -0,0 +1,167 @@
+// Package admin serves the token-protected admin API, which reports what PPB
+// believes about each machine and lets operators wake or refresh it, and the
+// activity endpoint that agents on the machines poll.
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libops/ppb/pkg/config"
+)
+
+// Prefix is the path every admin endpoint is served under.
+const Prefix = "/.ppb/admin/"
+
+// MachineStatus is the admin view of one machine. IDs are the machine's
+// position in config order and are stable for the life of the process.
+type MachineStatus struct {
+	ID                       int        `json:"id"`
+	Machine                  string     `json:"machine"`
+	Status                   string     `json:"status"`
+	Host                     string     `json:"host"`
+	LastPowerOnAttempt       *time.Time `json:"lastPowerOnAttempt,omitempty"`
+	CooldownRemainingSeconds int        `json:"cooldownRemainingSeconds"`
+}
+
+type handler struct {
+	ctx    context.Context
+	wg     *sync.WaitGroup
+	token  []byte
+	owners []*config.Config
+	now    func() time.Time
+}
+
+// NewHandler serves the admin API for c. Wakes run in the background under
+// ctx and are tracked by wg, so they outlive the request but stop at shutdown.
+func NewHandler(ctx context.Context, wg *sync.WaitGroup, c *config.Config) http.Handler {
+	return newHandler(ctx, wg, c, time.Now)
+}
+
+func newHandler(ctx context.Context, wg *sync.WaitGroup, c *config.Config, now func() time.Time) http.Handler {
+	h := &handler{
+		ctx:    ctx,
+		wg:     wg,
+		token:  []byte(c.Admin.Token),
+		owners: c.Owners(),
+		now:    now,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+Prefix+"machines", h.list)
+	mux.HandleFunc("GET "+Prefix+"machines/{id}", h.get)
+	mux.HandleFunc("POST "+Prefix+"machines/{id}/wake", h.wake)
+	mux.HandleFunc("POST "+Prefix+"machines/{id}/refresh", h.refresh)
+	return authorize(h.token, "ppb-admin", mux)
+}
+
+// authorize admits requests carrying token as a bearer token.
+func authorize(want []byte, realm string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), want) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+realm+`"`)
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (h *handler) list(w http.ResponseWriter, _ *http.Request) {
+	statuses := make([]MachineStatus, 0, len(h.owners))
+	for id := range h.owners {
+		statuses = append(statuses, h.status(id))
+	}
+	writeJSON(w, http.StatusOK, statuses)
+}
+
+func (h *handler) get(w http.ResponseWriter, r *http.Request) {
+	id, ok := machineID(w, r, h.owners)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, h.status(id))
+}
+
+// wake starts a power-on in the background and returns immediately; poll the
+// machine status to follow it. The wake counts as traffic for idle power-off.
+func (h *handler) wake(w http.ResponseWriter, r *http.Request) {
+	id, ok := machineID(w, r, h.owners)
+	if !ok {
+		return
+	}
+	owner := h.owners[id]
+	if owner.Activity != nil {
+		owner.Activity.Begin(false)()
+	}
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		ctx, cancel := context.WithTimeout(h.ctx, time.Duration(owner.PowerOnTimeout)*time.Second)
+		defer cancel()
+		slog.Info("Admin wake requested", "machine", owner.Machine.Describe())
+		if err := owner.Machine.PowerOnWithCooldown(ctx, owner.PowerOnCooldown); err != nil {
+			slog.Error("Admin wake failed", "machine", owner.Machine.Describe(), "status", owner.Machine.Status(), "err", err)
+		}
+	}()
+	writeJSON(w, http.StatusAccepted, h.status(id))
+}
+
+func (h *handler) refresh(w http.ResponseWriter, r *http.Request) {
+	id, ok := machineID(w, r, h.owners)
+	if !ok {
+		return
+	}
+	if err := h.owners[id].Machine.Refresh(r.Context()); err != nil {
+		slog.Error("Admin refresh failed", "machine", h.owners[id].Machine.Describe(), "err", err)
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, h.status(id))
+}
+
+// machineID parses the {id} path value as an index into owners.
+func machineID(w http.ResponseWriter, r *http.Request, owners []*config.Config) (int, bool) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil || id < 0 || id >= len(owners) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "unknown machine"})
+		return 0, false
+	}
+	return id, true
+}
+
+func (h *handler) status(id int) MachineStatus {
+	owner := h.owners[id]
+	m := owner.Machine
+	status := MachineStatus{
+		ID:      id,
+		Machine: m.Describe(),
+		Status:  m.Status(),
+		Host:    m.Host(),
+	}
+	if last := m.LastAttempt(); !last.IsZero() {
+		status.LastPowerOnAttempt = &last
+		remaining := last.Add(time.Duration(owner.PowerOnCooldown) * time.Second).Sub(h.now())
+		if remaining > 0 {
+			status.CooldownRemainingSeconds = int(math.Ceil(remaining.Seconds()))
+		}
+	}
+	return status
+}
+
+func writeJSON(w http.ResponseWriter, code int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		slog.Debug("Unable to write admin response", "err", err)
+	}
+}
@@ -0,0 +1,189 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libops/ppb/pkg/activity"
+	"github.com/libops/ppb/pkg/config"
+)
+
+// fakeMachine reports fixed state and records wakes and refreshes.
+type fakeMachine struct {
+	mu         sync.Mutex
+	last       time.Time
+	refreshErr error
+	woke       chan struct{}
+	block      bool
+	refreshes  int
+}
+
+func (m *fakeMachine) PowerOnWithCooldown(ctx context.Context, _ int) error {
+	close(m.woke)
+	if m.block {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return nil
+}
+
+func (m *fakeMachine) Host() string           { return "10.0.0.5" }
+func (m *fakeMachine) Status() string         { return "RUNNING" }
+func (m *fakeMachine) Describe() string       { return "fake" }
+func (m *fakeMachine) LastAttempt() time.Time { return m.last }
+func (m *fakeMachine) Wakes() uint64          { return 1 }
+
+func (m *fakeMachine) Refresh(context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.refreshes++
+	return m.refreshErr
+}
+
+func newTestHandler(m *fakeMachine, now time.Time) http.Handler {
+	return newTrackedHandler(context.Background(), &sync.WaitGroup{}, m, now)
+}
+
+func newTrackedHandler(ctx context.Context, wg *sync.WaitGroup, m *fakeMachine, now time.Time) http.Handler {
+	c := &config.Config{
+		Admin:           &config.AdminConfig{Token: "secret"},
+		PowerOnCooldown: 30,
+		PowerOnTimeout:  5,
+		Machine:         m,
+		Activity:        activity.NewTracker(),
+	}
+	return newHandler(ctx, wg, c, func() time.Time { return now })
+}
+
+func serve(h http.Handler, method, path, token string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, "http://ppb.test"+path, nil)
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestAdminRequiresToken(t *testing.T) {
+	t.Parallel()
+
+	h := newTestHandler(&fakeMachine{}, time.Now())
+	for _, token := range []string{"", "wrong"} {
+		recorder := serve(h, http.MethodGet, Prefix+"machines", token)
+		if recorder.Code != http.StatusUnauthorized {
+			t.Fatalf("token %q: status = %d, want %d", token, recorder.Code, http.StatusUnauthorized)
+		}
+		if recorder.Header().Get("WWW-Authenticate") == "" {
+			t.Fatal("unauthorized response omitted WWW-Authenticate")
+		}
+	}
+}
+
+func TestAdminListReportsCooldown(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC)
+	h := newTestHandler(&fakeMachine{last: now.Add(-10 * time.Second)}, now)
+
+	recorder := serve(h, http.MethodGet, Prefix+"machines", "secret")
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", recorder.Code, http.StatusOK)
+	}
+	var statuses []MachineStatus
+	if err := json.NewDecoder(recorder.Body).Decode(&statuses); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if len(statuses) != 1 {
+		t.Fatalf("statuses = %+v, want one machine", statuses)
+	}
+	got := statuses[0]
+	if got.Machine != "fake" || got.Status != "RUNNING" || got.Host != "10.0.0.5" || got.CooldownRemainingSeconds != 20 {
+		t.Fatalf("status = %+v, want RUNNING fake at 10.0.0.5 with 20s cooldown", got)
+	}
+	if got.LastPowerOnAttempt == nil || !got.LastPowerOnAttempt.Equal(now.Add(-10*time.Second)) {
+		t.Fatalf("lastPowerOnAttempt = %v", got.LastPowerOnAttempt)
+	}
+}
+
+func TestAdminWakeRunsInBackground(t *testing.T) {
+	t.Parallel()
+
+	m := &fakeMachine{woke: make(chan struct{})}
+	h := newTestHandler(m, time.Now())
+
+	recorder := serve(h, http.MethodPost, Prefix+"machines/0/wake", "secret")
+	if recorder.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want %d", recorder.Code, http.StatusAccepted)
+	}
+	select {
+	case <-m.woke:
+	case <-time.After(5 * time.Second):
+		t.Fatal("wake did not power on the machine")
+	}
+
+	if recorder := serve(h, http.MethodPost, Prefix+"machines/1/wake", "secret"); recorder.Code != http.StatusNotFound {
+		t.Fatalf("unknown machine status = %d, want %d", recorder.Code, http.StatusNotFound)
+	}
+	if recorder := serve(h, http.MethodGet, Prefix+"machines/0/wake", "secret"); recorder.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("GET wake status = %d, want %d", recorder.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestAdminWakeStopsOnShutdown(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var wg sync.WaitGroup
+	m := &fakeMachine{woke: make(chan struct{}), block: true}
+	h := newTrackedHandler(ctx, &wg, m, time.Now())
+
+	if recorder := serve(h, http.MethodPost, Prefix+"machines/0/wake", "secret"); recorder.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want %d", recorder.Code, http.StatusAccepted)
+	}
+	<-m.woke
+	stopped := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		t.Fatal("shutdown did not wait for the running wake")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("wake did not stop on shutdown")
+	}
+}
+
+func TestAdminRefresh(t *testing.T) {
+	t.Parallel()
+
+	m := &fakeMachine{}
+	h := newTestHandler(m, time.Now())
+	if recorder := serve(h, http.MethodPost, Prefix+"machines/0/refresh", "secret"); recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", recorder.Code, http.StatusOK)
+	}
+
+	m.mu.Lock()
+	m.refreshErr = errors.New("provider unavailable")
+	m.mu.Unlock()
+	if recorder := serve(h, http.MethodPost, Prefix+"machines/0/refresh", "secret"); recorder.Code != http.StatusBadGateway {
+		t.Fatalf("failed refresh status = %d, want %d", recorder.Code, http.StatusBadGateway)
+	}
+	if m.refreshes != 2 {
+		t.Fatalf("refreshes = %d, want 2", m.refreshes)
+	}
+}
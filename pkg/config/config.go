@@ -4,26 +4,55 @@ import (
 	"fmt"
 	"log/slog"
 	"net"
+	"net/http"
 	"os"
 	"strings"
 
+	"github.com/libops/ppb/pkg/activity"
 	"github.com/libops/ppb/pkg/machine"
+	"github.com/libops/ppb/pkg/progress"
+	"github.com/libops/ppb/pkg/schedule"
 	yaml "gopkg.in/yaml.v3"
 )
 
 type Config struct {
-	Type              string         `yaml:"type"`
-	Scheme            string         `yaml:"scheme"`
-	Port              int            `yaml:"port"`
-	AllowedIps        []IPNet        `yaml:"allowedIps"`
-	IpForwardedHeader string         `yaml:"ipForwardedHeader"`
-	IpDepth           int            `yaml:"ipDepth"`
-	PowerOnCooldown   int            `yaml:"powerOnCooldown"` // seconds
-	PowerOnTimeout    int            `yaml:"powerOnTimeout"`  // seconds, default: 360
-	ProxyTimeouts     ProxyTimeouts  `yaml:"proxyTimeouts"`
-	MachineMetadata   map[string]any `yaml:"machineMetadata"`
-	ProxyTarget       *ProxyTarget   `yaml:"proxyTarget"`
-	Machine           *machine.GoogleComputeEngine
+	Type              string             `yaml:"type"`
+	Scheme            string             `yaml:"scheme"`
+	Port              int                `yaml:"port"`
+	AllowedIps        []IPNet            `yaml:"allowedIps"`
+	IpForwardedHeader string             `yaml:"ipForwardedHeader"`
+	IpDepth           int                `yaml:"ipDepth"`
+	PowerOnCooldown   int                `yaml:"powerOnCooldown"` // seconds
+	PowerOnTimeout    int                `yaml:"powerOnTimeout"`  // seconds, default: 360
+	ProxyTimeouts     ProxyTimeouts      `yaml:"proxyTimeouts"`
+	Readiness         *ReadinessProbe    `yaml:"readiness"`
+	Heartbeat         *Heartbeat         `yaml:"heartbeat"`
+	StartingPage      *StartingPage      `yaml:"startingPage"`
+	MachineMetadata   map[string]any     `yaml:"machineMetadata"`
+	ProxyTarget       *ProxyTarget       `yaml:"proxyTarget"`
+	PathPrefix        string             `yaml:"pathPrefix"`  // routes only
+	StripPrefix       bool               `yaml:"stripPrefix"` // routes only
+	Idle              *IdlePolicy        `yaml:"idle"`
+	Schedule          *schedule.Schedule `yaml:"schedule"`
+	Routes            []*Route           `yaml:"routes"`
+	Admin             *AdminConfig       `yaml:"admin"`
+	ActivityEndpoint  *ActivityEndpoint  `yaml:"activityEndpoint"`
+	Machine           machine.Machine
+	// Activity tracks proxied traffic for Machine and is shared by every
+	// target that shares the machine.
+	Activity *activity.Tracker `yaml:"-"`
+	// Progress follows Machine through wakes and is shared the same way.
+	Progress *progress.Tracker `yaml:"-"`
+}
+
+// newProgress returns a progress tracker for m, fed by its power cycle when
+// the backend reports one.
+func newProgress(m machine.Machine) *progress.Tracker {
+	t := progress.NewTracker()
+	if observable, ok := m.(machine.Observable); ok {
+		observable.Observe(t)
+	}
+	return t
 }
 
 // ProxyTarget optionally overrides where requests are proxied to.
@@ -37,6 +66,41 @@ type ProxyTarget struct {
 	Port   int    `yaml:"port"`
 }
 
+// IdlePolicy powers the machine off after a period without proxied traffic.
+// Requests and upgraded connections that are still open keep it running.
+type IdlePolicy struct {
+	Action        string `yaml:"action"`        // stop (default) or suspend
+	After         int    `yaml:"after"`         // seconds without traffic
+	CheckInterval int    `yaml:"checkInterval"` // seconds, default: 60
+}
+
+// AdminConfig enables the admin API. Requests must carry the token as an
+// `Authorization: Bearer` header. Without Listen the API is served on the
+// proxy port under /.ppb/admin/, ahead of allowedIps and routing.
+type AdminConfig struct {
+	Token  string `yaml:"token"`
+	Listen string `yaml:"listen"` // optional separate address, e.g. 127.0.0.1:8081
+}
+
+// ReadinessProbe is an HTTP check the backend must pass after a wake before
+// requests are proxied to it. Accepting connections is not enough for
+// backends whose front server answers 502 until the application has started.
+type ReadinessProbe struct {
+	Path     string `yaml:"path"`
+	Status   int    `yaml:"status"`   // expected response status, default: 200
+	Body     string `yaml:"body"`     // optional text the response body must contain
+	Interval int    `yaml:"interval"` // seconds between probes, default: 2
+	Timeout  int    `yaml:"timeout"`  // seconds to wait for the probe to pass, default: 120
+}
+
+// ActivityEndpoint enables /.ppb/activity, which agents on the machines poll
+// for recent traffic instead of waiting for a heartbeat. It is served on the
+// proxy port ahead of allowedIps and routing, and has its own token so an
+// agent gets no admin rights.
+type ActivityEndpoint struct {
+	Token string `yaml:"token"`
+}
+
 type ProxyTimeouts struct {
 	DialTimeout           int `yaml:"dialTimeout"`           // total connection retry window in seconds, default: 120
 	DialAttemptTimeout    int `yaml:"dialAttemptTimeout"`    // timeout for one connection attempt in seconds, default: 5
@@ -100,33 +164,128 @@ func LoadConfig() (*Config, error) {
 		return nil, err
 	}
 	config.IpForwardedHeader = strings.TrimSpace(config.IpForwardedHeader)
-	if config.IpDepth < 0 {
-		return nil, fmt.Errorf("ipDepth must not be negative")
+	if err := config.validate(); err != nil {
+		return nil, err
 	}
-	if config.IpDepth > 0 && config.IpForwardedHeader == "" {
-		return nil, fmt.Errorf("ipForwardedHeader is required when ipDepth is greater than zero")
+	if config.PathPrefix != "" || config.StripPrefix {
+		return nil, fmt.Errorf("pathPrefix and stripPrefix are only supported on routes")
+	}
+	if config.Admin != nil && config.Admin.Token == "" {
+		return nil, fmt.Errorf("admin token is required")
+	}
+	if config.ActivityEndpoint != nil && config.ActivityEndpoint.Token == "" {
+		return nil, fmt.Errorf("activityEndpoint token is required")
 	}
 
-	switch config.Type {
-	case "google_compute_engine":
-		gce := machine.NewGceMachine()
-		machineYAML, _ := yaml.Marshal(config.MachineMetadata)
-		if err := yaml.Unmarshal(machineYAML, &gce); err != nil {
+	// With routes, the top-level machine is an optional default for hosts no
+	// route matches.
+	if len(config.Routes) == 0 || len(config.MachineMetadata) > 0 {
+		config.Machine, err = machine.New(config.Type, config.MachineMetadata)
+		if err != nil {
 			return nil, err
 		}
-		slog.Debug("loaded gce config", "gce", gce)
-		config.Machine = gce
-	default:
-		return nil, fmt.Errorf("unknown machine type: %s", config.Type)
+		config.Activity = activity.NewTracker()
+		config.Progress = newProgress(config.Machine)
+	}
+	if err := config.loadIdle(); err != nil {
+		return nil, err
+	}
+	if err := config.loadSchedule(); err != nil {
+		return nil, err
+	}
+	if config.Machine != nil {
+		if err := config.loadHeartbeat(); err != nil {
+			return nil, err
+		}
+	} else if config.Heartbeat != nil {
+		return nil, fmt.Errorf("heartbeat requires machineMetadata")
+	}
+	if err := config.loadReadiness(); err != nil {
+		return nil, err
+	}
+	if err := config.loadStartingPage(); err != nil {
+		return nil, err
 	}
 
 	// Set default proxy timeouts if not specified
 	config.setPowerDefaults()
 	config.setProxyTimeoutDefaults()
 
+	if err := config.loadRoutes(); err != nil {
+		return nil, err
+	}
+
 	return &config, nil
 }
 
+func (c *Config) validate() error {
+	if c.IpDepth < 0 {
+		return fmt.Errorf("ipDepth must not be negative")
+	}
+	if c.IpDepth > 0 && c.IpForwardedHeader == "" {
+		return fmt.Errorf("ipForwardedHeader is required when ipDepth is greater than zero")
+	}
+	return nil
+}
+
+func (c *Config) loadIdle() error {
+	if c.Idle == nil {
+		return nil
+	}
+	if c.Machine == nil {
+		return fmt.Errorf("idle requires machineMetadata")
+	}
+	if _, ok := c.Machine.(machine.Stopper); !ok {
+		return fmt.Errorf("machine type %s does not support idle power-off", c.Type)
+	}
+	switch c.Idle.Action {
+	case "":
+		c.Idle.Action = "stop"
+	case "stop", "suspend":
+	default:
+		return fmt.Errorf("idle action must be stop or suspend, got %q", c.Idle.Action)
+	}
+	if c.Idle.After <= 0 {
+		return fmt.Errorf("idle after must be a positive number of seconds")
+	}
+	if c.Idle.CheckInterval <= 0 {
+		c.Idle.CheckInterval = 60
+	}
+	return nil
+}
+
+func (c *Config) loadSchedule() error {
+	if c.Schedule == nil {
+		return nil
+	}
+	if c.Machine == nil {
+		return fmt.Errorf("schedule requires machineMetadata")
+	}
+	return c.Schedule.Compile()
+}
+
+func (c *Config) loadReadiness() error {
+	if c.Readiness == nil {
+		return nil
+	}
+	if !strings.HasPrefix(c.Readiness.Path, "/") {
+		return fmt.Errorf("readiness path %q must start with /", c.Readiness.Path)
+	}
+	if c.Readiness.Status == 0 {
+		c.Readiness.Status = http.StatusOK
+	}
+	if c.Readiness.Status < 100 || c.Readiness.Status > 599 {
+		return fmt.Errorf("readiness status %d is not an HTTP status", c.Readiness.Status)
+	}
+	if c.Readiness.Interval <= 0 {
+		c.Readiness.Interval = 2
+	}
+	if c.Readiness.Timeout <= 0 {
+		c.Readiness.Timeout = 120
+	}
+	return nil
+}
+
 func (c *Config) setPowerDefaults() {
 	if c.PowerOnCooldown <= 0 {
 		c.PowerOnCooldown = 30
@@ -6,8 +6,10 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"testing"
 
+	"github.com/libops/ppb/pkg/machine"
 	yaml "gopkg.in/yaml.v3"
 )
 
@@ -422,6 +424,13 @@ machineMetadata:
 			wantErr:  false,
 			wantType: "google_compute_engine",
 		},
+		{
+			name: "unknown machine type via PPB_YAML",
+			yamlContent: `type: carrier_pigeon
+scheme: https
+port: 443`,
+			wantErr: true,
+		},
 		{
 			name:        "invalid YAML via PPB_YAML",
 			yamlContent: "invalid: yaml: content: [[[",
@@ -502,8 +511,12 @@ machineMetadata:
 		return
 	}
 
-	if config.Machine.ProjectId != "from-env-var" {
-		t.Errorf("LoadConfig() should load from PPB_YAML, got project_id = %v, want from-env-var", config.Machine.ProjectId)
+	gce, ok := config.Machine.(*machine.GoogleComputeEngine)
+	if !ok {
+		t.Fatalf("LoadConfig() Machine = %T, want *machine.GoogleComputeEngine", config.Machine)
+	}
+	if gce.ProjectId != "from-env-var" {
+		t.Errorf("LoadConfig() should load from PPB_YAML, got project_id = %v, want from-env-var", gce.ProjectId)
 	}
 }
 
@@ -587,3 +600,486 @@ proxyTimeouts: {}
 		})
 	}
 }
+
+func TestLoadConfigRoutes(t *testing.T) {
+	t.Setenv("PPB_CONFIG_PATH", "")
+	t.Setenv("PPB_YAML", `type: google_compute_engine
+scheme: https
+port: 443
+allowedIps:
+  - 10.0.0.0/8
+powerOnCooldown: 45
+routes:
+  - hosts: [app.example.com]
+    machineMetadata:
+      project_id: test-project
+      zone: us-central1-a
+      name: app
+  - hosts: ["*.dev.example.com", "DEV.example.com:8443"]
+    scheme: http
+    port: 8080
+    allowedIps:
+      - 192.0.2.0/24
+    machineMetadata:
+      project_id: test-project
+      zone: us-central1-b
+      name: dev`)
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	if config.Machine != nil {
+		t.Fatal("top-level machine was created without top-level machineMetadata")
+	}
+	if len(config.Targets()) != 2 {
+		t.Fatalf("Targets() = %d, want 2 routes", len(config.Targets()))
+	}
+
+	app := config.Match("App.Example.com:443", "/")
+	if app == nil || app.Machine.Describe() != "google_compute_engine test-project/us-central1-a/app" {
+		t.Fatalf("Match(app) = %+v, want app route", app)
+	}
+	if app.Scheme != "https" || app.Port != 443 || app.PowerOnCooldown != 45 || app.ProxyTimeouts.DialTimeout != 120 {
+		t.Fatalf("app route = %+v, want inherited settings", app)
+	}
+	if len(app.AllowedIps) != 1 || app.AllowedIps[0].String() != "10.0.0.0/8" {
+		t.Fatalf("app allowedIps = %v, want inherited allowlist", app.AllowedIps)
+	}
+
+	dev := config.Match("feature-1.dev.example.com", "/")
+	if dev == nil || dev.Port != 8080 || dev.Scheme != "http" || dev.AllowedIps[0].String() != "192.0.2.0/24" {
+		t.Fatalf("Match(wildcard) = %+v, want dev route", dev)
+	}
+	if config.Match("dev.example.com", "/") != dev {
+		t.Fatal("Match(dev.example.com) did not use the normalized exact host")
+	}
+	if dev.Machine == app.Machine {
+		t.Fatal("routes share one machine and therefore one power-on lock")
+	}
+	if dev.Progress == nil || dev.Progress == app.Progress {
+		t.Fatal("routes with their own machines do not have their own progress trackers")
+	}
+	if config.Match("other.example.com", "/") != nil {
+		t.Fatal("Match(unrouted host) returned a target without a default machine")
+	}
+}
+
+func TestConfigMatchPrefersExactThenLongestWildcard(t *testing.T) {
+	t.Parallel()
+
+	exact := &Route{Hosts: []string{"a.b.example.com"}}
+	long := &Route{Hosts: []string{"*.b.example.com"}}
+	short := &Route{Hosts: []string{"*.example.com"}}
+	defaultMachine := machine.NewGceMachine()
+	config := &Config{Routes: []*Route{short, long, exact}, Machine: defaultMachine}
+
+	tests := []struct {
+		host string
+		want *Config
+	}{
+		{host: "a.b.example.com", want: &exact.Config},
+		{host: "c.b.example.com", want: &long.Config},
+		{host: "c.example.com", want: &short.Config},
+		{host: "example.com", want: config},
+		{host: "[::1]:8080", want: config},
+	}
+	for _, test := range tests {
+		if got := config.Match(test.host, "/"); got != test.want {
+			t.Errorf("Match(%q) returned the wrong route", test.host)
+		}
+	}
+}
+
+func TestLoadConfigRejectsInvalidRoutes(t *testing.T) {
+	tests := map[string]string{
+		"missing hosts": `routes:
+  - machineMetadata: {name: a}`,
+		"missing machine without default": `type: google_compute_engine
+routes:
+  - hosts: [a.example.com]`,
+		"duplicate host": `type: google_compute_engine
+routes:
+  - hosts: [a.example.com]
+    machineMetadata: {project_id: p, zone: z, name: a}
+  - hosts: [A.example.com]
+    machineMetadata: {project_id: p, zone: z, name: b}`,
+		"inner wildcard": `type: google_compute_engine
+routes:
+  - hosts: [a.*.example.com]
+    machineMetadata: {project_id: p, zone: z, name: a}`,
+		"strip without prefix": `type: google_compute_engine
+machineMetadata: {project_id: p, zone: z, name: a}
+routes:
+  - hosts: [a.example.com]
+    stripPrefix: true`,
+		"root prefix": `type: google_compute_engine
+machineMetadata: {project_id: p, zone: z, name: a}
+routes:
+  - pathPrefix: /`,
+		"route without type": `routes:
+  - hosts: [a.example.com]
+    machineMetadata: {project_id: p, zone: z, name: a}`,
+	}
+	for name, yamlContent := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv("PPB_CONFIG_PATH", "")
+			t.Setenv("PPB_YAML", yamlContent)
+			if _, err := LoadConfig(); err == nil {
+				t.Fatal("LoadConfig() unexpectedly accepted invalid routes")
+			}
+		})
+	}
+}
+
+func TestLoadConfigPathRoutes(t *testing.T) {
+	t.Setenv("PPB_CONFIG_PATH", "")
+	t.Setenv("PPB_YAML", `type: google_compute_engine
+scheme: http
+port: 80
+allowedIps:
+  - 0.0.0.0/0
+machineMetadata:
+  project_id: test-project
+  zone: us-central1-a
+  name: workspace
+routes:
+  - pathPrefix: /jupyter/
+    stripPrefix: true
+    machineMetadata:
+      project_id: test-project
+      zone: us-central1-a
+      name: jupyter
+  - hosts: [team.example.com]
+    pathPrefix: /api
+    proxyTarget:
+      host: 127.0.0.1
+      port: 8000`)
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	if got := len(config.Machines()); got != 2 {
+		t.Fatalf("Machines() = %d, want top-level and jupyter", got)
+	}
+
+	jupyter := config.Match("team.example.com", "/jupyter/lab")
+	if jupyter == nil || jupyter.PathPrefix != "/jupyter" || !jupyter.StripPrefix {
+		t.Fatalf("Match(/jupyter/lab) = %+v, want jupyter route with normalized prefix", jupyter)
+	}
+	api := config.Match("team.example.com", "/api/v1")
+	if api == nil || api.Machine != config.Machine || api.ProxyTarget == nil {
+		t.Fatalf("Match(/api/v1) = %+v, want api route sharing the top-level machine", api)
+	}
+	if got := config.Match("team.example.com", "/apix"); got != config {
+		t.Fatal("Match(/apix) matched a prefix inside a path segment")
+	}
+	if got := config.Match("other.example.com", "/api"); got != config {
+		t.Fatal("Match(other host /api) ignored the route host")
+	}
+}
+
+func TestLoadConfigRoutesMergeProxyTimeouts(t *testing.T) {
+	t.Setenv("PPB_CONFIG_PATH", "")
+	t.Setenv("PPB_YAML", `type: google_compute_engine
+machineMetadata: {project_id: p, zone: z, name: a}
+proxyTimeouts:
+  dialTimeout: 300
+  keepAlive: 30
+routes:
+  - pathPrefix: /api
+    proxyTimeouts:
+      dialAttemptTimeout: 2`)
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	got := config.Match("example.com", "/api").ProxyTimeouts
+	if got.DialAttemptTimeout != 2 || got.DialTimeout != 300 || got.KeepAlive != 30 || got.IdleConnTimeout != 90 {
+		t.Fatalf("route ProxyTimeouts = %+v, want its override merged over the parent's values", got)
+	}
+}
+
+func TestLoadConfigRejectsTopLevelPathPrefix(t *testing.T) {
+	t.Setenv("PPB_CONFIG_PATH", "")
+	t.Setenv("PPB_YAML", `type: google_compute_engine
+pathPrefix: /api
+machineMetadata: {project_id: p, zone: z, name: a}`)
+
+	if _, err := LoadConfig(); err == nil {
+		t.Fatal("LoadConfig() unexpectedly accepted a top-level pathPrefix")
+	}
+}
+
+func TestLoadConfigIdlePolicy(t *testing.T) {
+	t.Setenv("PPB_CONFIG_PATH", "")
+	t.Setenv("PPB_YAML", `type: google_compute_engine
+machineMetadata: {project_id: p, zone: z, name: a}
+idle:
+  after: 1800`)
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	if config.Idle.Action != "stop" || config.Idle.CheckInterval != 60 {
+		t.Fatalf("Idle = %+v, want stop every 60 seconds", config.Idle)
+	}
+	if config.Activity == nil {
+		t.Fatal("Activity tracker was not created for the machine")
+	}
+
+	for name, yamlContent := range map[string]string{
+		"unsupported backend": `type: docker_container
+machineMetadata: {container: app}
+idle: {after: 60}`,
+		"unknown action": `type: google_compute_engine
+machineMetadata: {project_id: p, zone: z, name: a}
+idle: {after: 60, action: hibernate}`,
+		"missing quiet period": `type: google_compute_engine
+machineMetadata: {project_id: p, zone: z, name: a}
+idle: {action: suspend}`,
+		"shared route machine": `type: google_compute_engine
+machineMetadata: {project_id: p, zone: z, name: a}
+routes:
+  - pathPrefix: /api
+    idle: {after: 60}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv("PPB_YAML", yamlContent)
+			if _, err := LoadConfig(); err == nil {
+				t.Fatal("LoadConfig() unexpectedly accepted the idle policy")
+			}
+		})
+	}
+}
+
+func TestLoadConfigSchedule(t *testing.T) {
+	t.Setenv("PPB_CONFIG_PATH", "")
+	t.Setenv("PPB_YAML", `type: google_compute_engine
+machineMetadata: {project_id: p, zone: z, name: a}
+schedule:
+  timezone: Europe/Berlin
+  keepWarm: ["45 7 * * MON-FRI"]
+  closed: ["* * * * SAT,SUN"]
+routes:
+  - pathPrefix: /api`)
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	if config.Match("example.com", "/api").Schedule != config.Schedule {
+		t.Fatal("route sharing the top-level machine does not share its schedule")
+	}
+
+	t.Setenv("PPB_YAML", `type: google_compute_engine
+machineMetadata: {project_id: p, zone: z, name: a}
+schedule:
+  closed: ["* * * SAT"]`)
+	if _, err := LoadConfig(); err == nil {
+		t.Fatal("LoadConfig() accepted an invalid cron expression")
+	}
+}
+
+func TestLoadConfigAdmin(t *testing.T) {
+	t.Setenv("PPB_CONFIG_PATH", "")
+	t.Setenv("PPB_YAML", `type: google_compute_engine
+machineMetadata: {project_id: p, zone: z, name: a}
+admin:
+  token: secret
+  listen: 127.0.0.1:8081`)
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	if config.Admin.Token != "secret" || config.Admin.Listen != "127.0.0.1:8081" {
+		t.Fatalf("Admin = %+v", config.Admin)
+	}
+
+	for name, yamlContent := range map[string]string{
+		"missing token": `type: google_compute_engine
+machineMetadata: {project_id: p, zone: z, name: a}
+admin: {listen: 127.0.0.1:8081}`,
+		"route admin": `type: google_compute_engine
+machineMetadata: {project_id: p, zone: z, name: a}
+routes:
+  - pathPrefix: /api
+    admin: {token: secret}`,
+		"missing activity token": `type: google_compute_engine
+machineMetadata: {project_id: p, zone: z, name: a}
+activityEndpoint: {}`,
+		"route activity endpoint": `type: google_compute_engine
+machineMetadata: {project_id: p, zone: z, name: a}
+routes:
+  - pathPrefix: /api
+    activityEndpoint: {token: agent}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv("PPB_YAML", yamlContent)
+			if _, err := LoadConfig(); err == nil {
+				t.Fatal("LoadConfig() unexpectedly accepted the admin config")
+			}
+		})
+	}
+}
+
+func TestLoadConfigReadiness(t *testing.T) {
+	t.Setenv("PPB_CONFIG_PATH", "")
+	t.Setenv("PPB_YAML", `type: google_compute_engine
+machineMetadata: {project_id: p, zone: z, name: a}
+readiness:
+  path: /healthz
+routes:
+  - pathPrefix: /api`)
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	want := ReadinessProbe{Path: "/healthz", Status: 200, Interval: 2, Timeout: 120}
+	if *config.Readiness != want {
+		t.Fatalf("Readiness = %+v, want %+v", *config.Readiness, want)
+	}
+	if config.Match("example.com", "/api").Readiness != config.Readiness {
+		t.Fatal("route did not inherit the readiness probe")
+	}
+
+	for name, yamlContent := range map[string]string{
+		"relative path": `type: google_compute_engine
+machineMetadata: {project_id: p, zone: z, name: a}
+readiness: {path: healthz}`,
+		"invalid status": `type: google_compute_engine
+machineMetadata: {project_id: p, zone: z, name: a}
+readiness: {path: /healthz, status: 2000}`,
+		"route path": `type: google_compute_engine
+machineMetadata: {project_id: p, zone: z, name: a}
+routes:
+  - pathPrefix: /api
+    readiness: {status: 204}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv("PPB_YAML", yamlContent)
+			if _, err := LoadConfig(); err == nil {
+				t.Fatal("LoadConfig() unexpectedly accepted the readiness probe")
+			}
+		})
+	}
+}
+
+func TestLoadConfigHeartbeat(t *testing.T) {
+	t.Setenv("PPB_CONFIG_PATH", "")
+	t.Setenv("PPB_YAML", `type: google_compute_engine
+scheme: http
+port: 80
+machineMetadata: {project_id: p, zone: z, name: a}
+routes:
+  - pathPrefix: /api
+  - hosts: [other.example]
+    type: google_compute_engine
+    machineMetadata: {project_id: p, zone: z, name: b}
+    proxyTarget: {scheme: https, host: frontend.internal, port: 8443}
+    heartbeat:
+      url: "{scheme}://{host}:{port}/activity?vm={machineHost}"
+      method: post
+      interval: 10
+      onlyWithTraffic: true
+      tls: {serverName: frontend.example}`)
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	if config.Heartbeat.URL != DefaultHeartbeatURL || config.Heartbeat.Method != "GET" || config.Heartbeat.Interval != 30 {
+		t.Fatalf("Heartbeat = %+v, want the :8808/ping default every 30 seconds", config.Heartbeat)
+	}
+	config.Machine.(interface{ SetHostForTesting(string) }).SetHostForTesting("10.0.0.1")
+	if got, ok := config.HeartbeatURL(); !ok || got != "http://10.0.0.1:8808/ping" {
+		t.Fatalf("HeartbeatURL() = %q, %v", got, ok)
+	}
+	if config.Match("example.com", "/api").Heartbeat != config.Heartbeat {
+		t.Fatal("route sharing the top-level machine does not share its heartbeat")
+	}
+
+	route := config.Match("other.example", "/")
+	if _, ok := route.HeartbeatURL(); ok {
+		t.Fatal("HeartbeatURL() rendered before the machine had a host")
+	}
+	route.Machine.(interface{ SetHostForTesting(string) }).SetHostForTesting("fd00::2")
+	if got, _ := route.HeartbeatURL(); got != "https://frontend.internal:8443/activity?vm=[fd00::2]" {
+		t.Fatalf("route HeartbeatURL() = %q", got)
+	}
+	if route.Heartbeat.Method != "POST" || route.Heartbeat.TLSConfig().ServerName != "frontend.example" {
+		t.Fatalf("route Heartbeat = %+v", route.Heartbeat)
+	}
+
+	for name, yamlContent := range map[string]string{
+		"relative url": `type: google_compute_engine
+machineMetadata: {project_id: p, zone: z, name: a}
+heartbeat: {url: "{machineHost}/ping"}`,
+		"invalid method": `type: google_compute_engine
+machineMetadata: {project_id: p, zone: z, name: a}
+heartbeat: {method: "GET /"}`,
+		"missing ca file": `type: google_compute_engine
+machineMetadata: {project_id: p, zone: z, name: a}
+heartbeat: {tls: {caFile: /does/not/exist.pem}}`,
+		"shared route machine": `type: google_compute_engine
+machineMetadata: {project_id: p, zone: z, name: a}
+routes:
+  - pathPrefix: /api
+    heartbeat: {interval: 10}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv("PPB_YAML", yamlContent)
+			if _, err := LoadConfig(); err == nil {
+				t.Fatal("LoadConfig() unexpectedly accepted the heartbeat")
+			}
+		})
+	}
+}
+
+func TestLoadConfigStartingPage(t *testing.T) {
+	dir := t.TempDir()
+	custom := filepath.Join(dir, "starting.html")
+	if err := os.WriteFile(custom, []byte("<p>{{.Title}} is {{.Status}}</p>"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PPB_CONFIG_PATH", "")
+	t.Setenv("PPB_YAML", `type: google_compute_engine
+machineMetadata: {project_id: p, zone: z, name: a}
+startingPage: {}
+routes:
+  - pathPrefix: /api
+  - pathPrefix: /docs
+    startingPage:
+      title: Docs
+      template: `+custom)
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	if config.StartingPage.Title != "Starting up" || config.StartingPage.Message == "" || config.StartingPage.Refresh != 5 {
+		t.Fatalf("StartingPage = %+v, want defaults", *config.StartingPage)
+	}
+	if config.Match("example.com", "/api").StartingPage != config.StartingPage {
+		t.Fatal("route did not inherit the starting page")
+	}
+	var page strings.Builder
+	if err := config.Match("example.com", "/docs").StartingPage.Render(&page, StartingPageData{Title: "Docs", Status: "STAGING"}); err != nil {
+		t.Fatalf("Render() error = %v", err)
+	}
+	if page.String() != "<p>Docs is STAGING</p>" {
+		t.Fatalf("custom page = %q", page.String())
+	}
+
+	t.Setenv("PPB_YAML", `type: google_compute_engine
+machineMetadata: {project_id: p, zone: z, name: a}
+startingPage: {template: `+filepath.Join(dir, "missing.html")+`}`)
+	if _, err := LoadConfig(); err == nil {
+		t.Fatal("LoadConfig() accepted a missing starting page template")
+	}
+}
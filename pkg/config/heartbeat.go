@@ -0,0 +1,144 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// DefaultHeartbeatURL is the heartbeat every machine gets when its
+// configuration has no heartbeat section.
+const DefaultHeartbeatURL = "http://{machineHost}:8808/ping"
+
+// Heartbeat periodically tells software on the machine, such as lightsout,
+// that PPB is still using it. It always belongs to the target that owns the
+// machine.
+type Heartbeat struct {
+	// URL is a template; {machineHost} is the machine's address and {scheme},
+	// {host}, and {port} are the proxy target's, which differ from the
+	// machine's when proxyTarget is set.
+	URL      string            `yaml:"url"`      // default: DefaultHeartbeatURL
+	Method   string            `yaml:"method"`   // default: GET, or POST with Payload
+	Interval int               `yaml:"interval"` // seconds, default: 30
+	Headers  map[string]string `yaml:"headers"`  // e.g. Authorization
+	TLS      HeartbeatTLS      `yaml:"tls"`
+	// Payload sends a JSON activity report with every heartbeat instead of an
+	// empty request.
+	Payload bool `yaml:"payload"`
+	// OnlyWithTraffic skips heartbeats for intervals without proxied traffic,
+	// so PPB's own heartbeat does not keep an unused machine active.
+	OnlyWithTraffic bool `yaml:"onlyWithTraffic"`
+	Disabled        bool `yaml:"disabled"`
+	tlsConfig       *tls.Config
+}
+
+// HeartbeatTLS configures how https heartbeat URLs are verified.
+type HeartbeatTLS struct {
+	CAFile             string `yaml:"caFile"`     // PEM bundle trusted instead of the system roots
+	ServerName         string `yaml:"serverName"` // name verified instead of the URL host
+	InsecureSkipVerify bool   `yaml:"insecureSkipVerify"`
+}
+
+// TLSConfig returns the client TLS configuration for https heartbeats, or nil
+// for the defaults.
+func (h *Heartbeat) TLSConfig() *tls.Config {
+	return h.tlsConfig
+}
+
+func (c *Config) loadHeartbeat() error {
+	if c.Heartbeat == nil {
+		c.Heartbeat = &Heartbeat{}
+	}
+	h := c.Heartbeat
+	if h.URL == "" {
+		h.URL = DefaultHeartbeatURL
+	}
+	if h.Method == "" {
+		h.Method = http.MethodGet
+		if h.Payload {
+			h.Method = http.MethodPost
+		}
+	}
+	h.Method = strings.ToUpper(h.Method)
+	if h.Interval <= 0 {
+		h.Interval = 30
+	}
+	if h.Disabled {
+		return nil
+	}
+
+	rendered := renderHeartbeatURL(h.URL, "192.0.2.1", "http", "192.0.2.1", "80")
+	u, err := url.Parse(rendered)
+	if err != nil {
+		return fmt.Errorf("heartbeat url: %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("heartbeat url %q must be an http or https URL", h.URL)
+	}
+	if _, err := http.NewRequest(h.Method, rendered, nil); err != nil {
+		return fmt.Errorf("heartbeat method: %w", err)
+	}
+
+	if h.TLS != (HeartbeatTLS{}) {
+		h.tlsConfig = &tls.Config{
+			ServerName:         h.TLS.ServerName,
+			InsecureSkipVerify: h.TLS.InsecureSkipVerify, // #nosec G402 -- explicit operator choice
+		}
+		if h.TLS.CAFile != "" {
+			pem, err := os.ReadFile(h.TLS.CAFile) // #nosec G304 -- trusted deployment configuration
+			if err != nil {
+				return fmt.Errorf("heartbeat tls caFile: %w", err)
+			}
+			h.tlsConfig.RootCAs = x509.NewCertPool()
+			if !h.tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+				return fmt.Errorf("heartbeat tls caFile %s contains no certificates", h.TLS.CAFile)
+			}
+		}
+	}
+	return nil
+}
+
+// HeartbeatURL renders the heartbeat URL for the machine's current address.
+// It reports false while the machine has no cached host.
+func (c *Config) HeartbeatURL() (string, bool) {
+	machineHost := c.Machine.Host()
+	if machineHost == "" {
+		return "", false
+	}
+	scheme, host, port := c.Scheme, machineHost, c.Port
+	if c.ProxyTarget != nil {
+		if c.ProxyTarget.Scheme != "" {
+			scheme = c.ProxyTarget.Scheme
+		}
+		if c.ProxyTarget.Host != "" {
+			host = c.ProxyTarget.Host
+		}
+		if c.ProxyTarget.Port != 0 {
+			port = c.ProxyTarget.Port
+		}
+	}
+	return renderHeartbeatURL(c.Heartbeat.URL, machineHost, scheme, host, strconv.Itoa(port)), true
+}
+
+func renderHeartbeatURL(template, machineHost, scheme, host, port string) string {
+	return strings.NewReplacer(
+		"{machineHost}", urlHost(machineHost),
+		"{scheme}", scheme,
+		"{host}", urlHost(host),
+		"{port}", port,
+	).Replace(template)
+}
+
+// urlHost brackets IPv6 addresses so they can be followed by a port.
+func urlHost(host string) string {
+	if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		return "[" + host + "]"
+	}
+	return host
+}
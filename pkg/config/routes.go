@@ -0,0 +1,273 @@
+package config
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"strings"
+
+	"github.com/libops/ppb/pkg/activity"
+	"github.com/libops/ppb/pkg/machine"
+)
+
+// Route serves requests matching its Host headers and path prefix. Settings
+// left unset are inherited from the top-level configuration, except
+// proxyTarget, idle, schedule, and heartbeat, which always belong to one
+// route. A route without machineMetadata shares the top-level machine, its
+// power-on lock, activity, schedule, and heartbeat.
+type Route struct {
+	// Hosts are exact names or "*.example.com" wildcards matching any
+	// subdomain. An empty list matches every host.
+	Hosts  []string `yaml:"hosts"`
+	Config `yaml:",inline"`
+}
+
+// Targets returns every configuration that serves requests: the top-level
+// default, when one is configured, followed by each route.
+func (c *Config) Targets() []*Config {
+	var targets []*Config
+	if c.Machine != nil {
+		targets = append(targets, c)
+	}
+	for _, route := range c.Routes {
+		targets = append(targets, &route.Config)
+	}
+	return targets
+}
+
+// Owners returns the first target of each distinct machine, which carries
+// that machine's idle policy and schedule.
+func (c *Config) Owners() []*Config {
+	var owners []*Config
+	seen := map[machine.Machine]bool{}
+	for _, target := range c.Targets() {
+		if !seen[target.Machine] {
+			seen[target.Machine] = true
+			owners = append(owners, target)
+		}
+	}
+	return owners
+}
+
+// Machines returns each distinct machine once, in target order.
+func (c *Config) Machines() []machine.Machine {
+	var machines []machine.Machine
+	for _, owner := range c.Owners() {
+		machines = append(machines, owner.Machine)
+	}
+	return machines
+}
+
+// Match returns the configuration serving a request for host and path,
+// falling back to the top-level machine. Routes are ranked by host
+// specificity (exact, then longest wildcard, then any host) and then by the
+// longest path prefix. It returns nil when nothing serves the request.
+func (c *Config) Match(host, path string) *Config {
+	host = normalizeHost(host)
+	var best *Config
+	bestHost, bestPath := -2, -1
+	for _, route := range c.Routes {
+		hostScore := route.hostScore(host)
+		if hostScore < -1 || !hasPathPrefix(path, route.PathPrefix) {
+			continue
+		}
+		if hostScore > bestHost || (hostScore == bestHost && len(route.PathPrefix) > bestPath) {
+			best, bestHost, bestPath = &route.Config, hostScore, len(route.PathPrefix)
+		}
+	}
+	if best != nil {
+		return best
+	}
+	if c.Machine != nil {
+		return c
+	}
+	return nil
+}
+
+// hostScore ranks how specifically the route matches host: MaxInt for an
+// exact name, the suffix length for a wildcard, -1 for a route without hosts,
+// and -2 when the route does not match.
+func (r *Route) hostScore(host string) int {
+	if len(r.Hosts) == 0 {
+		return -1
+	}
+	score := -2
+	for _, pattern := range r.Hosts {
+		if pattern == host {
+			return math.MaxInt
+		}
+		suffix, wildcard := strings.CutPrefix(pattern, "*")
+		if wildcard && strings.HasSuffix(host, suffix) && len(suffix) > score {
+			score = len(suffix)
+		}
+	}
+	return score
+}
+
+// hasPathPrefix reports whether prefix matches path on a segment boundary, so
+// /api matches /api and /api/users but not /apix.
+func hasPathPrefix(path, prefix string) bool {
+	if prefix == "" {
+		return true
+	}
+	rest, ok := strings.CutPrefix(path, prefix)
+	return ok && (rest == "" || strings.HasPrefix(rest, "/"))
+}
+
+// normalizeHost lowercases a Host header and removes any port and trailing dot.
+func normalizeHost(host string) string {
+	host = strings.ToLower(strings.TrimSpace(host))
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	}
+	return strings.TrimSuffix(strings.Trim(host, "[]"), ".")
+}
+
+func (c *Config) loadRoutes() error {
+	seen := map[string]bool{}
+	for i, route := range c.Routes {
+		if len(route.Hosts) == 0 && route.PathPrefix == "" {
+			return fmt.Errorf("routes[%d] requires hosts or pathPrefix", i)
+		}
+		if len(route.Routes) > 0 {
+			return fmt.Errorf("routes[%d] must not contain nested routes", i)
+		}
+		if route.Admin != nil || route.ActivityEndpoint != nil {
+			return fmt.Errorf("routes[%d] must not configure admin or activityEndpoint", i)
+		}
+		if route.PathPrefix != "" {
+			if !strings.HasPrefix(route.PathPrefix, "/") || route.PathPrefix == "/" {
+				return fmt.Errorf("routes[%d] pathPrefix %q must start with / and name a path", i, route.PathPrefix)
+			}
+			route.PathPrefix = strings.TrimRight(route.PathPrefix, "/")
+		} else if route.StripPrefix {
+			return fmt.Errorf("routes[%d] stripPrefix requires pathPrefix", i)
+		}
+		for j, pattern := range route.Hosts {
+			pattern = normalizeHost(pattern)
+			if pattern == "" || strings.Contains(strings.TrimPrefix(pattern, "*."), "*") {
+				return fmt.Errorf("routes[%d] host %q must be a name or a leading *. wildcard", i, route.Hosts[j])
+			}
+			key := pattern + route.PathPrefix
+			if seen[key] {
+				return fmt.Errorf("routes[%d] host %q and path %q are already routed", i, pattern, route.PathPrefix)
+			}
+			seen[key] = true
+			route.Hosts[j] = pattern
+		}
+		if len(route.Hosts) == 0 {
+			if seen[route.PathPrefix] {
+				return fmt.Errorf("routes[%d] path %q is already routed", i, route.PathPrefix)
+			}
+			seen[route.PathPrefix] = true
+		}
+
+		route.inherit(c)
+		if err := route.validate(); err != nil {
+			return fmt.Errorf("routes[%d]: %w", i, err)
+		}
+		if err := route.loadReadiness(); err != nil {
+			return fmt.Errorf("routes[%d]: %w", i, err)
+		}
+		if err := route.loadStartingPage(); err != nil {
+			return fmt.Errorf("routes[%d]: %w", i, err)
+		}
+		if len(route.MachineMetadata) == 0 {
+			if c.Machine == nil {
+				return fmt.Errorf("routes[%d] requires machineMetadata when there is no top-level machine", i)
+			}
+			if route.Idle != nil || route.Schedule != nil || route.Heartbeat != nil {
+				return fmt.Errorf("routes[%d] shares the top-level machine and its idle policy, schedule, and heartbeat", i)
+			}
+			route.Machine = c.Machine
+			route.Activity = c.Activity
+			route.Progress = c.Progress
+			route.Schedule = c.Schedule
+			route.Heartbeat = c.Heartbeat
+		} else {
+			var err error
+			route.Machine, err = machine.New(route.Type, route.MachineMetadata)
+			if err != nil {
+				return fmt.Errorf("routes[%d]: %w", i, err)
+			}
+			route.Activity = activity.NewTracker()
+			route.Progress = newProgress(route.Machine)
+			if err := route.loadIdle(); err != nil {
+				return fmt.Errorf("routes[%d]: %w", i, err)
+			}
+			if err := route.loadSchedule(); err != nil {
+				return fmt.Errorf("routes[%d]: %w", i, err)
+			}
+			if err := route.loadHeartbeat(); err != nil {
+				return fmt.Errorf("routes[%d]: %w", i, err)
+			}
+		}
+		route.setPowerDefaults()
+		route.setProxyTimeoutDefaults()
+	}
+	return nil
+}
+
+// inherit fills settings the route left unset from parent.
+func (r *Route) inherit(parent *Config) {
+	if r.Type == "" {
+		r.Type = parent.Type
+	}
+	if r.Scheme == "" {
+		r.Scheme = parent.Scheme
+	}
+	if r.Port == 0 {
+		r.Port = parent.Port
+	}
+	if len(r.AllowedIps) == 0 {
+		r.AllowedIps = parent.AllowedIps
+	}
+	r.IpForwardedHeader = strings.TrimSpace(r.IpForwardedHeader)
+	if r.IpForwardedHeader == "" {
+		// A depth only has meaning alongside the header it counts hops in.
+		r.IpForwardedHeader = parent.IpForwardedHeader
+		r.IpDepth = parent.IpDepth
+	}
+	if r.PowerOnCooldown <= 0 {
+		r.PowerOnCooldown = parent.PowerOnCooldown
+	}
+	if r.PowerOnTimeout <= 0 {
+		r.PowerOnTimeout = parent.PowerOnTimeout
+	}
+	r.ProxyTimeouts.inherit(parent.ProxyTimeouts)
+	if r.Readiness == nil {
+		r.Readiness = parent.Readiness
+	}
+	if r.StartingPage == nil {
+		r.StartingPage = parent.StartingPage
+	}
+}
+
+// inherit fills each timeout the route left unset from parent, so overriding
+// one timeout keeps the parent's values for the others.
+func (t *ProxyTimeouts) inherit(parent ProxyTimeouts) {
+	if t.DialTimeout <= 0 {
+		t.DialTimeout = parent.DialTimeout
+	}
+	if t.DialAttemptTimeout <= 0 {
+		t.DialAttemptTimeout = parent.DialAttemptTimeout
+	}
+	if t.DialRetryInterval <= 0 {
+		t.DialRetryInterval = parent.DialRetryInterval
+	}
+	if t.KeepAlive <= 0 {
+		t.KeepAlive = parent.KeepAlive
+	}
+	if t.IdleConnTimeout <= 0 {
+		t.IdleConnTimeout = parent.IdleConnTimeout
+	}
+	if t.TLSHandshakeTimeout <= 0 {
+		t.TLSHandshakeTimeout = parent.TLSHandshakeTimeout
+	}
+	if t.ExpectContinueTimeout <= 0 {
+		t.ExpectContinueTimeout = parent.ExpectContinueTimeout
+	}
+	if t.MaxIdleConns <= 0 {
+		t.MaxIdleConns = parent.MaxIdleConns
+	}
+}
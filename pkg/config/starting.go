@@ -0,0 +1,99 @@
+package config
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+)
+
+// defaultStartingTemplate is the starting page used without a custom template.
+const defaultStartingTemplate = `<!doctype html>
+<html><head><meta charset="utf-8">{{if not .Error}}<meta http-equiv="refresh" content="{{.RefreshSeconds}}">{{end}}
+<meta name="viewport" content="width=device-width, initial-scale=1"><title>{{.Title}}</title></head>
+<body style="font-family: system-ui, sans-serif; max-width: 36rem; margin: 4rem auto; padding: 0 1rem">
+<h1>{{.Title}}</h1>
+{{if .Error}}<p>The service could not be started: {{.Error}}</p>
+<p>Reload this page to try again.</p>
+{{else}}<p>{{.Message}}</p>
+<p><progress></progress></p>
+<p><small>{{if .Status}}Status: <span id="status">{{.Status}}</span> &middot; {{end}}{{.ElapsedSeconds}}s elapsed. This page refreshes every {{.RefreshSeconds}}s.</small></p>
+{{end}}{{if and .StreamURL (not .Error)}}<script>
+if (window.EventSource) {
+  const status = document.getElementById("status");
+  const stream = new EventSource({{.StreamURL}});
+  stream.addEventListener("status", (e) => { if (status) status.textContent = JSON.parse(e.data).status; });
+  stream.addEventListener("reachable", () => { if (status) status.textContent = "starting services"; });
+  stream.addEventListener("ready", () => { stream.close(); location.reload(); });
+  stream.addEventListener("failed", (e) => { stream.close(); if (status) status.textContent = "failed: " + JSON.parse(e.data).message; });
+}
+</script>{{end}}
+</body></html>
+`
+
+// StartingPage answers browser navigations that would wait for a wake with a
+// page that refreshes itself while the machine starts in the background. API
+// clients still wait for the machine.
+type StartingPage struct {
+	Title   string `yaml:"title"`   // default: Starting up
+	Message string `yaml:"message"` // default: a short explanation
+	Refresh int    `yaml:"refresh"` // seconds between reloads, default: 5
+	// Template is an optional html/template file rendered with
+	// StartingPageData instead of the built-in page.
+	Template string `yaml:"template"`
+	template *template.Template
+}
+
+// StartingPageData is what a starting page template is rendered with.
+type StartingPageData struct {
+	Title          string
+	Message        string
+	Status         string // last provider status, e.g. STAGING
+	ElapsedSeconds int    // since the current wake began
+	RefreshSeconds int
+	// StreamURL is the machine's progress stream, or "" when there is none.
+	StreamURL string
+	// Error is why the last wake started from the page failed, or "". The
+	// built-in page stops reloading while it is set, so a reload by the user
+	// starts the next wake.
+	Error string
+}
+
+func (c *Config) loadStartingPage() error {
+	if c.StartingPage == nil {
+		return nil
+	}
+	return c.StartingPage.Compile()
+}
+
+// Compile applies defaults and parses the template. It must be called before
+// the page is rendered.
+func (p *StartingPage) Compile() error {
+	if p.Title == "" {
+		p.Title = "Starting up"
+	}
+	if p.Message == "" {
+		p.Message = "This service was asleep and is starting. It is usually ready within a minute or two."
+	}
+	if p.Refresh <= 0 {
+		p.Refresh = 5
+	}
+	source := defaultStartingTemplate
+	if p.Template != "" {
+		data, err := os.ReadFile(p.Template) // #nosec G304 -- trusted deployment configuration
+		if err != nil {
+			return fmt.Errorf("startingPage template: %w", err)
+		}
+		source = string(data)
+	}
+	var err error
+	if p.template, err = template.New("starting").Parse(source); err != nil {
+		return fmt.Errorf("startingPage template: %w", err)
+	}
+	return nil
+}
+
+// Render writes the starting page for data.
+func (p *StartingPage) Render(w io.Writer, data StartingPageData) error {
+	return p.template.Execute(w, data)
+}
@@ -0,0 +1,436 @@
+// Package gcetest emulates the part of the Compute Engine API that PPB uses:
+// Instances.Get/Start/Resume/Stop/Suspend and ZoneOperations.Get/List/Wait.
+// Point a google_compute_engine machine's endpoint at it to run PPB end to
+// end without a real project.
+package gcetest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	compute "google.golang.org/api/compute/v1"
+)
+
+// maxWait matches how long the real ZoneOperations.Wait blocks before
+// returning an unfinished operation.
+const maxWait = 2 * time.Minute
+
+// Options controls how long emulated transitions take.
+type Options struct {
+	// StartDelay is how long a start or resume stays in STAGING, and how long
+	// a failing start takes to report its error.
+	StartDelay time.Duration
+	// StopDelay is how long a stop or suspend stays in STOPPING or SUSPENDING.
+	StopDelay time.Duration
+}
+
+// Instance is one emulated VM.
+type Instance struct {
+	Project string
+	Zone    string
+	Name    string
+	// Status is the current status, TERMINATED when added without one.
+	Status    string
+	NetworkIP string
+	NatIP     string
+	// StartError, when set, is the error code every start or resume operation
+	// fails with, e.g. ZONE_RESOURCE_POOL_EXHAUSTED. The instance keeps its
+	// status.
+	StartError string
+	// Denied fails every call for the instance with 403 Forbidden.
+	Denied bool
+	// Spot reports the instance as a spot VM, which Preempt can stop.
+	Spot bool
+}
+
+func (i *Instance) key() string {
+	return i.Project + "/" + i.Zone + "/" + i.Name
+}
+
+type instance struct {
+	Instance
+	// next becomes the status at settleAt.
+	next     string
+	settleAt time.Time
+}
+
+type operation struct {
+	compute.Operation
+	project string
+	doneAt  time.Time
+	errCode string
+}
+
+// Emulator is an http.Handler serving the emulated API. The zero value is not
+// usable; create one with New.
+type Emulator struct {
+	options    Options
+	mu         sync.Mutex
+	instances  map[string]*instance
+	operations map[string]*operation
+	sequence   int
+	mux        *http.ServeMux
+	now        func() time.Time
+}
+
+// New returns an emulator holding instances.
+func New(options Options, instances ...Instance) *Emulator {
+	e := &Emulator{
+		options:    options,
+		instances:  map[string]*instance{},
+		operations: map[string]*operation{},
+		now:        time.Now,
+	}
+	for _, vm := range instances {
+		e.Add(vm)
+	}
+
+	const zone = "/projects/{project}/zones/{zone}"
+	e.mux = http.NewServeMux()
+	e.mux.HandleFunc("GET "+zone+"/instances/{instance}", e.getInstance)
+	e.mux.HandleFunc("POST "+zone+"/instances/{instance}/start", e.mutate("start"))
+	e.mux.HandleFunc("POST "+zone+"/instances/{instance}/resume", e.mutate("resume"))
+	e.mux.HandleFunc("POST "+zone+"/instances/{instance}/stop", e.mutate("stop"))
+	e.mux.HandleFunc("POST "+zone+"/instances/{instance}/suspend", e.mutate("suspend"))
+	e.mux.HandleFunc("GET "+zone+"/operations", e.listOperations)
+	e.mux.HandleFunc("GET "+zone+"/operations/{operation}", e.getOperation)
+	e.mux.HandleFunc("POST "+zone+"/operations/{operation}/wait", e.waitOperation)
+	return e
+}
+
+// Add adds or replaces an instance.
+func (e *Emulator) Add(vm Instance) {
+	if vm.Status == "" {
+		vm.Status = "TERMINATED"
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.instances[vm.key()] = &instance{Instance: vm}
+}
+
+// Instance returns the current state of an instance.
+func (e *Emulator) Instance(project, zone, name string) (Instance, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	vm, ok := e.instances[project+"/"+zone+"/"+name]
+	if !ok {
+		return Instance{}, false
+	}
+	e.settle(vm)
+	return vm.Instance, true
+}
+
+// Update changes an instance in place, e.g. to inject a stockout or to stop
+// it behind PPB's back.
+func (e *Emulator) Update(project, zone, name string, update func(*Instance)) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	vm, ok := e.instances[project+"/"+zone+"/"+name]
+	if !ok {
+		return false
+	}
+	e.settle(vm)
+	update(&vm.Instance)
+	vm.next = ""
+	return true
+}
+
+// Preempt stops a running instance the way Compute Engine reclaims a spot
+// VM, recording a compute.instances.preempted operation for it. A stop made
+// with Update leaves no such operation, like lightsout or an operator would.
+func (e *Emulator) Preempt(project, zone, name string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	vm, ok := e.instances[project+"/"+zone+"/"+name]
+	if !ok {
+		return false
+	}
+	e.settle(vm)
+	vm.Status, vm.next = "TERMINATED", ""
+	op := e.newOperation(vm, "compute.instances.preempted", e.now())
+	e.operations[op.project+"/"+op.Zone+"/"+op.Name] = op
+	return true
+}
+
+// ServeHTTP serves the API at the root and under /compute/v1, so either form
+// works as an endpoint.
+func (e *Emulator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if rest, ok := strings.CutPrefix(r.URL.Path, "/compute/v1"); ok {
+		r = r.Clone(r.Context())
+		r.URL.Path = rest
+		r.URL.RawPath = ""
+	}
+	slog.Debug("Emulated compute request", "method", r.Method, "path", r.URL.Path)
+	e.mux.ServeHTTP(w, r)
+}
+
+// settle applies a pending transition once its time has come. e.mu must be held.
+func (e *Emulator) settle(vm *instance) {
+	if vm.next != "" && !e.now().Before(vm.settleAt) {
+		vm.Status, vm.next = vm.next, ""
+	}
+}
+
+// lookup returns the instance for the request, writing an API error when it
+// is missing or denied. e.mu must be held.
+func (e *Emulator) lookup(w http.ResponseWriter, r *http.Request) *instance {
+	key := r.PathValue("project") + "/" + r.PathValue("zone") + "/" + r.PathValue("instance")
+	vm, ok := e.instances[key]
+	if !ok {
+		writeError(w, http.StatusNotFound, "notFound", fmt.Sprintf("The resource 'projects/%s/zones/%s/instances/%s' was not found", r.PathValue("project"), r.PathValue("zone"), r.PathValue("instance")))
+		return nil
+	}
+	if vm.Denied {
+		writeError(w, http.StatusForbidden, "forbidden", fmt.Sprintf("Required permission denied on resource 'projects/%s/zones/%s/instances/%s'", vm.Project, vm.Zone, vm.Name))
+		return nil
+	}
+	e.settle(vm)
+	return vm
+}
+
+func (e *Emulator) getInstance(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	vm := e.lookup(w, r)
+	if vm == nil {
+		return
+	}
+	nic := &compute.NetworkInterface{Name: "nic0", NetworkIP: vm.NetworkIP}
+	if vm.NatIP != "" {
+		nic.AccessConfigs = []*compute.AccessConfig{{Name: "External NAT", NatIP: vm.NatIP}}
+	}
+	instance := &compute.Instance{
+		Kind:              "compute#instance",
+		Name:              vm.Name,
+		Zone:              vm.Zone,
+		Status:            vm.Status,
+		NetworkInterfaces: []*compute.NetworkInterface{nic},
+	}
+	if vm.Spot {
+		instance.Scheduling = &compute.Scheduling{ProvisioningModel: "SPOT", Preemptible: true}
+	}
+	writeJSON(w, instance)
+}
+
+// transitions lists, for each mutation, the statuses it starts from, the
+// status it passes through, and where it settles.
+var transitions = map[string]struct {
+	from    []string
+	through string
+	to      string
+}{
+	"start":   {from: []string{"TERMINATED"}, through: "STAGING", to: "RUNNING"},
+	"resume":  {from: []string{"SUSPENDED"}, through: "STAGING", to: "RUNNING"},
+	"stop":    {from: []string{"RUNNING", "SUSPENDED"}, through: "STOPPING", to: "TERMINATED"},
+	"suspend": {from: []string{"RUNNING"}, through: "SUSPENDING", to: "SUSPENDED"},
+}
+
+func (e *Emulator) mutate(operationType string) http.HandlerFunc {
+	transition := transitions[operationType]
+	return func(w http.ResponseWriter, r *http.Request) {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		vm := e.lookup(w, r)
+		if vm == nil {
+			return
+		}
+
+		now := e.now()
+		op := e.newOperation(vm, operationType, now)
+		switch {
+		case vm.Status == transition.to || vm.Status == transition.through:
+			// Repeating an accepted mutation is a no-op, as in the real API.
+		case !contains(transition.from, vm.Status):
+			writeError(w, http.StatusBadRequest, "resourceNotReady", fmt.Sprintf("The resource 'projects/%s/zones/%s/instances/%s' is not ready for %s in status %s", vm.Project, vm.Zone, vm.Name, operationType, vm.Status))
+			return
+		case vm.StartError != "" && transition.to == "RUNNING":
+			op.doneAt = now.Add(e.options.StartDelay)
+			op.errCode = vm.StartError
+		default:
+			delay := e.options.StopDelay
+			if transition.to == "RUNNING" {
+				delay = e.options.StartDelay
+			}
+			vm.Status = transition.through
+			vm.next, vm.settleAt = transition.to, now.Add(delay)
+			e.settle(vm)
+			op.doneAt = vm.settleAt
+		}
+		e.operations[op.project+"/"+op.Zone+"/"+op.Name] = op
+		writeJSON(w, e.operationView(op))
+	}
+}
+
+func (e *Emulator) newOperation(vm *instance, operationType string, now time.Time) *operation {
+	e.sequence++
+	return &operation{
+		Operation: compute.Operation{
+			Kind:          "compute#operation",
+			Name:          fmt.Sprintf("operation-%d", e.sequence),
+			OperationType: operationType,
+			Zone:          vm.Zone,
+			TargetLink:    "projects/" + vm.Project + "/zones/" + vm.Zone + "/instances/" + vm.Name,
+			InsertTime:    now.Format(time.RFC3339Nano),
+		},
+		project: vm.Project,
+		doneAt:  now,
+	}
+}
+
+// operationView reports the operation as of now. e.mu must be held.
+func (e *Emulator) operationView(op *operation) *compute.Operation {
+	view := op.Operation
+	if e.now().Before(op.doneAt) {
+		view.Status = "RUNNING"
+		return &view
+	}
+	view.Status = "DONE"
+	view.Progress = 100
+	if op.errCode != "" {
+		message := fmt.Sprintf("Emulated %s failure.", op.errCode)
+		if op.errCode == "ZONE_RESOURCE_POOL_EXHAUSTED" {
+			message = fmt.Sprintf("The zone '%s' does not have enough resources available to fulfill the request.", op.Zone)
+		}
+		view.Error = &compute.OperationError{Errors: []*compute.OperationErrorErrors{{Code: op.errCode, Message: message}}}
+	}
+	return &view
+}
+
+func (e *Emulator) findOperation(w http.ResponseWriter, r *http.Request) *operation {
+	op, ok := e.operations[r.PathValue("project")+"/"+r.PathValue("zone")+"/"+r.PathValue("operation")]
+	if !ok {
+		writeError(w, http.StatusNotFound, "notFound", fmt.Sprintf("The resource 'projects/%s/zones/%s/operations/%s' was not found", r.PathValue("project"), r.PathValue("zone"), r.PathValue("operation")))
+	}
+	return op
+}
+
+// listOperations lists the zone's operations, keeping those matching a filter
+// of field = "value" terms joined by AND on operationType or targetLink.
+func (e *Emulator) listOperations(w http.ResponseWriter, r *http.Request) {
+	terms, err := parseFilter(r.URL.Query().Get("filter"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid", err.Error())
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	list := &compute.OperationList{Kind: "compute#operationList", Items: []*compute.Operation{}}
+	for _, op := range e.operations {
+		if op.project != r.PathValue("project") || op.Zone != r.PathValue("zone") {
+			continue
+		}
+		if terms["operationType"] != "" && op.OperationType != terms["operationType"] {
+			continue
+		}
+		if terms["targetLink"] != "" && op.TargetLink != terms["targetLink"] {
+			continue
+		}
+		list.Items = append(list.Items, e.operationView(op))
+	}
+	writeJSON(w, list)
+}
+
+// parseFilter reads the subset of the list filter syntax listOperations
+// supports.
+func parseFilter(filter string) (map[string]string, error) {
+	terms := map[string]string{}
+	if strings.TrimSpace(filter) == "" {
+		return terms, nil
+	}
+	for _, term := range strings.Split(filter, " AND ") {
+		term = strings.Trim(strings.TrimSpace(term), "()")
+		field, value, ok := strings.Cut(term, "=")
+		field = strings.TrimSpace(field)
+		if !ok || (field != "operationType" && field != "targetLink") {
+			return nil, fmt.Errorf("Invalid list filter expression '%s'", filter)
+		}
+		terms[field] = strings.Trim(strings.TrimSpace(value), `"`)
+	}
+	return terms, nil
+}
+
+func (e *Emulator) getOperation(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if op := e.findOperation(w, r); op != nil {
+		writeJSON(w, e.operationView(op))
+	}
+}
+
+// waitOperation blocks until the operation is done, the request ends, or
+// maxWait passes, then reports it like getOperation.
+func (e *Emulator) waitOperation(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	op := e.findOperation(w, r)
+	if op == nil {
+		e.mu.Unlock()
+		return
+	}
+	wait := min(op.doneAt.Sub(e.now()), maxWait)
+	e.mu.Unlock()
+
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-r.Context().Done():
+			return
+		case <-timer.C:
+		}
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	writeJSON(w, e.operationView(op))
+}
+
+func contains(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		slog.Debug("Unable to write emulated response", "err", err)
+	}
+}
+
+// writeError writes an error in the JSON shape googleapi parses.
+func writeError(w http.ResponseWriter, code int, reason, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	body := map[string]any{"error": map[string]any{
+		"code":    code,
+		"message": message,
+		"errors":  []map[string]string{{"reason": reason, "message": message}},
+	}}
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		slog.Debug("Unable to write emulated response", "err", err)
+	}
+}
+
+// Serve runs the emulator on addr until ctx is cancelled.
+func Serve(ctx context.Context, addr string, e *Emulator) error {
+	server := &http.Server{Addr: addr, Handler: e, ReadHeaderTimeout: 10 * time.Second}
+	errs := make(chan error, 1)
+	go func() { errs <- server.ListenAndServe() }()
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return server.Shutdown(shutdownCtx)
+	}
+}
@@ -0,0 +1,146 @@
+package gcetest
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	compute "google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+)
+
+func newClient(t *testing.T, e *Emulator) *compute.Service {
+	t.Helper()
+	server := httptest.NewServer(e)
+	t.Cleanup(server.Close)
+	service, err := compute.NewService(context.Background(), option.WithEndpoint(server.URL+"/compute/v1/"), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatalf("compute.NewService() error = %v", err)
+	}
+	return service
+}
+
+func TestEmulatorStartPassesThroughStaging(t *testing.T) {
+	t.Parallel()
+
+	e := New(Options{StartDelay: 50 * time.Millisecond}, Instance{Project: "p", Zone: "z", Name: "vm", NetworkIP: "127.0.0.1"})
+	service := newClient(t, e)
+	ctx := context.Background()
+
+	op, err := service.Instances.Start("p", "z", "vm").Context(ctx).Do()
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	vm, err := service.Instances.Get("p", "z", "vm").Context(ctx).Do()
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if vm.Status != "STAGING" || op.Status != "RUNNING" {
+		t.Fatalf("status = %s, operation %s, want STAGING and a running operation", vm.Status, op.Status)
+	}
+
+	op, err = service.ZoneOperations.Wait("p", "z", op.Name).Context(ctx).Do()
+	if err != nil {
+		t.Fatalf("Wait() error = %v", err)
+	}
+	vm, err = service.Instances.Get("p", "z", "vm").Context(ctx).Do()
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if op.Status != "DONE" || op.Error != nil || vm.Status != "RUNNING" {
+		t.Fatalf("after Wait() operation = %s %v, instance = %s", op.Status, op.Error, vm.Status)
+	}
+	if vm.NetworkInterfaces[0].NetworkIP != "127.0.0.1" {
+		t.Fatalf("NetworkIP = %q", vm.NetworkInterfaces[0].NetworkIP)
+	}
+
+	if _, err := service.Instances.Resume("p", "z", "vm").Context(ctx).Do(); err != nil {
+		t.Fatalf("Resume() of a running instance error = %v, want no-op", err)
+	}
+	if _, err := service.Instances.Suspend("p", "z", "vm").Context(ctx).Do(); err != nil {
+		t.Fatalf("Suspend() error = %v", err)
+	}
+	if _, err := service.Instances.Start("p", "z", "vm").Context(ctx).Do(); !isCode(err, http.StatusBadRequest) {
+		t.Fatalf("Start() of a suspended instance error = %v, want 400", err)
+	}
+}
+
+func TestEmulatorStockoutFailsOperation(t *testing.T) {
+	t.Parallel()
+
+	e := New(Options{}, Instance{Project: "p", Zone: "z", Name: "vm", StartError: "ZONE_RESOURCE_POOL_EXHAUSTED"})
+	service := newClient(t, e)
+
+	op, err := service.Instances.Start("p", "z", "vm").Do()
+	if err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	op, err = service.ZoneOperations.Get("p", "z", op.Name).Do()
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if op.Error == nil || op.Error.Errors[0].Code != "ZONE_RESOURCE_POOL_EXHAUSTED" {
+		t.Fatalf("operation error = %+v, want ZONE_RESOURCE_POOL_EXHAUSTED", op.Error)
+	}
+	if vm, _ := e.Instance("p", "z", "vm"); vm.Status != "TERMINATED" {
+		t.Fatalf("status = %s, want TERMINATED after a stockout", vm.Status)
+	}
+}
+
+func TestEmulatorDeniedAndMissingInstances(t *testing.T) {
+	t.Parallel()
+
+	e := New(Options{}, Instance{Project: "p", Zone: "z", Name: "vm", Denied: true})
+	service := newClient(t, e)
+
+	if _, err := service.Instances.Get("p", "z", "vm").Do(); !isCode(err, http.StatusForbidden) {
+		t.Fatalf("Get() of a denied instance error = %v, want 403", err)
+	}
+	if _, err := service.Instances.Get("p", "z", "missing").Do(); !isCode(err, http.StatusNotFound) {
+		t.Fatalf("Get() of a missing instance error = %v, want 404", err)
+	}
+
+	e.Update("p", "z", "vm", func(vm *Instance) { vm.Denied = false })
+	if _, err := service.Instances.Get("p", "z", "vm").Do(); err != nil {
+		t.Fatalf("Get() after Update() error = %v", err)
+	}
+}
+
+func TestEmulatorListsPreemptions(t *testing.T) {
+	t.Parallel()
+
+	e := New(Options{}, Instance{Project: "p", Zone: "z", Name: "vm", Status: "RUNNING", Spot: true})
+	service := newClient(t, e)
+	ctx := context.Background()
+
+	if _, err := service.Instances.Stop("p", "z", "vm").Context(ctx).Do(); err != nil {
+		t.Fatalf("Stop() error = %v", err)
+	}
+	e.Update("p", "z", "vm", func(vm *Instance) { vm.Status = "RUNNING" })
+	if !e.Preempt("p", "z", "vm") {
+		t.Fatal("Preempt() = false")
+	}
+
+	list, err := service.ZoneOperations.List("p", "z").Filter(`operationType = "compute.instances.preempted"`).Context(ctx).Do()
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	if len(list.Items) != 1 || list.Items[0].TargetLink != "projects/p/zones/z/instances/vm" {
+		t.Fatalf("List() = %+v, want only the preemption", list.Items)
+	}
+	if vm, _ := e.Instance("p", "z", "vm"); vm.Status != "TERMINATED" {
+		t.Fatalf("status = %q, want TERMINATED after preemption", vm.Status)
+	}
+	if _, err := service.ZoneOperations.List("p", "z").Filter(`name = "x"`).Context(ctx).Do(); !isCode(err, http.StatusBadRequest) {
+		t.Fatalf("List() with an unsupported filter error = %v, want 400", err)
+	}
+}
+
+func isCode(err error, code int) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == code
+}
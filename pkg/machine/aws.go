@@ -0,0 +1,253 @@
+package machine
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const ec2APIVersion = "2016-11-15"
+
+// AwsEc2 powers on a single EC2 instance through the EC2 Query API.
+type AwsEc2 struct {
+	Region       string `yaml:"region"`
+	InstanceId   string `yaml:"instance_id"`
+	UsePrivateIp bool   `yaml:"usePrivateIp"`
+	// Endpoint overrides https://ec2.<region>.amazonaws.com, e.g. for a
+	// VPC interface endpoint or a local fake.
+	Endpoint string `yaml:"endpoint"`
+	powerState
+	client      *http.Client
+	credentials func() (awsCredentials, error)
+}
+
+type ec2Instance struct {
+	InstanceId       string `xml:"instanceId"`
+	State            string `xml:"instanceState>name"`
+	StateReason      string `xml:"stateReason>code"`
+	PrivateIpAddress string `xml:"privateIpAddress"`
+	IpAddress        string `xml:"ipAddress"`
+}
+
+type ec2DescribeInstancesResponse struct {
+	Reservations []struct {
+		Instances []ec2Instance `xml:"instancesSet>item"`
+	} `xml:"reservationSet>item"`
+}
+
+type ec2ErrorResponse struct {
+	Errors []struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	} `xml:"Errors>Error"`
+}
+
+// ec2APIError is an error document returned by the EC2 Query API.
+type ec2APIError struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *ec2APIError) Error() string {
+	return fmt.Sprintf("ec2 API error %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+func init() {
+	Register("aws_ec2", newAwsEc2FromMetadata)
+}
+
+func NewAwsEc2Machine() *AwsEc2 {
+	return &AwsEc2{
+		powerState:  newPowerState(),
+		client:      &http.Client{Timeout: 30 * time.Second},
+		credentials: awsCredentialsFromEnv,
+	}
+}
+
+func newAwsEc2FromMetadata(metadata map[string]any) (Machine, error) {
+	ec2 := NewAwsEc2Machine()
+	if err := decodeMetadata(metadata, ec2); err != nil {
+		return nil, err
+	}
+	if ec2.Region == "" || ec2.InstanceId == "" {
+		return nil, fmt.Errorf("aws_ec2 machineMetadata requires region and instance_id")
+	}
+	slog.Debug("loaded ec2 config", "ec2", ec2)
+	return ec2, nil
+}
+
+func (m *AwsEc2) Describe() string {
+	return fmt.Sprintf("aws_ec2 %s/%s", m.Region, m.InstanceId)
+}
+
+func (m *AwsEc2) cycle() powerCycle {
+	return powerCycle{powerState: &m.powerState, driver: m, name: m.InstanceId}
+}
+
+func (m *AwsEc2) PowerOn(ctx context.Context) error {
+	return m.cycle().powerOn(ctx)
+}
+
+// Refresh re-reads the machine status and proxy target without starting it.
+func (m *AwsEc2) Refresh(ctx context.Context) error {
+	return m.cycle().refresh(ctx)
+}
+
+// PowerOnWithCooldown attempts to power on the instance if enough time has elapsed since the last attempt
+func (m *AwsEc2) PowerOnWithCooldown(ctx context.Context, cooldownSeconds int) error {
+	return m.cycle().powerOnWithCooldown(ctx, cooldownSeconds)
+}
+
+func (m *AwsEc2) observe(ctx context.Context) (observation, error) {
+	instance, err := m.describeInstance(ctx)
+	if err != nil {
+		return observation{}, err
+	}
+	if instance.State == "stopped" && instance.StateReason == "Client.UserInitiatedHibernate" {
+		slog.Debug("Instance is hibernated", "instance", m.InstanceId)
+	}
+	return observation{
+		status:    instance.State,
+		setTarget: func() error { return m.setIp(instance) },
+	}, nil
+}
+
+func (m *AwsEc2) classify(status string) (instanceStatusAction, error) {
+	return classifyEc2State(status)
+}
+
+// start issues StartInstances. EC2 resumes hibernated instances through the
+// same call, restoring memory from the root volume.
+func (m *AwsEc2) start(ctx context.Context, status string) error {
+	if status != "stopped" {
+		return fmt.Errorf("unknown status: %s", status)
+	}
+	if _, err := m.call(ctx, "StartInstances", url.Values{"InstanceId.1": {m.InstanceId}}); err != nil {
+		return fmt.Errorf("failed to start instance: %w", err)
+	}
+	slog.Info("Power button pressed", "currentStatus", status, "instance", m.InstanceId)
+	return nil
+}
+
+func (m *AwsEc2) describeInstance(ctx context.Context) (*ec2Instance, error) {
+	body, err := m.call(ctx, "DescribeInstances", url.Values{"InstanceId.1": {m.InstanceId}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe instance: %w", err)
+	}
+	var response ec2DescribeInstancesResponse
+	if err := xml.Unmarshal(body, &response); err != nil {
+		return nil, fmt.Errorf("decode DescribeInstances response: %w", err)
+	}
+	for _, reservation := range response.Reservations {
+		for i := range reservation.Instances {
+			if reservation.Instances[i].InstanceId == m.InstanceId {
+				return &reservation.Instances[i], nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("instance %s not found", m.InstanceId)
+}
+
+// call sends one signed EC2 Query API action and returns the response body.
+func (m *AwsEc2) call(ctx context.Context, action string, params url.Values) ([]byte, error) {
+	credentials, err := m.credentials()
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	for key, values := range params {
+		form[key] = values
+	}
+	form.Set("Action", action)
+	form.Set("Version", ec2APIVersion)
+	body := []byte(form.Encode())
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, m.endpoint(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	signAWSv4(request, body, credentials, m.Region, "ec2", m.currentTime())
+
+	response, err := m.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = response.Body.Close() }()
+
+	responseBody, err := io.ReadAll(io.LimitReader(response.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		apiErr := &ec2APIError{StatusCode: response.StatusCode}
+		var errorResponse ec2ErrorResponse
+		if xml.Unmarshal(responseBody, &errorResponse) == nil && len(errorResponse.Errors) > 0 {
+			apiErr.Code = errorResponse.Errors[0].Code
+			apiErr.Message = errorResponse.Errors[0].Message
+		}
+		return nil, apiErr
+	}
+	return responseBody, nil
+}
+
+func (m *AwsEc2) endpoint() string {
+	if m.Endpoint != "" {
+		return m.Endpoint
+	}
+	return fmt.Sprintf("https://ec2.%s.amazonaws.com/", m.Region)
+}
+
+func (m *AwsEc2) setIp(instance *ec2Instance) error {
+	if m.UsePrivateIp {
+		if instance.PrivateIpAddress == "" {
+			return fmt.Errorf("no private IP found for instance %s", m.InstanceId)
+		}
+		m.setHost(instance.PrivateIpAddress)
+		slog.Debug("Found private IP", "ip", instance.PrivateIpAddress)
+		return nil
+	}
+	if instance.IpAddress == "" {
+		return fmt.Errorf("no public IP found for instance %s", m.InstanceId)
+	}
+	m.setHost(instance.IpAddress)
+	slog.Debug("Found public IP", "ip", instance.IpAddress)
+	return nil
+}
+
+// classifyEc2State maps EC2 instance states onto the shared power cycle.
+// Terminated instances cannot be started again.
+func classifyEc2State(state string) (instanceStatusAction, error) {
+	switch state {
+	case "running":
+		return instanceReady, nil
+	case "stopped":
+		return instanceStart, nil
+	case "pending", "stopping":
+		return instanceWait, nil
+	default:
+		return instanceWait, fmt.Errorf("unsupported instance state %q", state)
+	}
+}
+
+func awsCredentialsFromEnv() (awsCredentials, error) {
+	credentials := awsCredentials{
+		AccessKeyId:     strings.TrimSpace(os.Getenv("AWS_ACCESS_KEY_ID")),
+		SecretAccessKey: strings.TrimSpace(os.Getenv("AWS_SECRET_ACCESS_KEY")),
+		SessionToken:    strings.TrimSpace(os.Getenv("AWS_SESSION_TOKEN")),
+	}
+	if credentials.AccessKeyId == "" || credentials.SecretAccessKey == "" {
+		return awsCredentials{}, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+	return credentials, nil
+}
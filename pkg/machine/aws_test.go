@@ -0,0 +1,215 @@
+package machine
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeEc2 serves DescribeInstances and StartInstances for one instance and
+// advances through the configured states on each describe.
+type fakeEc2 struct {
+	mu          sync.Mutex
+	states      []string
+	index       int
+	starts      int
+	startError  string
+	stateReason string
+	unsigned    int
+}
+
+func (f *fakeEc2) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/") {
+		f.unsigned++
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if got := r.PostForm.Get("InstanceId.1"); got != "i-0123456789abcdef0" {
+		http.Error(w, "unexpected instance "+got, http.StatusBadRequest)
+		return
+	}
+
+	switch r.PostForm.Get("Action") {
+	case "DescribeInstances":
+		state := f.states[f.index]
+		if f.index < len(f.states)-1 {
+			f.index++
+		}
+		_, _ = fmt.Fprintf(w, `<DescribeInstancesResponse xmlns="http://ec2.amazonaws.com/doc/2016-11-15/">
+  <reservationSet><item><instancesSet><item>
+    <instanceId>i-0123456789abcdef0</instanceId>
+    <instanceState><code>0</code><name>%s</name></instanceState>
+    <stateReason><code>%s</code></stateReason>
+    <privateIpAddress>10.42.0.8</privateIpAddress>
+    <ipAddress>203.0.113.8</ipAddress>
+  </item></instancesSet></item></reservationSet>
+</DescribeInstancesResponse>`, state, f.stateReason)
+	case "StartInstances":
+		f.starts++
+		if f.startError != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = fmt.Fprintf(w, `<Response><Errors><Error><Code>%s</Code><Message>conflict</Message></Error></Errors></Response>`, f.startError)
+			return
+		}
+		_, _ = fmt.Fprint(w, `<StartInstancesResponse/>`)
+	default:
+		http.Error(w, "unexpected action", http.StatusBadRequest)
+	}
+}
+
+func newTestAwsEc2(t *testing.T, fake *fakeEc2) *AwsEc2 {
+	t.Helper()
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	m := NewAwsEc2Machine()
+	m.Region = "us-east-1"
+	m.InstanceId = "i-0123456789abcdef0"
+	m.Endpoint = server.URL
+	m.pollInterval = time.Millisecond
+	m.joinTimeout = 50 * time.Millisecond
+	m.credentials = func() (awsCredentials, error) {
+		return awsCredentials{AccessKeyId: "AKIDEXAMPLE", SecretAccessKey: "secret"}, nil
+	}
+	return m
+}
+
+func TestAwsEc2PowerOnStartsHibernatedInstance(t *testing.T) {
+	t.Parallel()
+
+	fake := &fakeEc2{
+		states:      []string{"stopped", "pending", "running"},
+		stateReason: "Client.UserInitiatedHibernate",
+	}
+	m := newTestAwsEc2(t, fake)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := m.PowerOnWithCooldown(ctx, 30); err != nil {
+		t.Fatalf("PowerOnWithCooldown() error = %v", err)
+	}
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if fake.starts != 1 {
+		t.Fatalf("StartInstances calls = %d, want 1", fake.starts)
+	}
+	if fake.unsigned != 0 {
+		t.Fatalf("unsigned requests = %d, want every request signed", fake.unsigned)
+	}
+	if host := m.Host(); host != "203.0.113.8" {
+		t.Fatalf("Host() = %q, want public IP 203.0.113.8", host)
+	}
+	if status := m.Status(); status != "running" {
+		t.Fatalf("Status() = %q, want running", status)
+	}
+}
+
+func TestAwsEc2JoinsConflictingStart(t *testing.T) {
+	t.Parallel()
+
+	fake := &fakeEc2{
+		states:     []string{"stopped", "pending", "running"},
+		startError: "IncorrectInstanceState",
+	}
+	m := newTestAwsEc2(t, fake)
+	m.UsePrivateIp = true
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := m.PowerOn(ctx); err != nil {
+		t.Fatalf("PowerOn() should join the competing transition: %v", err)
+	}
+	if host := m.Host(); host != "10.42.0.8" {
+		t.Fatalf("Host() = %q, want private IP 10.42.0.8", host)
+	}
+}
+
+func TestAwsEc2ReturnsPermanentStartError(t *testing.T) {
+	t.Parallel()
+
+	fake := &fakeEc2{
+		states:     []string{"stopped"},
+		startError: "UnauthorizedOperation",
+	}
+	m := newTestAwsEc2(t, fake)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := m.PowerOn(ctx)
+	if err == nil || !strings.Contains(err.Error(), "UnauthorizedOperation") {
+		t.Fatalf("PowerOn() error = %v, want permanent start failure", err)
+	}
+}
+
+func TestAwsEc2RejectsTerminatedInstance(t *testing.T) {
+	t.Parallel()
+
+	m := newTestAwsEc2(t, &fakeEc2{states: []string{"terminated"}})
+
+	if err := m.PowerOn(context.Background()); err == nil {
+		t.Fatal("PowerOn() unexpectedly succeeded for a terminated instance")
+	}
+}
+
+func TestSignAWSv4MatchesDocumentedExample(t *testing.T) {
+	t.Parallel()
+
+	// Example request from the AWS Signature Version 4 documentation.
+	request, err := http.NewRequest(http.MethodGet, "https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	signAWSv4(request, nil, awsCredentials{
+		AccessKeyId:     "AKIDEXAMPLE",
+		SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+	}, "us-east-1", "iam", time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+
+	want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, " +
+		"SignedHeaders=content-type;host;x-amz-date, " +
+		"Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7"
+	if got := request.Header.Get("Authorization"); got != want {
+		t.Fatalf("Authorization = %q, want %q", got, want)
+	}
+}
+
+func TestClassifyEc2State(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		state   string
+		action  instanceStatusAction
+		wantErr bool
+	}{
+		{state: "running", action: instanceReady},
+		{state: "stopped", action: instanceStart},
+		{state: "pending", action: instanceWait},
+		{state: "stopping", action: instanceWait},
+		{state: "shutting-down", action: instanceWait, wantErr: true},
+		{state: "terminated", action: instanceWait, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.state, func(t *testing.T) {
+			t.Parallel()
+			action, err := classifyEc2State(test.state)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("classifyEc2State(%q) error = %v, wantErr %v", test.state, err, test.wantErr)
+			}
+			if action != test.action {
+				t.Fatalf("classifyEc2State(%q) = %v, want %v", test.state, action, test.action)
+			}
+		})
+	}
+}
@@ -0,0 +1,247 @@
+package machine
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Command integrates in-house orchestration: PowerOnAction runs an executable or
+// calls a webhook, and StatusAction reports the machine state and host.
+type Command struct {
+	PowerOnAction commandAction `yaml:"powerOn"`
+	StatusAction  commandAction `yaml:"status"`
+	// Hostname is a static proxy target used when the status output has none.
+	Hostname string `yaml:"host"`
+	// The state lists map status output onto running, startable, and
+	// transitional states. Defaults follow the Compute Engine names.
+	RunningStates []string `yaml:"runningStates"`
+	StartStates   []string `yaml:"startStates"`
+	WaitStates    []string `yaml:"waitStates"`
+	powerState
+	client *http.Client
+}
+
+// commandAction runs Command (argv, no shell) or calls URL.
+type commandAction struct {
+	Command []string          `yaml:"command"`
+	URL     string            `yaml:"url"`
+	Method  string            `yaml:"method"`
+	Headers map[string]string `yaml:"headers"`
+	Timeout int               `yaml:"timeout"` // seconds, default: 30
+}
+
+// commandStatus is the status probe output. Probes print either this JSON
+// object or plain text "<status> [host]".
+type commandStatus struct {
+	Status string `json:"status"`
+	Host   string `json:"host"`
+}
+
+func init() {
+	Register("command", newCommandFromMetadata)
+}
+
+func NewCommandMachine() *Command {
+	return &Command{
+		RunningStates: []string{"RUNNING"},
+		StartStates:   []string{"TERMINATED", "SUSPENDED", "STOPPED"},
+		WaitStates:    []string{"PROVISIONING", "STAGING", "STARTING", "STOPPING", "SUSPENDING", "REPAIRING"},
+		powerState:    newPowerState(),
+		client:        &http.Client{},
+	}
+}
+
+func newCommandFromMetadata(metadata map[string]any) (Machine, error) {
+	command := NewCommandMachine()
+	if err := decodeMetadata(metadata, command); err != nil {
+		return nil, err
+	}
+	if err := command.PowerOnAction.validate("powerOn"); err != nil {
+		return nil, err
+	}
+	if err := command.StatusAction.validate("status"); err != nil {
+		return nil, err
+	}
+	slog.Debug("loaded command config", "command", command)
+	return command, nil
+}
+
+func (a commandAction) validate(name string) error {
+	if (len(a.Command) == 0) == (a.URL == "") {
+		return fmt.Errorf("command machineMetadata %s requires exactly one of command or url", name)
+	}
+	return nil
+}
+
+func (a commandAction) describe() string {
+	if a.URL != "" {
+		return a.URL
+	}
+	return a.Command[0]
+}
+
+func (m *Command) Describe() string {
+	return fmt.Sprintf("command %s", m.PowerOnAction.describe())
+}
+
+func (m *Command) cycle() powerCycle {
+	return powerCycle{powerState: &m.powerState, driver: m, name: m.PowerOnAction.describe()}
+}
+
+func (m *Command) PowerOn(ctx context.Context) error {
+	return m.cycle().powerOn(ctx)
+}
+
+// Refresh re-reads the machine status and proxy target without starting it.
+func (m *Command) Refresh(ctx context.Context) error {
+	return m.cycle().refresh(ctx)
+}
+
+// PowerOnWithCooldown runs the power-on action if enough time has elapsed since the last attempt
+func (m *Command) PowerOnWithCooldown(ctx context.Context, cooldownSeconds int) error {
+	return m.cycle().powerOnWithCooldown(ctx, cooldownSeconds)
+}
+
+func (m *Command) observe(ctx context.Context) (observation, error) {
+	output, err := m.run(ctx, m.StatusAction, http.MethodGet, "")
+	if err != nil {
+		return observation{}, fmt.Errorf("status probe failed: %w", err)
+	}
+	status, err := parseCommandStatus(output)
+	if err != nil {
+		return observation{}, err
+	}
+	return observation{
+		status: status.Status,
+		setTarget: func() error {
+			host := status.Host
+			if host == "" {
+				host = m.Hostname
+			}
+			if host == "" {
+				return fmt.Errorf("status probe reported no host and no static host is configured")
+			}
+			m.setHost(host)
+			return nil
+		},
+	}, nil
+}
+
+func (m *Command) classify(status string) (instanceStatusAction, error) {
+	switch {
+	case slices.Contains(m.RunningStates, status):
+		return instanceReady, nil
+	case slices.Contains(m.StartStates, status):
+		return instanceStart, nil
+	case slices.Contains(m.WaitStates, status):
+		return instanceWait, nil
+	default:
+		return instanceWait, fmt.Errorf("unsupported instance status %q", status)
+	}
+}
+
+func (m *Command) start(ctx context.Context, status string) error {
+	if _, err := m.run(ctx, m.PowerOnAction, http.MethodPost, status); err != nil {
+		return fmt.Errorf("power-on action failed: %w", err)
+	}
+	slog.Info("Power button pressed", "currentStatus", status, "instance", m.PowerOnAction.describe())
+	return nil
+}
+
+// run executes one action and returns its stdout or response body. The
+// observed status is passed as PPB_MACHINE_STATUS or a JSON body.
+func (m *Command) run(ctx context.Context, action commandAction, defaultMethod, status string) ([]byte, error) {
+	timeout := time.Duration(action.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if action.URL != "" {
+		return m.callWebhook(ctx, action, defaultMethod, status)
+	}
+
+	var stdout, stderr bytes.Buffer
+	// The executable and arguments come from trusted deployment configuration
+	// and are passed without a shell.
+	command := exec.CommandContext(ctx, action.Command[0], action.Command[1:]...) // #nosec G204 -- trusted deployment configuration
+	command.Env = append(os.Environ(), "PPB_MACHINE_STATUS="+status)
+	command.Stdout = &stdout
+	command.Stderr = &stderr
+	if err := command.Run(); err != nil {
+		return nil, fmt.Errorf("%s: %w: %s", action.Command[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+func (m *Command) callWebhook(ctx context.Context, action commandAction, defaultMethod, status string) ([]byte, error) {
+	method := action.Method
+	if method == "" {
+		method = defaultMethod
+	}
+	var body io.Reader
+	if method != http.MethodGet {
+		payload, err := json.Marshal(map[string]string{"status": status})
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(payload)
+	}
+	request, err := http.NewRequestWithContext(ctx, method, action.URL, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	for name, value := range action.Headers {
+		request.Header.Set(name, value)
+	}
+
+	response, err := m.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = response.Body.Close() }()
+	responseBody, err := io.ReadAll(io.LimitReader(response.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return nil, fmt.Errorf("%s %s returned %d: %s", method, action.URL, response.StatusCode, strings.TrimSpace(string(responseBody)))
+	}
+	return responseBody, nil
+}
+
+func parseCommandStatus(output []byte) (commandStatus, error) {
+	trimmed := bytes.TrimSpace(output)
+	var status commandStatus
+	if bytes.HasPrefix(trimmed, []byte("{")) {
+		if err := json.Unmarshal(trimmed, &status); err != nil {
+			return commandStatus{}, fmt.Errorf("decode status probe output: %w", err)
+		}
+	} else {
+		fields := strings.Fields(string(trimmed))
+		if len(fields) > 0 {
+			status.Status = fields[0]
+		}
+		if len(fields) > 1 {
+			status.Host = fields[1]
+		}
+	}
+	if status.Status == "" {
+		return commandStatus{}, fmt.Errorf("status probe output has no status")
+	}
+	return status, nil
+}
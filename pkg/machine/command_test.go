@@ -0,0 +1,185 @@
+package machine
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// writeScript writes an executable shell script into dir.
+func writeScript(t *testing.T, dir, name, body string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+body), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCommandMachineRunsPowerOnScript(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	state := filepath.Join(dir, "state")
+	if err := os.WriteFile(state, []byte("STOPPED"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	statusScript := writeScript(t, dir, "status", fmt.Sprintf(`
+case "$(cat %[1]s)" in
+  STOPPED) echo STOPPED ;;
+  STARTING) echo RUNNING > %[1]s; echo STARTING ;;
+  RUNNING) echo '{"status":"RUNNING","host":"10.9.0.4"}' ;;
+esac
+`, state))
+	powerOnScript := writeScript(t, dir, "power-on", fmt.Sprintf(`
+echo "$PPB_MACHINE_STATUS" > %[1]s.seen
+echo STARTING > %[1]s
+`, state))
+
+	m, err := New("command", map[string]any{
+		"powerOn": map[string]any{"command": []string{powerOnScript}},
+		"status":  map[string]any{"command": []string{statusScript}},
+	})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	command := m.(*Command)
+	command.pollInterval = time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := command.PowerOnWithCooldown(ctx, 30); err != nil {
+		t.Fatalf("PowerOnWithCooldown() error = %v", err)
+	}
+	if host := command.Host(); host != "10.9.0.4" {
+		t.Fatalf("Host() = %q, want probe host", host)
+	}
+	seen, err := os.ReadFile(state + ".seen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(seen) != "STOPPED\n" {
+		t.Fatalf("PPB_MACHINE_STATUS = %q, want STOPPED", seen)
+	}
+}
+
+func TestCommandMachineCallsWebhook(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	status := "SUSPENDED"
+	var wakes []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Header.Get("Authorization") != "Bearer hook-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case r.URL.Path == "/status" && r.Method == http.MethodGet:
+			_, _ = fmt.Fprintf(w, "%s\n", status)
+			if status == "STAGING" {
+				status = "RUNNING"
+			}
+		case r.URL.Path == "/wake" && r.Method == http.MethodPost:
+			var body map[string]string
+			_ = json.NewDecoder(r.Body).Decode(&body)
+			wakes = append(wakes, body["status"])
+			status = "STAGING"
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	headers := map[string]any{"Authorization": "Bearer hook-token"}
+	m, err := New("command", map[string]any{
+		"powerOn": map[string]any{"url": server.URL + "/wake", "headers": headers},
+		"status":  map[string]any{"url": server.URL + "/status", "headers": headers},
+		"host":    "vm.internal.example",
+	})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	command := m.(*Command)
+	command.pollInterval = time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := command.PowerOn(ctx); err != nil {
+		t.Fatalf("PowerOn() error = %v", err)
+	}
+	if host := command.Host(); host != "vm.internal.example" {
+		t.Fatalf("Host() = %q, want static host", host)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(wakes) != 1 || wakes[0] != "SUSPENDED" {
+		t.Fatalf("webhook calls = %v, want one wake from SUSPENDED", wakes)
+	}
+}
+
+func TestCommandMachineRejectsUnknownStatus(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	m, err := New("command", map[string]any{
+		"powerOn": map[string]any{"command": []string{writeScript(t, dir, "power-on", "exit 0\n")}},
+		"status":  map[string]any{"command": []string{writeScript(t, dir, "status", "echo DELETED\n")}},
+	})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := m.(*Command).PowerOn(ctx); err == nil {
+		t.Fatal("PowerOn() unexpectedly accepted an unknown status")
+	}
+}
+
+func TestNewCommandRequiresOneActionKind(t *testing.T) {
+	t.Parallel()
+
+	_, err := New("command", map[string]any{
+		"powerOn": map[string]any{"command": []string{"true"}, "url": "http://example.test/wake"},
+		"status":  map[string]any{"command": []string{"true"}},
+	})
+	if err == nil {
+		t.Fatal("New() unexpectedly accepted both command and url")
+	}
+}
+
+func TestParseCommandStatus(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		output string
+		want   commandStatus
+	}{
+		{output: "RUNNING 10.0.0.2\n", want: commandStatus{Status: "RUNNING", Host: "10.0.0.2"}},
+		{output: "STOPPED", want: commandStatus{Status: "STOPPED"}},
+		{output: `{"status":"RUNNING","host":"db.local"}`, want: commandStatus{Status: "RUNNING", Host: "db.local"}},
+	}
+	for _, test := range tests {
+		got, err := parseCommandStatus([]byte(test.output))
+		if err != nil {
+			t.Fatalf("parseCommandStatus(%q) error = %v", test.output, err)
+		}
+		if got != test.want {
+			t.Fatalf("parseCommandStatus(%q) = %+v, want %+v", test.output, got, test.want)
+		}
+	}
+	if _, err := parseCommandStatus([]byte("  \n")); err == nil {
+		t.Fatal("parseCommandStatus() accepted empty output")
+	}
+}
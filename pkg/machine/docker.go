@@ -0,0 +1,226 @@
+package machine
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+)
+
+// DockerContainer starts or unpauses a container through the Docker Engine
+// API and proxies to its address on a container network.
+type DockerContainer struct {
+	// Socket is the Docker Engine unix socket, default /var/run/docker.sock.
+	Socket    string `yaml:"socket"`
+	Container string `yaml:"container"`
+	// Network selects the container network whose IP is used. When empty the
+	// container must be attached to exactly one network.
+	Network string `yaml:"network"`
+	powerState
+	client *http.Client
+}
+
+type dockerContainerJSON struct {
+	State struct {
+		Status string `json:"Status"`
+	} `json:"State"`
+	NetworkSettings struct {
+		Networks map[string]struct {
+			IPAddress         string `json:"IPAddress"`
+			GlobalIPv6Address string `json:"GlobalIPv6Address"`
+		} `json:"Networks"`
+	} `json:"NetworkSettings"`
+}
+
+// dockerAPIError is a non-success response from the Docker Engine API.
+type dockerAPIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *dockerAPIError) Error() string {
+	return fmt.Sprintf("docker API error %d: %s", e.StatusCode, e.Message)
+}
+
+func init() {
+	Register("docker_container", newDockerContainerFromMetadata)
+}
+
+func NewDockerContainerMachine() *DockerContainer {
+	m := &DockerContainer{
+		Socket:     "/var/run/docker.sock",
+		powerState: newPowerState(),
+	}
+	m.client = newDockerClient(func() string { return m.Socket })
+	return m
+}
+
+func newDockerContainerFromMetadata(metadata map[string]any) (Machine, error) {
+	container := NewDockerContainerMachine()
+	if err := decodeMetadata(metadata, container); err != nil {
+		return nil, err
+	}
+	if container.Container == "" {
+		return nil, fmt.Errorf("docker_container machineMetadata requires container")
+	}
+	slog.Debug("loaded docker config", "docker", container)
+	return container, nil
+}
+
+func (m *DockerContainer) Describe() string {
+	return fmt.Sprintf("docker_container %s", m.Container)
+}
+
+func (m *DockerContainer) cycle() powerCycle {
+	return powerCycle{powerState: &m.powerState, driver: m, name: m.Container}
+}
+
+func (m *DockerContainer) PowerOn(ctx context.Context) error {
+	return m.cycle().powerOn(ctx)
+}
+
+// Refresh re-reads the machine status and proxy target without starting it.
+func (m *DockerContainer) Refresh(ctx context.Context) error {
+	return m.cycle().refresh(ctx)
+}
+
+// PowerOnWithCooldown attempts to start the container if enough time has elapsed since the last attempt
+func (m *DockerContainer) PowerOnWithCooldown(ctx context.Context, cooldownSeconds int) error {
+	return m.cycle().powerOnWithCooldown(ctx, cooldownSeconds)
+}
+
+func (m *DockerContainer) observe(ctx context.Context) (observation, error) {
+	var container dockerContainerJSON
+	if err := m.call(ctx, http.MethodGet, "json", &container); err != nil {
+		return observation{}, fmt.Errorf("failed to inspect container: %w", err)
+	}
+	return observation{
+		status:    container.State.Status,
+		setTarget: func() error { return m.setIp(&container) },
+	}, nil
+}
+
+func (m *DockerContainer) classify(status string) (instanceStatusAction, error) {
+	return classifyContainerStatus(status)
+}
+
+func (m *DockerContainer) start(ctx context.Context, status string) error {
+	var operation string
+	switch status {
+	case "created", "exited":
+		operation = "start"
+	case "paused":
+		operation = "unpause"
+	default:
+		return fmt.Errorf("unknown status: %s", status)
+	}
+	if err := m.call(ctx, http.MethodPost, operation, nil); err != nil {
+		return fmt.Errorf("failed to %s container: %w", operation, err)
+	}
+	slog.Info("Power button pressed", "currentStatus", status, "instance", m.Container)
+	return nil
+}
+
+// call sends one request for the configured container and decodes a JSON
+// response into out when it is non-nil.
+func (m *DockerContainer) call(ctx context.Context, method, operation string, out any) error {
+	endpoint := "http://docker/containers/" + url.PathEscape(m.Container) + "/" + operation
+	request, err := http.NewRequestWithContext(ctx, method, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	response, err := m.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = response.Body.Close() }()
+
+	body, err := io.ReadAll(io.LimitReader(response.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	// 304 means the container is already in the requested state.
+	if response.StatusCode >= 300 && response.StatusCode != http.StatusNotModified {
+		apiErr := &dockerAPIError{StatusCode: response.StatusCode, Message: string(body)}
+		var message struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(body, &message) == nil && message.Message != "" {
+			apiErr.Message = message.Message
+		}
+		return apiErr
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(body, out)
+}
+
+// newDockerClient returns an HTTP client that sends every request to the
+// Docker Engine unix socket regardless of the URL host. The socket path is
+// read at dial time, so it can be set after the machine is constructed.
+func newDockerClient(socket func() string) *http.Client {
+	dialer := &net.Dialer{}
+	return &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return dialer.DialContext(ctx, "unix", socket())
+			},
+		},
+	}
+}
+
+func (m *DockerContainer) setIp(container *dockerContainerJSON) error {
+	networks := container.NetworkSettings.Networks
+	name := m.Network
+	if name == "" {
+		if len(networks) != 1 {
+			names := make([]string, 0, len(networks))
+			for network := range networks {
+				names = append(names, network)
+			}
+			sort.Strings(names)
+			return fmt.Errorf("container %s is attached to networks %v; configure network", m.Container, names)
+		}
+		for network := range networks {
+			name = network
+		}
+	}
+
+	network, ok := networks[name]
+	if !ok {
+		return fmt.Errorf("container %s is not attached to network %s", m.Container, name)
+	}
+	ip := network.IPAddress
+	if ip == "" {
+		ip = network.GlobalIPv6Address
+	}
+	if ip == "" {
+		return fmt.Errorf("no IP found for container %s on network %s", m.Container, name)
+	}
+	m.setHost(ip)
+	slog.Debug("Found container IP", "ip", ip, "network", name)
+	return nil
+}
+
+// classifyContainerStatus maps Docker container states onto the shared power
+// cycle. Removed or dead containers cannot be started by PPB.
+func classifyContainerStatus(status string) (instanceStatusAction, error) {
+	switch status {
+	case "running":
+		return instanceReady, nil
+	case "created", "exited", "paused":
+		return instanceStart, nil
+	case "restarting":
+		return instanceWait, nil
+	default:
+		return instanceWait, fmt.Errorf("unsupported container status %q", status)
+	}
+}
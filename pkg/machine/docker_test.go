@@ -0,0 +1,183 @@
+package machine
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDocker serves the container inspect, start, and unpause endpoints for
+// a single container named "wiki".
+type fakeDocker struct {
+	mu         sync.Mutex
+	status     string
+	operations []string
+	networks   string
+}
+
+func (f *fakeDocker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/containers/wiki/json":
+		_, _ = fmt.Fprintf(w, `{"State":{"Status":%q},"NetworkSettings":{"Networks":{%s}}}`, f.status, f.networks)
+	case r.Method == http.MethodPost && r.URL.Path == "/containers/wiki/start":
+		f.operations = append(f.operations, "start")
+		f.status = "running"
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPost && r.URL.Path == "/containers/wiki/unpause":
+		f.operations = append(f.operations, "unpause")
+		f.status = "running"
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = fmt.Fprint(w, `{"message":"No such container"}`)
+	}
+}
+
+func newTestDockerContainer(t *testing.T, fake *fakeDocker, metadata map[string]any) *DockerContainer {
+	t.Helper()
+	metadata["socket"] = serveFakeDocker(t, fake)
+	m, err := New("docker_container", metadata)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	container := m.(*DockerContainer)
+	container.pollInterval = time.Millisecond
+	container.joinTimeout = 50 * time.Millisecond
+	return container
+}
+
+// serveFakeDocker serves fake on a unix socket and returns its path.
+func serveFakeDocker(t *testing.T, fake *fakeDocker) string {
+	t.Helper()
+	socket := filepath.Join(t.TempDir(), "docker.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("listen on unix socket: %v", err)
+	}
+	server := &http.Server{Handler: fake, ReadHeaderTimeout: time.Second}
+	go func() { _ = server.Serve(listener) }()
+	t.Cleanup(func() { _ = server.Close() })
+	return socket
+}
+
+func TestNewDockerContainerMachineCanPowerOn(t *testing.T) {
+	t.Parallel()
+
+	fake := &fakeDocker{status: "exited", networks: `"bridge":{"IPAddress":"172.17.0.2"}`}
+	m := NewDockerContainerMachine()
+	m.Socket = serveFakeDocker(t, fake)
+	m.Container = "wiki"
+	m.pollInterval = time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := m.PowerOn(ctx); err != nil {
+		t.Fatalf("PowerOn() error = %v", err)
+	}
+	if host := m.Host(); host != "172.17.0.2" {
+		t.Fatalf("Host() = %q, want 172.17.0.2", host)
+	}
+}
+
+func TestDockerContainerStartsExitedContainer(t *testing.T) {
+	t.Parallel()
+
+	fake := &fakeDocker{
+		status:   "exited",
+		networks: `"tools":{"IPAddress":"172.18.0.4"},"bridge":{"IPAddress":"172.17.0.2"}`,
+	}
+	m := newTestDockerContainer(t, fake, map[string]any{"container": "wiki", "network": "tools"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := m.PowerOnWithCooldown(ctx, 30); err != nil {
+		t.Fatalf("PowerOnWithCooldown() error = %v", err)
+	}
+	if host := m.Host(); host != "172.18.0.4" {
+		t.Fatalf("Host() = %q, want address on the tools network", host)
+	}
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if strings.Join(fake.operations, ",") != "start" {
+		t.Fatalf("operations = %v, want one start", fake.operations)
+	}
+}
+
+func TestDockerContainerUnpausesPausedContainer(t *testing.T) {
+	t.Parallel()
+
+	fake := &fakeDocker{
+		status:   "paused",
+		networks: `"bridge":{"IPAddress":"172.17.0.2"}`,
+	}
+	m := newTestDockerContainer(t, fake, map[string]any{"container": "wiki"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := m.PowerOn(ctx); err != nil {
+		t.Fatalf("PowerOn() error = %v", err)
+	}
+	if host := m.Host(); host != "172.17.0.2" {
+		t.Fatalf("Host() = %q, want the only network address", host)
+	}
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if strings.Join(fake.operations, ",") != "unpause" {
+		t.Fatalf("operations = %v, want one unpause", fake.operations)
+	}
+}
+
+func TestDockerContainerRequiresNetworkWhenAmbiguous(t *testing.T) {
+	t.Parallel()
+
+	fake := &fakeDocker{
+		status:   "running",
+		networks: `"tools":{"IPAddress":"172.18.0.4"},"bridge":{"IPAddress":"172.17.0.2"}`,
+	}
+	m := newTestDockerContainer(t, fake, map[string]any{"container": "wiki"})
+
+	err := m.PowerOn(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "configure network") {
+		t.Fatalf("PowerOn() error = %v, want ambiguous network failure", err)
+	}
+}
+
+func TestClassifyContainerStatus(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		status  string
+		action  instanceStatusAction
+		wantErr bool
+	}{
+		{status: "running", action: instanceReady},
+		{status: "created", action: instanceStart},
+		{status: "exited", action: instanceStart},
+		{status: "paused", action: instanceStart},
+		{status: "restarting", action: instanceWait},
+		{status: "removing", action: instanceWait, wantErr: true},
+		{status: "dead", action: instanceWait, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.status, func(t *testing.T) {
+			t.Parallel()
+			action, err := classifyContainerStatus(test.status)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("classifyContainerStatus(%q) error = %v, wantErr %v", test.status, err, test.wantErr)
+			}
+			if action != test.action {
+				t.Fatalf("classifyContainerStatus(%q) = %v, want %v", test.status, action, test.action)
+			}
+		})
+	}
+}
@@ -4,98 +4,132 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
-	"sync"
+	"strings"
 	"time"
 
-	"golang.org/x/sync/semaphore"
 	compute "google.golang.org/api/compute/v1"
-	"google.golang.org/api/option"
 )
 
 type GoogleComputeEngine struct {
-	ProjectId          string `yaml:"project_id"`
-	Zone               string `yaml:"zone"`
-	Name               string `yaml:"name"`
-	UsePrivateIp       bool   `yaml:"usePrivateIp"`
-	Lock               *semaphore.Weighted
-	host               string
-	hostMutex          sync.RWMutex
-	LastPowerOnAttempt time.Time
-	getInstanceHook    func(context.Context) (*compute.Instance, error)
-	powerOnHook        func(context.Context, string) error
-	pollInterval       time.Duration
-	joinTimeout        time.Duration
-	now                func() time.Time
+	ProjectId     string `yaml:"project_id"`
+	Zone          string `yaml:"zone"`
+	Name          string `yaml:"name"`
+	gceFailover   `yaml:",inline"`
+	gceAddress    `yaml:",inline"`
+	computeClient `yaml:",inline"`
+	powerState
+	getInstanceHook func(context.Context) (*compute.Instance, error)
+	powerOnHook     func(context.Context, string) error
+	powerOffHook    func(context.Context, bool) error
 }
 
-type instanceStatusAction int
-
-const (
-	instanceReady instanceStatusAction = iota
-	instanceStart
-	instanceWait
-)
+func init() {
+	Register("google_compute_engine", newGceFromMetadata)
+}
 
 func NewGceMachine() *GoogleComputeEngine {
 	return &GoogleComputeEngine{
-		Lock: semaphore.NewWeighted(1),
+		gceFailover: gceFailover{PreemptionLimit: 2},
+		powerState:  newPowerState(),
+	}
+}
+
+func newGceFromMetadata(metadata map[string]any) (Machine, error) {
+	gce := NewGceMachine()
+	if err := decodeMetadata(metadata, gce); err != nil {
+		return nil, err
 	}
+	if err := gce.gceAddress.validate(); err != nil {
+		return nil, fmt.Errorf("google_compute_engine machineMetadata: %w", err)
+	}
+	if err := gce.computeClient.validate(); err != nil {
+		return nil, fmt.Errorf("google_compute_engine machineMetadata: %w", err)
+	}
+	if err := gce.gceFailover.validate(); err != nil {
+		return nil, fmt.Errorf("google_compute_engine machineMetadata: %w", err)
+	}
+	slog.Debug("loaded gce config", "gce", gce)
+	return gce, nil
 }
 
-func (m *GoogleComputeEngine) Host() string {
-	m.hostMutex.RLock()
-	defer m.hostMutex.RUnlock()
-	return m.host
+func (m *GoogleComputeEngine) Describe() string {
+	description := fmt.Sprintf("google_compute_engine %s/%s/%s", m.ProjectId, m.Zone, m.Name)
+	if m.active.Load() > 0 {
+		description += " via failover " + m.current().String()
+	}
+	return description
 }
 
-// SetHostForTesting sets the host IP for testing purposes
-func (m *GoogleComputeEngine) SetHostForTesting(host string) {
-	m.hostMutex.Lock()
-	defer m.hostMutex.Unlock()
-	m.host = host
+func (m *GoogleComputeEngine) cycle() powerCycle {
+	return powerCycle{powerState: &m.powerState, driver: m, name: m.Name}
 }
 
 func (m *GoogleComputeEngine) PowerOn(ctx context.Context) error {
-	// get machine metadata
-	vm, err := m.getInstanceMetadata(ctx)
-	if err != nil {
-		return fmt.Errorf("could not fetch instance metadata: %v", err)
-	}
+	return m.cycle().powerOn(ctx)
+}
+
+// Refresh re-reads the machine status and proxy target without starting it.
+func (m *GoogleComputeEngine) Refresh(ctx context.Context) error {
+	return m.cycle().refresh(ctx)
+}
+
+// PowerOnWithCooldown attempts to power on the machine if enough time has elapsed since the last attempt
+func (m *GoogleComputeEngine) PowerOnWithCooldown(ctx context.Context, cooldownSeconds int) error {
+	return m.cycle().powerOnWithCooldown(ctx, cooldownSeconds)
+}
+
+// PowerOff stops or suspends the instance when it is RUNNING.
+func (m *GoogleComputeEngine) PowerOff(ctx context.Context, suspend bool, stillIdle func() bool) error {
+	return m.cycle().powerOff(ctx, stillIdle, func(ctx context.Context) error {
+		m.stopRequested = true
+		return m.powerOff(ctx, suspend)
+	})
+}
 
-	slog.Debug("Instance status", "status", vm.Status, "instance", m.Name)
-	action, err := classifyInstanceStatus(vm.Status)
+func (m *GoogleComputeEngine) observe(ctx context.Context) (observation, error) {
+	previous := m.Status()
+	vm, err := m.getInstanceMetadata(ctx, m.current())
 	if err != nil {
-		return err
+		return observation{}, err
 	}
-	startRequested := false
-	switch action {
-	case instanceReady:
-		return m.setIp(vm)
-	case instanceStart:
-		if err := m.powerOn(ctx, vm.Status); err != nil {
-			return m.joinAfterPowerOnError(ctx, fmt.Errorf("could not power on: %w", err))
+	if m.preempted(ctx, previous, vm) && m.failover("spot instance was preempted repeatedly") {
+		if vm, err = m.getInstanceMetadata(ctx, m.current()); err != nil {
+			return observation{}, err
 		}
-		startRequested = true
-	case instanceWait:
-		// Another request or operator has already initiated a state change.
-		// Continue through the bounded state loop instead of returning without
-		// a usable target IP.
 	}
+	if vm.Status == "RUNNING" {
+		m.runningAt = time.Now()
+	}
+	return observation{
+		status:    vm.Status,
+		setTarget: func() error { return m.setIp(vm) },
+	}, nil
+}
 
-	return m.waitForInstanceRunning(ctx, startRequested)
+func (m *GoogleComputeEngine) classify(status string) (instanceStatusAction, error) {
+	return classifyInstanceStatus(status)
 }
 
-func (m *GoogleComputeEngine) getInstanceMetadata(ctx context.Context) (*compute.Instance, error) {
+func (m *GoogleComputeEngine) start(ctx context.Context, status string) error {
+	m.stopRequested = false
+	if m.startedCandidate(ctx) != nil {
+		// The power cycle waits on the candidate instead.
+		return nil
+	}
+	return m.startWithFailover(ctx, status)
+}
+
+func (m *GoogleComputeEngine) getInstanceMetadata(ctx context.Context, target gceInstance) (*compute.Instance, error) {
 	if m.getInstanceHook != nil {
 		return m.getInstanceHook(ctx)
 	}
-	computeService, err := compute.NewService(ctx, option.WithScopes(compute.CloudPlatformScope))
+	computeService, err := m.computeService()
 	if err != nil {
-		return nil, fmt.Errorf("failed to create compute service: %v", err)
+		return nil, err
 	}
 
 	// Fetch instance metadata
-	instance, err := computeService.Instances.Get(m.ProjectId, m.Zone, m.Name).Context(ctx).Do()
+	instance, err := computeService.Instances.Get(target.ProjectId, target.Zone, target.Name).Context(ctx).Do()
 	if err != nil {
 		return nil, fmt.Errorf("failed to get instance metadata: %v", err)
 	}
@@ -107,133 +141,99 @@ func (m *GoogleComputeEngine) powerOn(ctx context.Context, status string) error
 	if m.powerOnHook != nil {
 		return m.powerOnHook(ctx, status)
 	}
-	computeService, err := compute.NewService(ctx, option.WithScopes(compute.CloudPlatformScope))
+	computeService, err := m.computeService()
 	if err != nil {
-		return fmt.Errorf("failed to create compute service: %v", err)
+		return err
 	}
+	target := m.current()
+	var op *compute.Operation
 	switch status {
 	case "TERMINATED":
-		_, err := computeService.Instances.Start(m.ProjectId, m.Zone, m.Name).Context(ctx).Do()
-		if err != nil {
-			return fmt.Errorf("failed to start instance: %v", err)
-		}
+		op, err = computeService.Instances.Start(target.ProjectId, target.Zone, target.Name).Context(ctx).Do()
 	case "SUSPENDED":
-		_, err := computeService.Instances.Resume(m.ProjectId, m.Zone, m.Name).Context(ctx).Do()
-		if err != nil {
-			return fmt.Errorf("failed to start instance: %v", err)
-		}
+		op, err = computeService.Instances.Resume(target.ProjectId, target.Zone, target.Name).Context(ctx).Do()
 	default:
 		return fmt.Errorf("unknown status: %s", status)
 	}
+	if err != nil {
+		return fmt.Errorf("failed to start instance: %v", err)
+	}
 
-	slog.Info("Power button pressed", "currentStatus", status, "instance", m.Name)
+	slog.Info("Power button pressed", "currentStatus", status, "instance", target.Name, "zone", target.Zone, "operation", op.Name)
 
-	return nil
+	return m.waitOperation(ctx, computeService, target, op)
 }
 
-// Polls instance metadata until the VM is in the RUNNING state
-func (m *GoogleComputeEngine) waitForInstanceRunning(ctx context.Context, startRequested bool) error {
-	ticker := time.NewTicker(m.effectivePollInterval())
-	defer ticker.Stop()
-
-	seenTransition := false
-
-	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case <-ticker.C:
-			vm, err := m.getInstanceMetadata(ctx)
-			if err != nil {
-				slog.Warn("Failed to fetch instance status, retrying...", "error", err)
-				continue
-			}
-
-			slog.Debug("Polling instance status", "status", vm.Status, "instance", m.Name)
-
-			action, err := classifyInstanceStatus(vm.Status)
-			if err != nil {
-				return err
-			}
-			switch action {
-			case instanceReady:
-				return m.setIp(vm)
-			case instanceStart:
-				if startRequested && !seenTransition {
-					// The start/resume API can become visible before the instance
-					// status changes. Avoid issuing the same mutation twice.
-					continue
-				}
-				if err := m.powerOn(ctx, vm.Status); err != nil {
-					return m.joinAfterPowerOnError(ctx, fmt.Errorf("could not power on after transitional state: %w", err))
-				}
-				startRequested = true
-				seenTransition = false
-			case instanceWait:
-				seenTransition = true
-				continue
+// waitOperation blocks until a zone operation is DONE and returns an
+// *OperationError when it finished with errors. An operation that cannot be
+// read is not a failure: the power cycle still polls the instance status.
+func (m *GoogleComputeEngine) waitOperation(ctx context.Context, computeService *compute.Service, target gceInstance, op *compute.Operation) error {
+	for op.Status != "DONE" {
+		// Wait returns when the operation is done or after about two minutes.
+		next, err := computeService.ZoneOperations.Wait(target.ProjectId, target.Zone, op.Name).Context(ctx).Do()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
 			}
+			slog.Warn("Unable to wait for zone operation, polling instance status", "operation", op.Name, "instance", target.Name, "error", err)
+			return nil
 		}
+		op = next
 	}
+	if op.Error == nil || len(op.Error.Errors) == 0 {
+		return nil
+	}
+	return &OperationError{Type: op.OperationType, Name: op.Name, Errors: op.Error.Errors}
 }
 
-// joinAfterPowerOnError handles the cross-process race where another Cloud
-// Run revision starts or resumes the same VM after both observed a terminal
-// state. A conflicting mutation is successful from PPB's perspective once the
-// instance is observed transitioning or running. Permanent failures still
-// return within a short bounded window.
-func (m *GoogleComputeEngine) joinAfterPowerOnError(ctx context.Context, powerErr error) error {
-	timer := time.NewTimer(m.effectiveJoinTimeout())
-	defer timer.Stop()
-	ticker := time.NewTicker(m.effectivePollInterval())
-	defer ticker.Stop()
-
-	for {
-		vm, err := m.getInstanceMetadata(ctx)
-		if err == nil {
-			action, classifyErr := classifyInstanceStatus(vm.Status)
-			if classifyErr != nil {
-				return classifyErr
-			}
-			switch action {
-			case instanceReady:
-				return m.setIp(vm)
-			case instanceWait:
-				return m.waitForInstanceRunning(ctx, false)
-			case instanceStart:
-				// The competing operation might not be visible yet.
-			}
-		}
-
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case <-timer.C:
-			return powerErr
-		case <-ticker.C:
-		}
-	}
+// OperationError reports a Compute Engine operation that was accepted and
+// then failed, e.g. a start with ZONE_RESOURCE_POOL_EXHAUSTED.
+type OperationError struct {
+	Type   string
+	Name   string
+	Errors []*compute.OperationErrorErrors
 }
 
-func (m *GoogleComputeEngine) effectivePollInterval() time.Duration {
-	if m.pollInterval > 0 {
-		return m.pollInterval
+func (e *OperationError) Error() string {
+	details := make([]string, 0, len(e.Errors))
+	for _, operationErr := range e.Errors {
+		details = append(details, operationErr.Code+": "+operationErr.Message)
 	}
-	return 2 * time.Second
+	return fmt.Sprintf("%s operation %s failed: %s", e.Type, e.Name, strings.Join(details, "; "))
 }
 
-func (m *GoogleComputeEngine) effectiveJoinTimeout() time.Duration {
-	if m.joinTimeout > 0 {
-		return m.joinTimeout
+// Codes returns the structured error codes reported by the operation.
+func (e *OperationError) Codes() []string {
+	codes := make([]string, 0, len(e.Errors))
+	for _, operationErr := range e.Errors {
+		codes = append(codes, operationErr.Code)
 	}
-	return 10 * time.Second
+	return codes
 }
 
-func (m *GoogleComputeEngine) currentTime() time.Time {
-	if m.now != nil {
-		return m.now()
+func (e *OperationError) operationFailed() {}
+
+func (m *GoogleComputeEngine) powerOff(ctx context.Context, suspend bool) error {
+	if m.powerOffHook != nil {
+		return m.powerOffHook(ctx, suspend)
+	}
+	computeService, err := m.computeService()
+	if err != nil {
+		return err
 	}
-	return time.Now()
+	target := m.current()
+	if suspend {
+		_, err = computeService.Instances.Suspend(target.ProjectId, target.Zone, target.Name).Context(ctx).Do()
+	} else {
+		_, err = computeService.Instances.Stop(target.ProjectId, target.Zone, target.Name).Context(ctx).Do()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to power off instance: %v", err)
+	}
+
+	slog.Info("Power off requested", "suspend", suspend, "instance", target.Name, "zone", target.Zone)
+
+	return nil
 }
 
 func classifyInstanceStatus(status string) (instanceStatusAction, error) {
@@ -250,95 +250,112 @@ func classifyInstanceStatus(status string) (instanceStatusAction, error) {
 }
 
 func (m *GoogleComputeEngine) setIp(vm *compute.Instance) error {
-	if len(vm.NetworkInterfaces) == 0 {
-		return fmt.Errorf("no network interfaces found for instance %s", m.Name)
-	}
-
-	if m.UsePrivateIp && vm.NetworkInterfaces[0].NetworkIP == "" {
-		return fmt.Errorf("no private IP found for instance %s", m.Name)
+	target := m.current()
+	host, err := m.instanceHost(vm, target.ProjectId, target.Zone, target.Name)
+	if err != nil {
+		return err
 	}
+	m.setHost(host)
+	return nil
+}
 
-	m.hostMutex.Lock()
-	defer m.hostMutex.Unlock()
+// gceAddress selects which address of a Compute Engine instance is the proxy
+// target. By default that is the first external NAT IP, or with UsePrivateIp
+// the first NIC's internal IP.
+type gceAddress struct {
+	UsePrivateIp bool `yaml:"usePrivateIp"`
+	// NetworkInterface selects a NIC by index, e.g. 1 for nic1.
+	NetworkInterface *int `yaml:"networkInterface"`
+	// Network selects the NICs attached to the named VPC network.
+	Network string `yaml:"network"`
+	// PreferIpv6 targets the internal or external IPv6 address when the NIC
+	// has one, falling back to IPv4.
+	PreferIpv6 bool `yaml:"preferIpv6"`
+	// UseInternalDns targets the instance's internal DNS name instead of an
+	// address, which only resolves inside the VPC.
+	UseInternalDns bool `yaml:"useInternalDns"`
+}
 
-	if m.UsePrivateIp {
-		m.host = vm.NetworkInterfaces[0].NetworkIP
-		slog.Debug("Found private IP", "ip", m.host)
-		return nil
+func (a *gceAddress) validate() error {
+	if a.NetworkInterface != nil && a.Network != "" {
+		return fmt.Errorf("networkInterface and network are mutually exclusive")
 	}
-
-	for _, nic := range vm.NetworkInterfaces {
-		if len(nic.AccessConfigs) > 0 && nic.AccessConfigs[0].NatIP != "" {
-			m.host = nic.AccessConfigs[0].NatIP
-			slog.Debug("Found public IP", "ip", m.host)
-			return nil
-		}
+	if a.NetworkInterface != nil && *a.NetworkInterface < 0 {
+		return fmt.Errorf("networkInterface must not be negative")
 	}
-
-	return fmt.Errorf("no public IP found for instance %s", m.Name)
+	return nil
 }
 
-// PowerOnWithCooldown attempts to power on the machine if enough time has elapsed since the last attempt
-func (m *GoogleComputeEngine) PowerOnWithCooldown(ctx context.Context, cooldownSeconds int) error {
-	if m.Lock == nil {
-		return fmt.Errorf("machine power-on lock is not initialized")
+// instanceHost selects the proxy target host of a Compute Engine instance.
+func (a *gceAddress) instanceHost(vm *compute.Instance, project, zone, name string) (string, error) {
+	if a.UseInternalDns {
+		if vm.Hostname != "" {
+			return vm.Hostname, nil
+		}
+		return fmt.Sprintf("%s.%s.c.%s.internal", name, zone, project), nil
 	}
-	if err := m.Lock.Acquire(ctx, 1); err != nil {
-		return fmt.Errorf("wait for concurrent power-on attempt: %w", err)
+
+	nics, err := a.networkInterfaces(vm, name)
+	if err != nil {
+		return "", err
 	}
-	defer m.Lock.Release(1)
 
-	now := m.currentTime()
-	retryAt := m.LastPowerOnAttempt.Add(time.Duration(cooldownSeconds) * time.Second)
-	if !m.LastPowerOnAttempt.IsZero() && now.Before(retryAt) {
-		slog.Debug("Power-on attempt skipped due to cooldown", "instance", m.Name, "cooldown", cooldownSeconds)
-		if m.Host() == "" {
-			return m.waitForCooldownTransition(ctx, retryAt)
+	if a.UsePrivateIp {
+		nic := nics[0]
+		if a.PreferIpv6 && nic.Ipv6Address != "" {
+			slog.Debug("Found private IPv6 address", "ip", nic.Ipv6Address)
+			return nic.Ipv6Address, nil
 		}
-		return nil
+		if nic.NetworkIP == "" {
+			return "", fmt.Errorf("no private IP found for instance %s", name)
+		}
+		slog.Debug("Found private IP", "ip", nic.NetworkIP)
+		return nic.NetworkIP, nil
 	}
 
-	// Update the last attempt time before making the API call
-	m.LastPowerOnAttempt = now
+	if a.PreferIpv6 {
+		for _, nic := range nics {
+			if len(nic.Ipv6AccessConfigs) > 0 && nic.Ipv6AccessConfigs[0].ExternalIpv6 != "" {
+				slog.Debug("Found public IPv6 address", "ip", nic.Ipv6AccessConfigs[0].ExternalIpv6)
+				return nic.Ipv6AccessConfigs[0].ExternalIpv6, nil
+			}
+		}
+	}
+	for _, nic := range nics {
+		if len(nic.AccessConfigs) > 0 && nic.AccessConfigs[0].NatIP != "" {
+			slog.Debug("Found public IP", "ip", nic.AccessConfigs[0].NatIP)
+			return nic.AccessConfigs[0].NatIP, nil
+		}
+	}
 
-	slog.Debug("Attempting power-on check", "instance", m.Name)
-	return m.PowerOn(ctx)
+	return "", fmt.Errorf("no public IP found for instance %s", name)
 }
 
-// waitForCooldownTransition lets a caller join an accepted start whose state
-// change was not visible before the previous request was cancelled. It polls
-// without issuing another mutation until the cooldown expires, then makes one
-// fresh power-on attempt if the VM is still terminal.
-func (m *GoogleComputeEngine) waitForCooldownTransition(ctx context.Context, retryAt time.Time) error {
-	ticker := time.NewTicker(m.effectivePollInterval())
-	defer ticker.Stop()
-
-	for {
-		vm, err := m.getInstanceMetadata(ctx)
-		if err == nil {
-			action, classifyErr := classifyInstanceStatus(vm.Status)
-			if classifyErr != nil {
-				return classifyErr
-			}
-			switch action {
-			case instanceReady:
-				return m.setIp(vm)
-			case instanceWait:
-				return m.waitForInstanceRunning(ctx, false)
-			case instanceStart:
-				// Wait out the mutation cooldown before retrying.
-			}
+// networkInterfaces returns the NICs selected by NetworkInterface or Network,
+// or all of them.
+func (a *gceAddress) networkInterfaces(vm *compute.Instance, name string) ([]*compute.NetworkInterface, error) {
+	if len(vm.NetworkInterfaces) == 0 {
+		return nil, fmt.Errorf("no network interfaces found for instance %s", name)
+	}
+	switch {
+	case a.NetworkInterface != nil:
+		if *a.NetworkInterface >= len(vm.NetworkInterfaces) {
+			return nil, fmt.Errorf("instance %s has no network interface %d", name, *a.NetworkInterface)
 		}
-
-		if !m.currentTime().Before(retryAt) {
-			m.LastPowerOnAttempt = m.currentTime()
-			return m.PowerOn(ctx)
+		return vm.NetworkInterfaces[*a.NetworkInterface : *a.NetworkInterface+1], nil
+	case a.Network != "":
+		var nics []*compute.NetworkInterface
+		for _, nic := range vm.NetworkInterfaces {
+			// Network is a URL ending in the network name.
+			if nic.Network == a.Network || strings.HasSuffix(nic.Network, "/networks/"+a.Network) {
+				nics = append(nics, nic)
+			}
 		}
-
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case <-ticker.C:
+		if len(nics) == 0 {
+			return nil, fmt.Errorf("instance %s has no network interface on network %s", name, a.Network)
 		}
+		return nics, nil
+	default:
+		return vm.NetworkInterfaces, nil
 	}
 }
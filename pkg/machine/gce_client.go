@@ -0,0 +1,66 @@
+package machine
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	compute "google.golang.org/api/compute/v1"
+	"google.golang.org/api/option"
+)
+
+// computeClient builds one Compute Engine client per backend on first use and
+// shares it, with its pooled connections and cached token, across every poll
+// and mutation. A failed build is retried on the next call, so a transient
+// credential lookup failure does not disable the backend.
+type computeClient struct {
+	// Endpoint overrides the Compute Engine API base URL, e.g. for a private
+	// endpoint or a local emulator. Plain http:// endpoints, which only
+	// emulators serve, are used without credentials.
+	Endpoint string `yaml:"endpoint"`
+	// CredentialsFile is a service account key file used instead of
+	// Application Default Credentials.
+	CredentialsFile string `yaml:"credentialsFile"`
+	UserAgent       string `yaml:"userAgent"`
+	serviceMutex    sync.Mutex
+	service         *compute.Service
+}
+
+// validate rejects settings that cannot build a client.
+func (c *computeClient) validate() error {
+	if strings.HasPrefix(c.Endpoint, "http://") && c.CredentialsFile != "" {
+		return fmt.Errorf("credentialsFile cannot be used with the unauthenticated http:// endpoint %s", c.Endpoint)
+	}
+	return nil
+}
+
+func (c *computeClient) computeService() (*compute.Service, error) {
+	c.serviceMutex.Lock()
+	defer c.serviceMutex.Unlock()
+	if c.service != nil {
+		return c.service, nil
+	}
+
+	options := []option.ClientOption{option.WithScopes(compute.CloudPlatformScope)}
+	if c.Endpoint != "" {
+		options = append(options, option.WithEndpoint(c.Endpoint))
+		if strings.HasPrefix(c.Endpoint, "http://") {
+			options = append(options, option.WithoutAuthentication())
+		}
+	}
+	if c.CredentialsFile != "" {
+		options = append(options, option.WithAuthCredentialsFile(option.ServiceAccount, c.CredentialsFile))
+	}
+	if c.UserAgent != "" {
+		options = append(options, option.WithUserAgent(c.UserAgent))
+	}
+	// The service outlives any one request, so it must not capture a request
+	// context that would cancel its token refreshes.
+	service, err := compute.NewService(context.Background(), options...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create compute service: %w", err)
+	}
+	c.service = service
+	return service, nil
+}
@@ -0,0 +1,214 @@
+package machine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	compute "google.golang.org/api/compute/v1"
+)
+
+// gceInstance names one Compute Engine instance.
+type gceInstance struct {
+	ProjectId string `yaml:"project_id"` // default: the primary instance's project
+	Zone      string `yaml:"zone"`
+	Name      string `yaml:"name"`
+}
+
+func (i gceInstance) String() string {
+	return i.ProjectId + "/" + i.Zone + "/" + i.Name
+}
+
+// capacityErrorCodes are start failures that another zone or instance may not
+// share.
+var capacityErrorCodes = map[string]bool{
+	"ZONE_RESOURCE_POOL_EXHAUSTED":              true,
+	"ZONE_RESOURCE_POOL_EXHAUSTED_WITH_DETAILS": true,
+	"QUOTA_EXCEEDED":                            true,
+}
+
+// gceFailover moves a Compute Engine machine to the next candidate instance
+// when a start fails for lack of capacity or the active spot instance keeps
+// being preempted. PPB stays on the candidate that last started; once every
+// candidate has failed it starts over with the primary instance.
+type gceFailover struct {
+	// Failover lists the candidates tried, in order, after the primary
+	// project_id/zone/name instance.
+	Failover []gceInstance `yaml:"failover"`
+	// PreemptionLimit is how many preemptions of the active spot instance
+	// PPB tolerates before moving to the next candidate.
+	PreemptionLimit int `yaml:"preemptionLimit"` // default: 2
+	active          atomic.Int32
+	// preemptions, stopRequested, and runningAt are only used under the
+	// power-on lock.
+	preemptions   int
+	stopRequested bool
+	// runningAt is when PPB last saw the active instance RUNNING.
+	runningAt time.Time
+}
+
+func (f *gceFailover) validate() error {
+	for i, candidate := range f.Failover {
+		if candidate.Zone == "" || candidate.Name == "" {
+			return fmt.Errorf("failover[%d] requires zone and name", i)
+		}
+	}
+	if f.PreemptionLimit <= 0 {
+		return fmt.Errorf("preemptionLimit must be positive")
+	}
+	return nil
+}
+
+// candidate returns the primary instance for 0 and failover candidates after it.
+func (m *GoogleComputeEngine) candidate(i int) gceInstance {
+	if i == 0 {
+		return gceInstance{ProjectId: m.ProjectId, Zone: m.Zone, Name: m.Name}
+	}
+	candidate := m.Failover[i-1]
+	if candidate.ProjectId == "" {
+		candidate.ProjectId = m.ProjectId
+	}
+	return candidate
+}
+
+// current returns the instance the power cycle is driving.
+func (m *GoogleComputeEngine) current() gceInstance {
+	return m.candidate(int(m.active.Load()))
+}
+
+// failover moves to the next candidate. It reports false when there is none.
+func (m *GoogleComputeEngine) failover(reason string) bool {
+	next := int(m.active.Load()) + 1
+	if next > len(m.Failover) {
+		return false
+	}
+	slog.Warn("Failing over to next instance", "from", m.current().String(), "to", m.candidate(next).String(), "reason", reason)
+	m.active.Store(int32(next))
+	m.preemptions = 0
+	m.runningAt = time.Time{}
+	return true
+}
+
+// startWithFailover starts the current instance and moves through the
+// candidates while starts fail for lack of capacity. A candidate that is
+// already running or starting is joined instead of started.
+func (m *GoogleComputeEngine) startWithFailover(ctx context.Context, status string) error {
+	err := m.powerOn(ctx, status)
+	for isCapacityError(err) {
+		if !m.failover(err.Error()) {
+			m.active.Store(0)
+			return err
+		}
+		vm, getErr := m.getInstanceMetadata(ctx, m.current())
+		if getErr != nil {
+			return getErr
+		}
+		if vm.Status != "TERMINATED" && vm.Status != "SUSPENDED" {
+			return nil
+		}
+		err = m.powerOn(ctx, vm.Status)
+	}
+	return err
+}
+
+func isCapacityError(err error) bool {
+	var operationErr *OperationError
+	if !errors.As(err, &operationErr) {
+		return false
+	}
+	for _, code := range operationErr.Codes() {
+		if capacityErrorCodes[code] {
+			return true
+		}
+	}
+	return false
+}
+
+// preempted counts a spot instance found stopped after PPB last saw it
+// running when Compute Engine recorded a preemption of it since, and reports
+// whether the limit was reached. Stops by PPB, lightsout, or an operator are
+// not preemptions.
+func (m *GoogleComputeEngine) preempted(ctx context.Context, previous string, vm *compute.Instance) bool {
+	if previous != "RUNNING" || (vm.Status != "STOPPING" && vm.Status != "TERMINATED") {
+		return false
+	}
+	if m.stopRequested {
+		m.stopRequested = false
+		return false
+	}
+	if vm.Scheduling == nil || (!vm.Scheduling.Preemptible && vm.Scheduling.ProvisioningModel != "SPOT") {
+		return false
+	}
+	preempted, err := m.preemptedSince(ctx, m.current(), m.runningAt)
+	if err != nil {
+		slog.Warn("Unable to check whether spot instance was preempted", "instance", m.current().String(), "error", err)
+		return false
+	}
+	if !preempted {
+		slog.Debug("Spot instance was stopped without being preempted", "instance", m.current().String())
+		return false
+	}
+	m.preemptions++
+	slog.Warn("Spot instance was preempted", "instance", m.current().String(), "preemptions", m.preemptions)
+	return m.preemptions >= m.PreemptionLimit
+}
+
+// preemptedSince reports whether the zone has a compute.instances.preempted
+// operation for target that started at or after since.
+func (m *GoogleComputeEngine) preemptedSince(ctx context.Context, target gceInstance, since time.Time) (bool, error) {
+	computeService, err := m.computeService()
+	if err != nil {
+		return false, err
+	}
+	link := "projects/" + target.ProjectId + "/zones/" + target.Zone + "/instances/" + target.Name
+	// InsertTime has no more than millisecond precision.
+	since = since.Truncate(time.Millisecond)
+	preempted := false
+	err = computeService.ZoneOperations.List(target.ProjectId, target.Zone).
+		Filter(`operationType = "compute.instances.preempted"`).
+		Pages(ctx, func(page *compute.OperationList) error {
+			for _, op := range page.Items {
+				if !strings.HasSuffix(op.TargetLink, "/"+link) && op.TargetLink != link {
+					continue
+				}
+				inserted, err := time.Parse(time.RFC3339, op.InsertTime)
+				if err == nil && !inserted.Before(since) {
+					preempted = true
+				}
+			}
+			return nil
+		})
+	if err != nil {
+		return false, fmt.Errorf("failed to list preemptions: %w", err)
+	}
+	return preempted, nil
+}
+
+// startedCandidate switches to another candidate that is already running or
+// starting, e.g. after PPB restarted while a failover instance was up. It is
+// checked only before a start, not on every status read.
+func (m *GoogleComputeEngine) startedCandidate(ctx context.Context) *compute.Instance {
+	active := int(m.active.Load())
+	for i := 0; i <= len(m.Failover); i++ {
+		if i == active {
+			continue
+		}
+		vm, err := m.getInstanceMetadata(ctx, m.candidate(i))
+		if err != nil {
+			slog.Debug("Unable to check failover candidate", "instance", m.candidate(i).String(), "error", err)
+			continue
+		}
+		switch vm.Status {
+		case "RUNNING", "PROVISIONING", "STAGING":
+			slog.Info("Using failover candidate that is already running", "instance", m.candidate(i).String(), "status", vm.Status)
+			m.active.Store(int32(i))
+			m.preemptions = 0
+			return vm
+		}
+	}
+	return nil
+}
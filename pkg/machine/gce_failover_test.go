@@ -0,0 +1,208 @@
+package machine
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/libops/ppb/pkg/gcetest"
+)
+
+func newFailoverMachine(t *testing.T, emulator http.Handler, metadata map[string]any) *GoogleComputeEngine {
+	t.Helper()
+	server := httptest.NewServer(emulator)
+	t.Cleanup(server.Close)
+
+	metadata["project_id"], metadata["zone"], metadata["name"] = "p", "us-east1-b", "vm"
+	metadata["endpoint"] = server.URL
+	metadata["failover"] = []any{map[string]any{"zone": "us-west1-a", "name": "vm-west"}}
+	built, err := newGceFromMetadata(metadata)
+	if err != nil {
+		t.Fatalf("newGceFromMetadata() error = %v", err)
+	}
+	m := built.(*GoogleComputeEngine)
+	m.pollInterval = time.Millisecond
+	return m
+}
+
+func TestGoogleComputeEngineFailsOverOnStockout(t *testing.T) {
+	t.Parallel()
+
+	emulator := gcetest.New(gcetest.Options{},
+		gcetest.Instance{Project: "p", Zone: "us-east1-b", Name: "vm", NetworkIP: "10.0.0.1", StartError: "ZONE_RESOURCE_POOL_EXHAUSTED"},
+		gcetest.Instance{Project: "p", Zone: "us-west1-a", Name: "vm-west", NetworkIP: "10.0.0.2"},
+	)
+	m := newFailoverMachine(t, emulator, map[string]any{"usePrivateIp": true})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := m.PowerOn(ctx); err != nil {
+		t.Fatalf("PowerOn() error = %v", err)
+	}
+	if got := m.Host(); got != "10.0.0.2" {
+		t.Fatalf("Host() = %q, want the failover candidate", got)
+	}
+	if vm, _ := emulator.Instance("p", "us-west1-a", "vm-west"); vm.Status != "RUNNING" {
+		t.Fatalf("candidate status = %q, want RUNNING", vm.Status)
+	}
+	if got := m.Describe(); got != "google_compute_engine p/us-east1-b/vm via failover p/us-west1-a/vm-west" {
+		t.Fatalf("Describe() = %q", got)
+	}
+}
+
+func TestGoogleComputeEngineReturnsStockoutWhenCandidatesExhausted(t *testing.T) {
+	t.Parallel()
+
+	emulator := gcetest.New(gcetest.Options{},
+		gcetest.Instance{Project: "p", Zone: "us-east1-b", Name: "vm", StartError: "ZONE_RESOURCE_POOL_EXHAUSTED"},
+		gcetest.Instance{Project: "p", Zone: "us-west1-a", Name: "vm-west", StartError: "QUOTA_EXCEEDED"},
+	)
+	m := newFailoverMachine(t, emulator, map[string]any{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := m.PowerOn(ctx); !isCapacityError(err) {
+		t.Fatalf("PowerOn() error = %v, want a capacity error", err)
+	}
+	if got := m.current().Name; got != "vm" {
+		t.Fatalf("current() = %q, want the primary after exhausting candidates", got)
+	}
+}
+
+func TestGoogleComputeEngineFailsOverAfterRepeatedPreemption(t *testing.T) {
+	t.Parallel()
+
+	emulator := gcetest.New(gcetest.Options{},
+		gcetest.Instance{Project: "p", Zone: "us-east1-b", Name: "vm", NetworkIP: "10.0.0.1", Spot: true},
+		gcetest.Instance{Project: "p", Zone: "us-west1-a", Name: "vm-west", NetworkIP: "10.0.0.2"},
+	)
+	m := newFailoverMachine(t, emulator, map[string]any{"usePrivateIp": true, "preemptionLimit": 2})
+	preempt := func() { emulator.Preempt("p", "us-east1-b", "vm") }
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for i := range 2 {
+		if err := m.PowerOn(ctx); err != nil {
+			t.Fatalf("PowerOn() #%d error = %v", i+1, err)
+		}
+		if got := m.Host(); got != "10.0.0.1" {
+			t.Fatalf("Host() #%d = %q, want the primary", i+1, got)
+		}
+		preempt()
+		if err := m.Refresh(ctx); err != nil {
+			t.Fatalf("Refresh() #%d error = %v", i+1, err)
+		}
+	}
+
+	if err := m.PowerOn(ctx); err != nil {
+		t.Fatalf("PowerOn() after preemptions error = %v", err)
+	}
+	if got := m.Host(); got != "10.0.0.2" {
+		t.Fatalf("Host() = %q, want the failover candidate", got)
+	}
+}
+
+func TestGoogleComputeEngineDoesNotCountIdleStopsAsPreemption(t *testing.T) {
+	t.Parallel()
+
+	emulator := gcetest.New(gcetest.Options{},
+		gcetest.Instance{Project: "p", Zone: "us-east1-b", Name: "vm", NetworkIP: "10.0.0.1", Spot: true},
+		gcetest.Instance{Project: "p", Zone: "us-west1-a", Name: "vm-west", NetworkIP: "10.0.0.2"},
+	)
+	m := newFailoverMachine(t, emulator, map[string]any{"usePrivateIp": true, "preemptionLimit": 1})
+	// lightsout stops the instance with an ordinary stop, not a preemption.
+	lightsout := func() {
+		emulator.Update("p", "us-east1-b", "vm", func(vm *gcetest.Instance) { vm.Status = "TERMINATED" })
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for i := range 3 {
+		if err := m.PowerOn(ctx); err != nil {
+			t.Fatalf("PowerOn() #%d error = %v", i+1, err)
+		}
+		if got := m.Host(); got != "10.0.0.1" {
+			t.Fatalf("Host() #%d = %q, want the primary", i+1, got)
+		}
+		lightsout()
+		if err := m.Refresh(ctx); err != nil {
+			t.Fatalf("Refresh() #%d error = %v", i+1, err)
+		}
+	}
+	if m.preemptions != 0 {
+		t.Fatalf("preemptions = %d, want idle stops not counted", m.preemptions)
+	}
+}
+
+func TestGoogleComputeEngineAdoptsRunningCandidate(t *testing.T) {
+	t.Parallel()
+
+	emulator := gcetest.New(gcetest.Options{},
+		gcetest.Instance{Project: "p", Zone: "us-east1-b", Name: "vm", NetworkIP: "10.0.0.1"},
+		gcetest.Instance{Project: "p", Zone: "us-west1-a", Name: "vm-west", NetworkIP: "10.0.0.2", Status: "RUNNING"},
+	)
+	m := newFailoverMachine(t, emulator, map[string]any{"usePrivateIp": true})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := m.PowerOn(ctx); err != nil {
+		t.Fatalf("PowerOn() error = %v", err)
+	}
+	if got := m.Host(); got != "10.0.0.2" {
+		t.Fatalf("Host() = %q, want the running candidate", got)
+	}
+	if vm, _ := emulator.Instance("p", "us-east1-b", "vm"); vm.Status != "TERMINATED" {
+		t.Fatalf("primary status = %q, want it left stopped", vm.Status)
+	}
+}
+
+func TestGoogleComputeEngineChecksCandidatesOnlyBeforeStarting(t *testing.T) {
+	t.Parallel()
+
+	emulator := gcetest.New(gcetest.Options{},
+		gcetest.Instance{Project: "p", Zone: "us-east1-b", Name: "vm", NetworkIP: "10.0.0.1"},
+		gcetest.Instance{Project: "p", Zone: "us-west1-a", Name: "vm-west", NetworkIP: "10.0.0.2"},
+	)
+	var candidateReads atomic.Int32
+	m := newFailoverMachine(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/instances/vm-west") {
+			candidateReads.Add(1)
+		}
+		emulator.ServeHTTP(w, r)
+	}), map[string]any{"usePrivateIp": true})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for range 3 {
+		if err := m.Refresh(ctx); err != nil {
+			t.Fatalf("Refresh() error = %v", err)
+		}
+	}
+	if got := candidateReads.Load(); got != 0 {
+		t.Fatalf("candidate reads while stopped = %d, want none", got)
+	}
+	if err := m.PowerOn(ctx); err != nil {
+		t.Fatalf("PowerOn() error = %v", err)
+	}
+	if got := candidateReads.Load(); got != 1 {
+		t.Fatalf("candidate reads after PowerOn() = %d, want one check before starting", got)
+	}
+}
+
+func TestNewGceRejectsIncompleteFailover(t *testing.T) {
+	t.Parallel()
+
+	_, err := newGceFromMetadata(map[string]any{
+		"project_id": "p",
+		"zone":       "z",
+		"name":       "vm",
+		"failover":   []any{map[string]any{"name": "vm-west"}},
+	})
+	if err == nil {
+		t.Fatal("newGceFromMetadata() error = nil, want missing failover zone rejected")
+	}
+}
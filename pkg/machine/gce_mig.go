@@ -0,0 +1,325 @@
+package machine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	compute "google.golang.org/api/compute/v1"
+)
+
+// GoogleComputeMig resizes a zonal or regional managed instance group from
+// zero and proxies to its instances once they are RUNNING and healthy.
+type GoogleComputeMig struct {
+	ProjectId string `yaml:"project_id"`
+	// Exactly one of Zone or Region selects a zonal or regional group.
+	Zone       string `yaml:"zone"`
+	Region     string `yaml:"region"`
+	Name       string `yaml:"name"`
+	TargetSize int64  `yaml:"targetSize"` // default: 1
+	// LoadBalance rotates PickHost across every ready instance instead of
+	// always returning the first one.
+	LoadBalance   bool `yaml:"loadBalance"`
+	gceAddress    `yaml:",inline"`
+	computeClient `yaml:",inline"`
+	powerState
+	hosts           []string
+	next            atomic.Uint64
+	getGroupHook    func(context.Context) (*migSnapshot, error)
+	resizeHook      func(context.Context, int64) error
+	getInstanceHook func(context.Context, string, string) (*compute.Instance, error)
+}
+
+// migSnapshot is one read of the group target size and its instances.
+type migSnapshot struct {
+	targetSize int64
+	instances  []*compute.ManagedInstance
+}
+
+func init() {
+	Register("google_compute_mig", newGceMigFromMetadata)
+}
+
+func NewGceMigMachine() *GoogleComputeMig {
+	return &GoogleComputeMig{
+		TargetSize: 1,
+		powerState: newPowerState(),
+	}
+}
+
+func newGceMigFromMetadata(metadata map[string]any) (Machine, error) {
+	mig := NewGceMigMachine()
+	if err := decodeMetadata(metadata, mig); err != nil {
+		return nil, err
+	}
+	if mig.ProjectId == "" || mig.Name == "" {
+		return nil, fmt.Errorf("google_compute_mig machineMetadata requires project_id and name")
+	}
+	if (mig.Zone == "") == (mig.Region == "") {
+		return nil, fmt.Errorf("google_compute_mig machineMetadata requires exactly one of zone or region")
+	}
+	if err := mig.gceAddress.validate(); err != nil {
+		return nil, fmt.Errorf("google_compute_mig machineMetadata: %w", err)
+	}
+	if err := mig.computeClient.validate(); err != nil {
+		return nil, fmt.Errorf("google_compute_mig machineMetadata: %w", err)
+	}
+	if mig.TargetSize <= 0 {
+		mig.TargetSize = 1
+	}
+	slog.Debug("loaded mig config", "mig", mig)
+	return mig, nil
+}
+
+func (m *GoogleComputeMig) Describe() string {
+	return fmt.Sprintf("google_compute_mig %s/%s/%s", m.ProjectId, m.location(), m.Name)
+}
+
+func (m *GoogleComputeMig) location() string {
+	if m.Region != "" {
+		return m.Region
+	}
+	return m.Zone
+}
+
+// PickHost returns the instance to send one request to: the first ready
+// instance, or the next one in turn when LoadBalance is set. Host always
+// returns the first, so it can be read without moving the rotation.
+func (m *GoogleComputeMig) PickHost() string {
+	m.hostMutex.RLock()
+	defer m.hostMutex.RUnlock()
+	if m.host == "" || !m.LoadBalance || len(m.hosts) == 0 {
+		return m.host
+	}
+	return m.hosts[(m.next.Add(1)-1)%uint64(len(m.hosts))]
+}
+
+// HasHost reports whether host is one of the ready instances.
+func (m *GoogleComputeMig) HasHost(host string) bool {
+	m.hostMutex.RLock()
+	defer m.hostMutex.RUnlock()
+	return m.host != "" && slices.Contains(m.hosts, host)
+}
+
+func (m *GoogleComputeMig) setHosts(hosts []string) {
+	m.hostMutex.Lock()
+	defer m.hostMutex.Unlock()
+	if m.host == "" {
+		m.wakes++
+	}
+	m.hosts = hosts
+	m.host = hosts[0]
+}
+
+func (m *GoogleComputeMig) cycle() powerCycle {
+	return powerCycle{powerState: &m.powerState, driver: m, name: m.Name}
+}
+
+func (m *GoogleComputeMig) PowerOn(ctx context.Context) error {
+	return m.cycle().powerOn(ctx)
+}
+
+// Refresh re-reads the machine status and proxy target without starting it.
+func (m *GoogleComputeMig) Refresh(ctx context.Context) error {
+	return m.cycle().refresh(ctx)
+}
+
+// PowerOnWithCooldown attempts to resize the group if enough time has elapsed since the last attempt
+func (m *GoogleComputeMig) PowerOnWithCooldown(ctx context.Context, cooldownSeconds int) error {
+	return m.cycle().powerOnWithCooldown(ctx, cooldownSeconds)
+}
+
+// observe reports SCALED_TO_ZERO for an empty group, SCALING until at least
+// one instance is RUNNING, idle, and healthy, then READY with the instances
+// that are. Instances that are still starting or recreating join the target
+// on a later read.
+func (m *GoogleComputeMig) observe(ctx context.Context) (observation, error) {
+	group, err := m.getGroup(ctx)
+	if err != nil {
+		return observation{}, err
+	}
+	if group.targetSize == 0 {
+		return observation{status: workloadScaledToZero}, nil
+	}
+
+	var ready []*compute.ManagedInstance
+	for _, instance := range group.instances {
+		if managedInstanceReady(instance) {
+			ready = append(ready, instance)
+		}
+	}
+	if len(ready) == 0 {
+		slog.Debug("Waiting for managed instances", "instances", len(group.instances), "targetSize", group.targetSize, "group", m.Name)
+		return observation{status: workloadScaling}, nil
+	}
+	if int64(len(ready)) < group.targetSize {
+		slog.Debug("Proxying to the ready managed instances", "ready", len(ready), "targetSize", group.targetSize, "group", m.Name)
+	}
+	return observation{
+		status:    workloadReady,
+		setTarget: func() error { return m.setIps(ctx, ready) },
+	}, nil
+}
+
+func (m *GoogleComputeMig) classify(status string) (instanceStatusAction, error) {
+	switch status {
+	case workloadReady:
+		return instanceReady, nil
+	case workloadScaledToZero:
+		return instanceStart, nil
+	case workloadScaling:
+		return instanceWait, nil
+	default:
+		return instanceWait, fmt.Errorf("unsupported group status %q", status)
+	}
+}
+
+func (m *GoogleComputeMig) start(ctx context.Context, status string) error {
+	if status != workloadScaledToZero {
+		return fmt.Errorf("unknown status: %s", status)
+	}
+	if err := m.resize(ctx, m.TargetSize); err != nil {
+		return err
+	}
+	slog.Info("Power button pressed", "currentStatus", status, "instance", m.Name, "targetSize", m.TargetSize)
+	return nil
+}
+
+// managedInstanceReady requires a RUNNING instance with no pending MIG
+// action. Health is only checked when the group has an autohealing policy.
+func managedInstanceReady(instance *compute.ManagedInstance) bool {
+	if instance.InstanceStatus != "RUNNING" || instance.CurrentAction != "NONE" {
+		return false
+	}
+	for _, health := range instance.InstanceHealth {
+		if health.DetailedHealthState != "HEALTHY" {
+			return false
+		}
+	}
+	return true
+}
+
+// setIps resolves the address of every ready instance. An instance whose
+// address cannot be read is skipped so the rest of the group keeps serving;
+// the target is only dropped when no instance is left.
+func (m *GoogleComputeMig) setIps(ctx context.Context, instances []*compute.ManagedInstance) error {
+	hosts := make([]string, 0, len(instances))
+	var errs []error
+	for _, managed := range instances {
+		host, err := m.managedInstanceHost(ctx, managed)
+		if err != nil {
+			slog.Warn("Skipping managed instance without a usable address", "instance", managed.Instance, "group", m.Name, "error", err)
+			errs = append(errs, err)
+			continue
+		}
+		hosts = append(hosts, host)
+	}
+	if len(hosts) == 0 {
+		return fmt.Errorf("no ready instance in group %s has a usable address: %w", m.Name, errors.Join(errs...))
+	}
+	m.setHosts(hosts)
+	return nil
+}
+
+func (m *GoogleComputeMig) managedInstanceHost(ctx context.Context, managed *compute.ManagedInstance) (string, error) {
+	zone, name, err := parseInstanceURL(managed.Instance)
+	if err != nil {
+		return "", err
+	}
+	vm, err := m.getInstance(ctx, zone, name)
+	if err != nil {
+		return "", err
+	}
+	return m.instanceHost(vm, m.ProjectId, zone, name)
+}
+
+// parseInstanceURL extracts the zone and name from a managed instance URL
+// such as .../projects/p/zones/us-central1-a/instances/worker-abcd.
+func parseInstanceURL(instanceURL string) (string, string, error) {
+	parts := strings.Split(instanceURL, "/")
+	for i := 0; i+3 < len(parts); i++ {
+		if parts[i] == "zones" && parts[i+2] == "instances" {
+			return parts[i+1], parts[i+3], nil
+		}
+	}
+	return "", "", fmt.Errorf("unexpected managed instance URL %q", instanceURL)
+}
+
+func (m *GoogleComputeMig) getGroup(ctx context.Context) (*migSnapshot, error) {
+	if m.getGroupHook != nil {
+		return m.getGroupHook(ctx)
+	}
+	computeService, err := m.computeService()
+	if err != nil {
+		return nil, err
+	}
+
+	group := &migSnapshot{}
+	if m.Region != "" {
+		manager, err := computeService.RegionInstanceGroupManagers.Get(m.ProjectId, m.Region, m.Name).Context(ctx).Do()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get instance group manager: %v", err)
+		}
+		group.targetSize = manager.TargetSize
+		err = computeService.RegionInstanceGroupManagers.ListManagedInstances(m.ProjectId, m.Region, m.Name).Pages(ctx, func(page *compute.RegionInstanceGroupManagersListInstancesResponse) error {
+			group.instances = append(group.instances, page.ManagedInstances...)
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list managed instances: %v", err)
+		}
+		return group, nil
+	}
+
+	manager, err := computeService.InstanceGroupManagers.Get(m.ProjectId, m.Zone, m.Name).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get instance group manager: %v", err)
+	}
+	group.targetSize = manager.TargetSize
+	err = computeService.InstanceGroupManagers.ListManagedInstances(m.ProjectId, m.Zone, m.Name).Pages(ctx, func(page *compute.InstanceGroupManagersListManagedInstancesResponse) error {
+		group.instances = append(group.instances, page.ManagedInstances...)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list managed instances: %v", err)
+	}
+	return group, nil
+}
+
+func (m *GoogleComputeMig) resize(ctx context.Context, size int64) error {
+	if m.resizeHook != nil {
+		return m.resizeHook(ctx, size)
+	}
+	computeService, err := m.computeService()
+	if err != nil {
+		return err
+	}
+	if m.Region != "" {
+		_, err = computeService.RegionInstanceGroupManagers.Resize(m.ProjectId, m.Region, m.Name, size).Context(ctx).Do()
+	} else {
+		_, err = computeService.InstanceGroupManagers.Resize(m.ProjectId, m.Zone, m.Name, size).Context(ctx).Do()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to resize instance group: %v", err)
+	}
+	return nil
+}
+
+func (m *GoogleComputeMig) getInstance(ctx context.Context, zone, name string) (*compute.Instance, error) {
+	if m.getInstanceHook != nil {
+		return m.getInstanceHook(ctx, zone, name)
+	}
+	computeService, err := m.computeService()
+	if err != nil {
+		return nil, err
+	}
+	instance, err := computeService.Instances.Get(m.ProjectId, zone, name).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get instance metadata: %v", err)
+	}
+	return instance, nil
+}
@@ -0,0 +1,283 @@
+package machine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	compute "google.golang.org/api/compute/v1"
+)
+
+// testMig fakes a group that gains one RUNNING instance per read after a
+// resize until it reaches the requested size.
+func testMig(t *testing.T) (*GoogleComputeMig, *[]int64) {
+	t.Helper()
+	var mu sync.Mutex
+	var resizes []int64
+	var targetSize int64
+	created := 0
+
+	m := NewGceMigMachine()
+	m.ProjectId = "test-project"
+	m.Region = "us-central1"
+	m.Name = "workers"
+	m.TargetSize = 2
+	m.UsePrivateIp = true
+	m.pollInterval = time.Millisecond
+	m.getGroupHook = func(context.Context) (*migSnapshot, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		group := &migSnapshot{targetSize: targetSize}
+		if int64(created) < targetSize {
+			created++
+		}
+		for i := range created {
+			group.instances = append(group.instances, &compute.ManagedInstance{
+				Instance:       fmt.Sprintf("https://www.googleapis.com/compute/v1/projects/test-project/zones/us-central1-a/instances/worker-%d", i),
+				InstanceStatus: "RUNNING",
+				CurrentAction:  "NONE",
+				InstanceHealth: []*compute.ManagedInstanceInstanceHealth{{DetailedHealthState: "HEALTHY"}},
+			})
+		}
+		return group, nil
+	}
+	m.resizeHook = func(_ context.Context, size int64) error {
+		mu.Lock()
+		defer mu.Unlock()
+		resizes = append(resizes, size)
+		targetSize = size
+		return nil
+	}
+	m.getInstanceHook = func(_ context.Context, zone, name string) (*compute.Instance, error) {
+		if zone != "us-central1-a" {
+			t.Errorf("getInstance zone = %q, want us-central1-a", zone)
+		}
+		var index int
+		if _, err := fmt.Sscanf(name, "worker-%d", &index); err != nil {
+			return nil, err
+		}
+		return &compute.Instance{
+			Name:              name,
+			NetworkInterfaces: []*compute.NetworkInterface{{NetworkIP: fmt.Sprintf("10.42.0.%d", 10+index)}},
+		}, nil
+	}
+	return m, &resizes
+}
+
+func TestGoogleComputeMigResizesFromZeroAndBalancesHosts(t *testing.T) {
+	t.Parallel()
+
+	m, resizes := testMig(t)
+	m.LoadBalance = true
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := m.PowerOnWithCooldown(ctx, 30); err != nil {
+		t.Fatalf("PowerOnWithCooldown() error = %v", err)
+	}
+	if len(*resizes) != 1 || (*resizes)[0] != 2 {
+		t.Fatalf("resizes = %v, want one resize to 2", *resizes)
+	}
+	// The second instance becomes ready after the first read.
+	if err := m.Refresh(ctx); err != nil {
+		t.Fatalf("Refresh() error = %v", err)
+	}
+	seen := map[string]bool{}
+	for range 4 {
+		seen[m.PickHost()] = true
+	}
+	if !seen["10.42.0.10"] || !seen["10.42.0.11"] || len(seen) != 2 {
+		t.Fatalf("PickHost() rotation = %v, want both instance IPs", seen)
+	}
+	for range 3 {
+		if host := m.Host(); host != "10.42.0.10" {
+			t.Fatalf("Host() = %q, want the first instance without rotating", host)
+		}
+	}
+	if !m.HasHost("10.42.0.11") || m.HasHost("10.42.0.99") {
+		t.Fatal("HasHost() does not match the ready instances")
+	}
+}
+
+func TestGoogleComputeMigProxiesToReadySubset(t *testing.T) {
+	t.Parallel()
+
+	m, _ := testMig(t)
+	m.getGroupHook = func(context.Context) (*migSnapshot, error) {
+		return &migSnapshot{targetSize: 2, instances: []*compute.ManagedInstance{
+			{
+				Instance:       "https://www.googleapis.com/compute/v1/projects/test-project/zones/us-central1-a/instances/worker-0",
+				InstanceStatus: "STAGING",
+				CurrentAction:  "RECREATING",
+			},
+			{
+				Instance:       "https://www.googleapis.com/compute/v1/projects/test-project/zones/us-central1-a/instances/worker-1",
+				InstanceStatus: "RUNNING",
+				CurrentAction:  "NONE",
+			},
+		}}, nil
+	}
+
+	if err := m.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh() error = %v", err)
+	}
+	if host := m.Host(); host != "10.42.0.11" {
+		t.Fatalf("Host() = %q, want the ready instance while the other recreates", host)
+	}
+}
+
+func TestGoogleComputeMigSkipsInstanceWithoutAddress(t *testing.T) {
+	t.Parallel()
+
+	m, _ := testMig(t)
+	m.LoadBalance = true
+	m.getGroupHook = func(context.Context) (*migSnapshot, error) {
+		group := &migSnapshot{targetSize: 2}
+		for i := range 2 {
+			group.instances = append(group.instances, &compute.ManagedInstance{
+				Instance:       fmt.Sprintf("https://www.googleapis.com/compute/v1/projects/test-project/zones/us-central1-a/instances/worker-%d", i),
+				InstanceStatus: "RUNNING",
+				CurrentAction:  "NONE",
+			})
+		}
+		return group, nil
+	}
+	lookup := m.getInstanceHook
+	broken := "worker-0"
+	m.getInstanceHook = func(ctx context.Context, zone, name string) (*compute.Instance, error) {
+		if name == broken {
+			return nil, errors.New("instance not found")
+		}
+		return lookup(ctx, zone, name)
+	}
+
+	if err := m.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh() error = %v", err)
+	}
+	for range 3 {
+		if host := m.PickHost(); host != "10.42.0.11" {
+			t.Fatalf("PickHost() = %q, want only the instance with an address", host)
+		}
+	}
+
+	m.getInstanceHook = func(context.Context, string, string) (*compute.Instance, error) {
+		return nil, errors.New("instance not found")
+	}
+	if err := m.Refresh(context.Background()); err == nil {
+		t.Fatal("Refresh() error = nil, want an error when no instance has an address")
+	}
+}
+
+func TestGoogleComputeMigWithoutLoadBalancingUsesFirstInstance(t *testing.T) {
+	t.Parallel()
+
+	m, _ := testMig(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := m.PowerOn(ctx); err != nil {
+		t.Fatalf("PowerOn() error = %v", err)
+	}
+	for range 3 {
+		if host := m.Host(); host != "10.42.0.10" {
+			t.Fatalf("Host() = %q, want first instance", host)
+		}
+	}
+}
+
+func TestManagedInstanceReady(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		instance *compute.ManagedInstance
+		want     bool
+	}{
+		{name: "running without health check", instance: &compute.ManagedInstance{InstanceStatus: "RUNNING", CurrentAction: "NONE"}, want: true},
+		{name: "staging", instance: &compute.ManagedInstance{InstanceStatus: "STAGING", CurrentAction: "CREATING"}},
+		{name: "running but verifying", instance: &compute.ManagedInstance{InstanceStatus: "RUNNING", CurrentAction: "VERIFYING"}},
+		{name: "running but unhealthy", instance: &compute.ManagedInstance{
+			InstanceStatus: "RUNNING",
+			CurrentAction:  "NONE",
+			InstanceHealth: []*compute.ManagedInstanceInstanceHealth{{DetailedHealthState: "UNHEALTHY"}},
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			if got := managedInstanceReady(test.instance); got != test.want {
+				t.Fatalf("managedInstanceReady() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestNewGceMigRequiresZoneOrRegion(t *testing.T) {
+	t.Parallel()
+
+	_, err := New("google_compute_mig", map[string]any{
+		"project_id": "test-project",
+		"name":       "workers",
+		"zone":       "us-central1-a",
+		"region":     "us-central1",
+	})
+	if err == nil {
+		t.Fatal("New() unexpectedly accepted both zone and region")
+	}
+}
+
+func TestNewGceMigDecodesClientSettings(t *testing.T) {
+	t.Parallel()
+
+	m, err := New("google_compute_mig", map[string]any{
+		"project_id":      "test-project",
+		"name":            "workers",
+		"zone":            "us-central1-a",
+		"endpoint":        "https://compute.example.test/",
+		"credentialsFile": "/secrets/ppb.json",
+		"userAgent":       "ppb",
+	})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	mig := m.(*GoogleComputeMig)
+	if mig.Endpoint != "https://compute.example.test/" || mig.CredentialsFile != "/secrets/ppb.json" || mig.UserAgent != "ppb" {
+		t.Fatalf("client settings = %q %q %q", mig.Endpoint, mig.CredentialsFile, mig.UserAgent)
+	}
+
+	// An emulator endpoint is unauthenticated, so a key file cannot apply.
+	if _, err := New("google_compute_mig", map[string]any{
+		"project_id":      "test-project",
+		"name":            "workers",
+		"zone":            "us-central1-a",
+		"endpoint":        "http://127.0.0.1:8085/",
+		"credentialsFile": "/secrets/ppb.json",
+	}); err == nil {
+		t.Fatal("New() accepted credentialsFile with an http:// endpoint")
+	}
+}
+
+func TestComputeClientRetriesFailedBuild(t *testing.T) {
+	t.Parallel()
+
+	c := &computeClient{CredentialsFile: filepath.Join(t.TempDir(), "missing.json")}
+	if _, err := c.computeService(); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("computeService() error = %v, want the wrapped missing file", err)
+	}
+
+	c.CredentialsFile = ""
+	c.Endpoint = "http://127.0.0.1:8085/"
+	first, err := c.computeService()
+	if err != nil {
+		t.Fatalf("computeService() error = %v after the failure was fixed", err)
+	}
+	if again, _ := c.computeService(); again != first {
+		t.Fatal("computeService() did not reuse the client it built")
+	}
+}
@@ -3,6 +3,9 @@ package machine
 import (
 	"context"
 	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -51,6 +54,9 @@ func TestGoogleComputeEnginePowerOnFollowsStateSequence(t *testing.T) {
 	if host := m.Host(); host != "10.42.0.8" {
 		t.Fatalf("Host() = %q, want 10.42.0.8", host)
 	}
+	if status := m.Status(); status != "RUNNING" {
+		t.Fatalf("Status() = %q, want RUNNING", status)
+	}
 }
 
 func TestGoogleComputeEngineJoinsConflictingMutation(t *testing.T) {
@@ -105,6 +111,145 @@ func TestGoogleComputeEngineReturnsPermanentMutationError(t *testing.T) {
 	}
 }
 
+func TestGoogleComputeEngineReturnsFailedOperationWithoutJoining(t *testing.T) {
+	t.Parallel()
+
+	m := NewGceMachine()
+	m.pollInterval = time.Millisecond
+	m.joinTimeout = time.Minute
+	m.getInstanceHook = func(context.Context) (*compute.Instance, error) {
+		return testInstance("TERMINATED"), nil
+	}
+	m.powerOnHook = func(context.Context, string) error {
+		return &OperationError{Type: "start", Name: "operation-1", Errors: []*compute.OperationErrorErrors{{
+			Code:    "ZONE_RESOURCE_POOL_EXHAUSTED",
+			Message: "The zone does not have enough resources available.",
+		}}}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := m.PowerOn(ctx)
+	var operationErr *OperationError
+	if !errors.As(err, &operationErr) {
+		t.Fatalf("PowerOn() error = %v, want *OperationError", err)
+	}
+	if codes := operationErr.Codes(); len(codes) != 1 || codes[0] != "ZONE_RESOURCE_POOL_EXHAUSTED" {
+		t.Fatalf("Codes() = %v, want ZONE_RESOURCE_POOL_EXHAUSTED", codes)
+	}
+	if ctx.Err() != nil {
+		t.Fatal("PowerOn() waited to join a start that had already failed")
+	}
+}
+
+func TestGoogleComputeEngineWaitOperation(t *testing.T) {
+	t.Parallel()
+
+	var waits atomic.Int32
+	var failWait atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || !strings.HasSuffix(r.URL.Path, "/zones/z/operations/operation-1/wait") {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		if failWait.Load() {
+			http.Error(w, `{"error":{"code":403,"message":"forbidden"}}`, http.StatusForbidden)
+			return
+		}
+		status := "RUNNING"
+		body := ""
+		if waits.Add(1) > 1 {
+			status = "DONE"
+			body = `,"error":{"errors":[{"code":"ZONE_RESOURCE_POOL_EXHAUSTED","message":"no capacity"}]}`
+		}
+		_, _ = fmt.Fprintf(w, `{"name":"operation-1","operationType":"start","status":%q%s}`, status, body)
+	}))
+	defer server.Close()
+
+	m := NewGceMachine()
+	m.ProjectId, m.Zone, m.Name, m.Endpoint = "p", "z", "vm", server.URL
+	computeService, err := m.computeService()
+	if err != nil {
+		t.Fatalf("computeService() error = %v", err)
+	}
+
+	err = m.waitOperation(context.Background(), computeService, m.current(), &compute.Operation{Name: "operation-1", Status: "PENDING"})
+	if err == nil || !strings.Contains(err.Error(), "ZONE_RESOURCE_POOL_EXHAUSTED: no capacity") {
+		t.Fatalf("waitOperation() error = %v, want the operation error code", err)
+	}
+	if got := waits.Load(); got != 2 {
+		t.Fatalf("Wait calls = %d, want 2", got)
+	}
+
+	failWait.Store(true)
+	if err := m.waitOperation(context.Background(), computeService, m.current(), &compute.Operation{Name: "operation-1", Status: "PENDING"}); err != nil {
+		t.Fatalf("waitOperation() error = %v, want fallback to instance polling", err)
+	}
+}
+
+func TestGoogleComputeEnginePowerOnThroughEndpoint(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	status := "TERMINATED"
+	var starts int
+	userAgents := map[string]bool{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		userAgents[r.Header.Get("User-Agent")] = true
+		switch {
+		case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/projects/p/zones/z/instances/vm"):
+			_, _ = fmt.Fprintf(w, `{"name":"vm","status":%q,"networkInterfaces":[{"networkIP":"10.42.0.8"}]}`, status)
+		case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/projects/p/zones/z/instances/vm/start"):
+			starts++
+			status = "RUNNING"
+			_, _ = fmt.Fprint(w, `{"name":"operation-1","operationType":"start","status":"DONE"}`)
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	built, err := newGceFromMetadata(map[string]any{
+		"project_id":   "p",
+		"zone":         "z",
+		"name":         "vm",
+		"usePrivateIp": true,
+		"endpoint":     server.URL,
+		"userAgent":    "ppb-test",
+	})
+	if err != nil {
+		t.Fatalf("newGceFromMetadata() error = %v", err)
+	}
+	m := built.(*GoogleComputeEngine)
+	m.pollInterval = time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := m.PowerOn(ctx); err != nil {
+		t.Fatalf("PowerOn() error = %v", err)
+	}
+	first := m.service
+	if err := m.Refresh(ctx); err != nil {
+		t.Fatalf("Refresh() error = %v", err)
+	}
+	if m.service != first {
+		t.Fatal("compute service was rebuilt between calls")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if starts != 1 || m.Host() != "10.42.0.8" {
+		t.Fatalf("starts = %d host = %q, want one start and the private IP", starts, m.Host())
+	}
+	for userAgent := range userAgents {
+		if !strings.Contains(userAgent, "ppb-test") {
+			t.Fatalf("User-Agent = %q, want ppb-test", userAgent)
+		}
+	}
+}
+
 func TestGoogleComputeEngineCooldownJoinsAcceptedTransition(t *testing.T) {
 	t.Parallel()
 
@@ -226,6 +371,175 @@ func testInstance(status string) *compute.Instance {
 	}
 }
 
+func TestGoogleComputeEnginePowerOffClearsTargetAndCooldown(t *testing.T) {
+	t.Parallel()
+
+	m := NewGceMachine()
+	m.SetHostForTesting("10.42.0.8")
+	m.LastPowerOnAttempt = time.Now()
+	m.getInstanceHook = func(context.Context) (*compute.Instance, error) {
+		return testInstance("RUNNING"), nil
+	}
+	var suspends []bool
+	m.powerOffHook = func(_ context.Context, suspend bool) error {
+		suspends = append(suspends, suspend)
+		return nil
+	}
+
+	if err := m.PowerOff(context.Background(), true, func() bool { return false }); !errors.Is(err, ErrNotIdle) {
+		t.Fatalf("PowerOff(busy) error = %v, want ErrNotIdle", err)
+	}
+	if len(suspends) != 0 || m.Host() == "" {
+		t.Fatal("PowerOff(busy) powered off a machine with new traffic")
+	}
+
+	if err := m.PowerOff(context.Background(), true, func() bool { return true }); err != nil {
+		t.Fatalf("PowerOff() error = %v", err)
+	}
+	if len(suspends) != 1 || !suspends[0] {
+		t.Fatalf("power-off calls = %v, want one suspend", suspends)
+	}
+	if m.Host() != "" || !m.LastPowerOnAttempt.IsZero() {
+		t.Fatal("PowerOff() left a cached target or cooldown behind")
+	}
+}
+
+func TestGoogleComputeEngineCountsWakes(t *testing.T) {
+	t.Parallel()
+
+	m := NewGceMachine()
+	m.UsePrivateIp = true
+	m.getInstanceHook = func(context.Context) (*compute.Instance, error) {
+		return testInstance("RUNNING"), nil
+	}
+	m.powerOffHook = func(context.Context, bool) error { return nil }
+
+	ctx := context.Background()
+	if err := m.PowerOn(ctx); err != nil {
+		t.Fatalf("PowerOn() error = %v", err)
+	}
+	if err := m.Refresh(ctx); err != nil {
+		t.Fatalf("Refresh() error = %v", err)
+	}
+	if got := m.Wakes(); got != 1 {
+		t.Fatalf("Wakes() = %d after re-checking a running machine, want 1", got)
+	}
+
+	if err := m.PowerOff(ctx, false, func() bool { return true }); err != nil {
+		t.Fatalf("PowerOff() error = %v", err)
+	}
+	if err := m.PowerOn(ctx); err != nil {
+		t.Fatalf("PowerOn() error = %v", err)
+	}
+	if got := m.Wakes(); got != 2 {
+		t.Fatalf("Wakes() = %d after a wake on the same address, want 2", got)
+	}
+}
+
+// recordingObserver records power cycle progress.
+type recordingObserver struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (o *recordingObserver) Status(status string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.events = append(o.events, status)
+}
+
+func (o *recordingObserver) Stopped() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.events = append(o.events, "stopped")
+}
+
+func TestGoogleComputeEngineReportsProgress(t *testing.T) {
+	t.Parallel()
+
+	statuses := []string{"TERMINATED", "STAGING", "RUNNING"}
+	var statusMu sync.Mutex
+	m := NewGceMachine()
+	m.UsePrivateIp = true
+	m.pollInterval = time.Millisecond
+	m.getInstanceHook = func(context.Context) (*compute.Instance, error) {
+		statusMu.Lock()
+		defer statusMu.Unlock()
+		status := statuses[0]
+		if len(statuses) > 1 {
+			statuses = statuses[1:]
+		}
+		return testInstance(status), nil
+	}
+	m.powerOnHook = func(context.Context, string) error { return nil }
+	m.powerOffHook = func(context.Context, bool) error { return nil }
+	observer := &recordingObserver{}
+	var observable Observable = m
+	observable.Observe(observer)
+
+	ctx := context.Background()
+	if err := m.PowerOn(ctx); err != nil {
+		t.Fatalf("PowerOn() error = %v", err)
+	}
+	if err := m.PowerOff(ctx, false, func() bool { return true }); err != nil {
+		t.Fatalf("PowerOff() error = %v", err)
+	}
+
+	observer.mu.Lock()
+	defer observer.mu.Unlock()
+	if got := strings.Join(observer.events, " "); got != "TERMINATED STAGING RUNNING RUNNING stopped" {
+		t.Fatalf("observed %q, want every status read and the power-off", got)
+	}
+}
+
+func TestGoogleComputeEnginePowerOffSkipsStoppedInstance(t *testing.T) {
+	t.Parallel()
+
+	m := NewGceMachine()
+	m.getInstanceHook = func(context.Context) (*compute.Instance, error) {
+		return testInstance("TERMINATED"), nil
+	}
+	m.powerOffHook = func(context.Context, bool) error {
+		t.Fatal("powerOff called for a TERMINATED instance")
+		return nil
+	}
+
+	if err := m.PowerOff(context.Background(), false, func() bool { return true }); err != nil {
+		t.Fatalf("PowerOff() error = %v", err)
+	}
+}
+
+func TestGoogleComputeEngineRefreshDoesNotStart(t *testing.T) {
+	t.Parallel()
+
+	status := "RUNNING"
+	m := NewGceMachine()
+	m.UsePrivateIp = true
+	m.getInstanceHook = func(context.Context) (*compute.Instance, error) {
+		return testInstance(status), nil
+	}
+	m.powerOnHook = func(context.Context, string) error {
+		t.Fatal("Refresh() started the instance")
+		return nil
+	}
+
+	if err := m.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh() error = %v", err)
+	}
+	if m.Host() != "10.42.0.8" || m.Status() != "RUNNING" {
+		t.Fatalf("Refresh() host = %q status = %q, want cached RUNNING target", m.Host(), m.Status())
+	}
+
+	status = "TERMINATED"
+	m.LastPowerOnAttempt = time.Now()
+	if err := m.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh() error = %v", err)
+	}
+	if m.Host() != "" || !m.LastAttempt().IsZero() || m.Status() != "TERMINATED" {
+		t.Fatal("Refresh() kept the target or cooldown of a stopped instance")
+	}
+}
+
 func TestGoogleComputeEngine_setIp(t *testing.T) {
 	tests := []struct {
 		name         string
@@ -329,10 +643,8 @@ func TestGoogleComputeEngine_setIp(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			m := &GoogleComputeEngine{
-				Name:         "test-instance",
-				UsePrivateIp: tt.usePrivateIp,
-			}
+			m := &GoogleComputeEngine{Name: "test-instance"}
+			m.UsePrivateIp = tt.usePrivateIp
 
 			err := m.setIp(tt.instance)
 
@@ -349,11 +661,75 @@ func TestGoogleComputeEngine_setIp(t *testing.T) {
 	}
 }
 
-func TestGoogleComputeEngine_Host(t *testing.T) {
-	m := &GoogleComputeEngine{
-		host: "192.168.1.1",
+func TestGceAddressInstanceHost(t *testing.T) {
+	t.Parallel()
+
+	one, two := 1, 2
+	vm := &compute.Instance{
+		Name: "appliance",
+		NetworkInterfaces: []*compute.NetworkInterface{
+			{
+				Network:       "https://www.googleapis.com/compute/v1/projects/p/global/networks/mgmt",
+				NetworkIP:     "10.0.0.5",
+				AccessConfigs: []*compute.AccessConfig{{NatIP: "203.0.113.1"}},
+			},
+			{
+				Network:           "https://www.googleapis.com/compute/v1/projects/p/global/networks/data",
+				NetworkIP:         "10.1.0.5",
+				Ipv6Address:       "fd20:1::5",
+				Ipv6AccessConfigs: []*compute.AccessConfig{{ExternalIpv6: "2600:1900::5"}},
+			},
+		},
+	}
+	tests := []struct {
+		name    string
+		address gceAddress
+		want    string
+		wantErr bool
+	}{
+		{name: "nic by index", address: gceAddress{UsePrivateIp: true, NetworkInterface: &one}, want: "10.1.0.5"},
+		{name: "nic by network", address: gceAddress{UsePrivateIp: true, Network: "data"}, want: "10.1.0.5"},
+		{name: "internal ipv6", address: gceAddress{UsePrivateIp: true, Network: "data", PreferIpv6: true}, want: "fd20:1::5"},
+		{name: "internal ipv6 falls back to ipv4", address: gceAddress{UsePrivateIp: true, PreferIpv6: true}, want: "10.0.0.5"},
+		{name: "external ipv6", address: gceAddress{PreferIpv6: true}, want: "2600:1900::5"},
+		{name: "external ipv4 by default", address: gceAddress{}, want: "203.0.113.1"},
+		{name: "internal dns", address: gceAddress{UseInternalDns: true}, want: "appliance.us-central1-a.c.p.internal"},
+		{name: "unknown network", address: gceAddress{Network: "other"}, wantErr: true},
+		{name: "missing nic", address: gceAddress{NetworkInterface: &two}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.address.instanceHost(vm, "p", "us-central1-a", "appliance")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("instanceHost() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("instanceHost() = %q, want %q", got, tt.want)
+			}
+		})
 	}
 
+	custom := &compute.Instance{Hostname: "appliance.corp.example.com"}
+	if got, _ := (&gceAddress{UseInternalDns: true}).instanceHost(custom, "p", "z", "appliance"); got != "appliance.corp.example.com" {
+		t.Fatalf("instanceHost() = %q, want the custom hostname", got)
+	}
+}
+
+func TestNewGceRejectsConflictingNicSelection(t *testing.T) {
+	t.Parallel()
+
+	_, err := New("google_compute_engine", map[string]any{
+		"project_id": "p", "zone": "z", "name": "vm", "networkInterface": 1, "network": "data",
+	})
+	if err == nil {
+		t.Fatal("New() accepted both networkInterface and network")
+	}
+}
+
+func TestGoogleComputeEngine_Host(t *testing.T) {
+	m := &GoogleComputeEngine{}
+	m.host = "192.168.1.1"
+
 	result := m.Host()
 	expected := "192.168.1.1"
 
@@ -0,0 +1,310 @@
+package machine
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	kubernetesServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+	workloadScaledToZero = "SCALED_TO_ZERO"
+	workloadScaling      = "SCALING"
+	workloadReady        = "READY"
+)
+
+// KubernetesWorkload scales a Deployment or StatefulSet from zero replicas
+// and proxies to its Service once the Service has ready endpoints.
+type KubernetesWorkload struct {
+	// APIServer defaults to the in-cluster KUBERNETES_SERVICE_HOST address.
+	APIServer string `yaml:"apiServer"`
+	// TokenFile and CAFile default to the pod service account credentials.
+	TokenFile string `yaml:"tokenFile"`
+	CAFile    string `yaml:"caFile"`
+	Namespace string `yaml:"namespace"`
+	// Kind is Deployment (default) or StatefulSet.
+	Kind     string `yaml:"kind"`
+	Name     string `yaml:"name"`
+	Replicas int    `yaml:"replicas"` // default: 1
+	Service  string `yaml:"service"`  // default: Name
+	// Address overrides the Service ClusterIP as the proxy target, e.g. a
+	// LoadBalancer IP or DNS name reachable from PPB.
+	Address string `yaml:"address"`
+	powerState
+	client *http.Client
+}
+
+type kubernetesScale struct {
+	Spec struct {
+		Replicas int `json:"replicas"`
+	} `json:"spec"`
+}
+
+type kubernetesEndpointSliceList struct {
+	Items []struct {
+		Endpoints []struct {
+			Conditions struct {
+				Ready *bool `json:"ready"`
+			} `json:"conditions"`
+		} `json:"endpoints"`
+	} `json:"items"`
+}
+
+type kubernetesService struct {
+	Spec struct {
+		ClusterIP string `json:"clusterIP"`
+	} `json:"spec"`
+}
+
+// kubernetesAPIError is a non-success response from the API server.
+type kubernetesAPIError struct {
+	StatusCode int
+	Reason     string
+	Message    string
+}
+
+func (e *kubernetesAPIError) Error() string {
+	return fmt.Sprintf("kubernetes API error %d %s: %s", e.StatusCode, e.Reason, e.Message)
+}
+
+func init() {
+	Register("kubernetes_workload", newKubernetesWorkloadFromMetadata)
+}
+
+func NewKubernetesWorkloadMachine() *KubernetesWorkload {
+	return &KubernetesWorkload{
+		Kind:       "Deployment",
+		Replicas:   1,
+		powerState: newPowerState(),
+	}
+}
+
+func newKubernetesWorkloadFromMetadata(metadata map[string]any) (Machine, error) {
+	workload := NewKubernetesWorkloadMachine()
+	if err := decodeMetadata(metadata, workload); err != nil {
+		return nil, err
+	}
+	if workload.Namespace == "" || workload.Name == "" {
+		return nil, fmt.Errorf("kubernetes_workload machineMetadata requires namespace and name")
+	}
+	if workload.Kind != "Deployment" && workload.Kind != "StatefulSet" {
+		return nil, fmt.Errorf("kubernetes_workload kind must be Deployment or StatefulSet, got %q", workload.Kind)
+	}
+	if workload.Replicas <= 0 {
+		workload.Replicas = 1
+	}
+	if workload.Service == "" {
+		workload.Service = workload.Name
+	}
+
+	inCluster := workload.APIServer == ""
+	if inCluster {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, fmt.Errorf("kubernetes_workload apiServer is required outside a cluster")
+		}
+		workload.APIServer = "https://" + net.JoinHostPort(host, port)
+	}
+	if workload.TokenFile == "" && inCluster {
+		workload.TokenFile = kubernetesServiceAccountDir + "/token"
+	}
+	if workload.CAFile == "" && inCluster {
+		workload.CAFile = kubernetesServiceAccountDir + "/ca.crt"
+	}
+	client, err := newKubernetesClient(workload.CAFile)
+	if err != nil {
+		return nil, err
+	}
+	workload.client = client
+	slog.Debug("loaded kubernetes config", "kubernetes", workload)
+	return workload, nil
+}
+
+func newKubernetesClient(caFile string) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if caFile != "" {
+		// The CA path is trusted deployment configuration.
+		pem, err := os.ReadFile(caFile) // #nosec G304 -- trusted deployment configuration
+		if err != nil {
+			return nil, fmt.Errorf("read kubernetes CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("kubernetes CA file %s contains no certificates", caFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	}
+	return &http.Client{Timeout: 30 * time.Second, Transport: transport}, nil
+}
+
+func (m *KubernetesWorkload) Describe() string {
+	return fmt.Sprintf("kubernetes_workload %s/%s/%s", m.Namespace, strings.ToLower(m.Kind), m.Name)
+}
+
+func (m *KubernetesWorkload) cycle() powerCycle {
+	return powerCycle{powerState: &m.powerState, driver: m, name: m.Name}
+}
+
+func (m *KubernetesWorkload) PowerOn(ctx context.Context) error {
+	return m.cycle().powerOn(ctx)
+}
+
+// Refresh re-reads the machine status and proxy target without starting it.
+func (m *KubernetesWorkload) Refresh(ctx context.Context) error {
+	return m.cycle().refresh(ctx)
+}
+
+// PowerOnWithCooldown attempts to scale up the workload if enough time has elapsed since the last attempt
+func (m *KubernetesWorkload) PowerOnWithCooldown(ctx context.Context, cooldownSeconds int) error {
+	return m.cycle().powerOnWithCooldown(ctx, cooldownSeconds)
+}
+
+func (m *KubernetesWorkload) workloadPath() string {
+	resource := "deployments"
+	if m.Kind == "StatefulSet" {
+		resource = "statefulsets"
+	}
+	return fmt.Sprintf("/apis/apps/v1/namespaces/%s/%s/%s/scale", url.PathEscape(m.Namespace), resource, url.PathEscape(m.Name))
+}
+
+// observe reports SCALED_TO_ZERO, SCALING until an endpoint of the Service
+// is ready, then READY.
+func (m *KubernetesWorkload) observe(ctx context.Context) (observation, error) {
+	var scale kubernetesScale
+	if err := m.call(ctx, http.MethodGet, m.workloadPath(), nil, &scale); err != nil {
+		return observation{}, fmt.Errorf("failed to get workload scale: %w", err)
+	}
+	if scale.Spec.Replicas == 0 {
+		return observation{status: workloadScaledToZero}, nil
+	}
+
+	var endpointSlices kubernetesEndpointSliceList
+	slicesPath := fmt.Sprintf("/apis/discovery.k8s.io/v1/namespaces/%s/endpointslices?labelSelector=%s",
+		url.PathEscape(m.Namespace), url.QueryEscape("kubernetes.io/service-name="+m.Service))
+	if err := m.call(ctx, http.MethodGet, slicesPath, nil, &endpointSlices); err != nil {
+		return observation{}, fmt.Errorf("failed to list service endpoints: %w", err)
+	}
+	ready := false
+	for _, slice := range endpointSlices.Items {
+		for _, endpoint := range slice.Endpoints {
+			// A nil ready condition is treated as ready by the API contract.
+			if endpoint.Conditions.Ready == nil || *endpoint.Conditions.Ready {
+				ready = true
+			}
+		}
+	}
+	if !ready {
+		return observation{status: workloadScaling}, nil
+	}
+
+	return observation{
+		status:    workloadReady,
+		setTarget: func() error { return m.setServiceAddress(ctx) },
+	}, nil
+}
+
+func (m *KubernetesWorkload) classify(status string) (instanceStatusAction, error) {
+	switch status {
+	case workloadReady:
+		return instanceReady, nil
+	case workloadScaledToZero:
+		return instanceStart, nil
+	case workloadScaling:
+		return instanceWait, nil
+	default:
+		return instanceWait, fmt.Errorf("unsupported workload status %q", status)
+	}
+}
+
+func (m *KubernetesWorkload) start(ctx context.Context, status string) error {
+	if status != workloadScaledToZero {
+		return fmt.Errorf("unknown status: %s", status)
+	}
+	patch := fmt.Appendf(nil, `{"spec":{"replicas":%d}}`, m.Replicas)
+	if err := m.call(ctx, http.MethodPatch, m.workloadPath(), patch, nil); err != nil {
+		return fmt.Errorf("failed to scale workload: %w", err)
+	}
+	slog.Info("Power button pressed", "currentStatus", status, "instance", m.Name, "replicas", m.Replicas)
+	return nil
+}
+
+func (m *KubernetesWorkload) setServiceAddress(ctx context.Context) error {
+	if m.Address != "" {
+		m.setHost(m.Address)
+		return nil
+	}
+	var service kubernetesService
+	path := fmt.Sprintf("/api/v1/namespaces/%s/services/%s", url.PathEscape(m.Namespace), url.PathEscape(m.Service))
+	if err := m.call(ctx, http.MethodGet, path, nil, &service); err != nil {
+		return fmt.Errorf("failed to get service: %w", err)
+	}
+	if service.Spec.ClusterIP == "" || service.Spec.ClusterIP == "None" {
+		return fmt.Errorf("service %s has no cluster IP; configure address", m.Service)
+	}
+	m.setHost(service.Spec.ClusterIP)
+	slog.Debug("Found service IP", "ip", service.Spec.ClusterIP)
+	return nil
+}
+
+// call sends one API request. A non-nil patch is sent as a JSON merge patch.
+func (m *KubernetesWorkload) call(ctx context.Context, method, path string, patch []byte, out any) error {
+	var body io.Reader
+	if patch != nil {
+		body = bytes.NewReader(patch)
+	}
+	request, err := http.NewRequestWithContext(ctx, method, strings.TrimRight(m.APIServer, "/")+path, body)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Accept", "application/json")
+	if patch != nil {
+		request.Header.Set("Content-Type", "application/merge-patch+json")
+	}
+	if m.TokenFile != "" {
+		// Projected service account tokens rotate, so read the file per call.
+		token, err := os.ReadFile(m.TokenFile) // #nosec G304 -- trusted deployment configuration
+		if err != nil {
+			return fmt.Errorf("read kubernetes token: %w", err)
+		}
+		request.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	response, err := m.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = response.Body.Close() }()
+
+	responseBody, err := io.ReadAll(io.LimitReader(response.Body, 4<<20))
+	if err != nil {
+		return err
+	}
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		apiErr := &kubernetesAPIError{StatusCode: response.StatusCode, Message: string(responseBody)}
+		var status struct {
+			Reason  string `json:"reason"`
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(responseBody, &status) == nil && status.Message != "" {
+			apiErr.Reason = status.Reason
+			apiErr.Message = status.Message
+		}
+		return apiErr
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(responseBody, out)
+}
@@ -0,0 +1,154 @@
+package machine
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeKubernetes serves the scale subresource, EndpointSlices, and Service
+// for one workload. Endpoints become ready readyAfter reads after a scale-up.
+type fakeKubernetes struct {
+	mu         sync.Mutex
+	replicas   int
+	readyAfter int
+	patches    []int
+	badTokens  int
+}
+
+func (f *fakeKubernetes) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.Header.Get("Authorization") != "Bearer test-token" {
+		f.badTokens++
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = fmt.Fprint(w, `{"kind":"Status","reason":"Unauthorized","message":"Unauthorized"}`)
+		return
+	}
+
+	switch {
+	case r.URL.Path == "/apis/apps/v1/namespaces/dev/statefulsets/notebook/scale" && r.Method == http.MethodGet:
+		_, _ = fmt.Fprintf(w, `{"spec":{"replicas":%d}}`, f.replicas)
+	case r.URL.Path == "/apis/apps/v1/namespaces/dev/statefulsets/notebook/scale" && r.Method == http.MethodPatch:
+		if r.Header.Get("Content-Type") != "application/merge-patch+json" {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		var scale kubernetesScale
+		if err := json.Unmarshal(body, &scale); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.replicas = scale.Spec.Replicas
+		f.patches = append(f.patches, scale.Spec.Replicas)
+		_, _ = w.Write(body)
+	case r.URL.Path == "/apis/discovery.k8s.io/v1/namespaces/dev/endpointslices":
+		if r.URL.Query().Get("labelSelector") != "kubernetes.io/service-name=notebook-http" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		ready := f.replicas > 0 && f.readyAfter == 0
+		if f.replicas > 0 && f.readyAfter > 0 {
+			f.readyAfter--
+		}
+		_, _ = fmt.Fprintf(w, `{"items":[{"endpoints":[{"conditions":{"ready":%t}}]}]}`, ready)
+	case r.URL.Path == "/api/v1/namespaces/dev/services/notebook-http":
+		_, _ = fmt.Fprint(w, `{"spec":{"clusterIP":"10.96.14.2"}}`)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = fmt.Fprint(w, `{"kind":"Status","reason":"NotFound","message":"not found"}`)
+	}
+}
+
+func newTestKubernetesWorkload(t *testing.T, fake *fakeKubernetes) *KubernetesWorkload {
+	t.Helper()
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("test-token\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	m, err := New("kubernetes_workload", map[string]any{
+		"apiServer": server.URL,
+		"tokenFile": tokenFile,
+		"namespace": "dev",
+		"kind":      "StatefulSet",
+		"name":      "notebook",
+		"service":   "notebook-http",
+		"replicas":  2,
+	})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	workload := m.(*KubernetesWorkload)
+	workload.pollInterval = time.Millisecond
+	workload.joinTimeout = 20 * time.Millisecond
+	return workload
+}
+
+func TestKubernetesWorkloadScalesFromZeroAndWaitsForEndpoints(t *testing.T) {
+	t.Parallel()
+
+	fake := &fakeKubernetes{readyAfter: 3}
+	m := newTestKubernetesWorkload(t, fake)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := m.PowerOnWithCooldown(ctx, 30); err != nil {
+		t.Fatalf("PowerOnWithCooldown() error = %v", err)
+	}
+	if host := m.Host(); host != "10.96.14.2" {
+		t.Fatalf("Host() = %q, want service cluster IP", host)
+	}
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if len(fake.patches) != 1 || fake.patches[0] != 2 {
+		t.Fatalf("scale patches = %v, want one scale to 2", fake.patches)
+	}
+	if fake.badTokens != 0 {
+		t.Fatalf("unauthenticated requests = %d, want 0", fake.badTokens)
+	}
+}
+
+func TestKubernetesWorkloadDoesNotRescaleRunningWorkload(t *testing.T) {
+	t.Parallel()
+
+	fake := &fakeKubernetes{replicas: 3, readyAfter: 1}
+	m := newTestKubernetesWorkload(t, fake)
+	m.Address = "notebook.dev.example.test"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := m.PowerOn(ctx); err != nil {
+		t.Fatalf("PowerOn() error = %v", err)
+	}
+	if host := m.Host(); host != "notebook.dev.example.test" {
+		t.Fatalf("Host() = %q, want address override", host)
+	}
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if len(fake.patches) != 0 {
+		t.Fatalf("scale patches = %v, want none", fake.patches)
+	}
+}
+
+func TestKubernetesWorkloadRequiresAPIServerOutsideCluster(t *testing.T) {
+	t.Setenv("KUBERNETES_SERVICE_HOST", "")
+	t.Setenv("KUBERNETES_SERVICE_PORT", "")
+
+	_, err := New("kubernetes_workload", map[string]any{"namespace": "dev", "name": "notebook"})
+	if err == nil {
+		t.Fatal("New() unexpectedly succeeded without an API server")
+	}
+}
@@ -0,0 +1,237 @@
+package machine
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+// Libvirt starts or resumes a libvirt domain, e.g. a KVM guest, and proxies
+// to its static address or the address reported by libvirt.
+type Libvirt struct {
+	// URI is the libvirt connection URI, e.g. qemu:///system or
+	// qemu+ssh://admin@kvm1/system. Empty uses the virsh default.
+	URI    string `yaml:"uri"`
+	Domain string `yaml:"domain"`
+	// Address is a static proxy target. When empty the address is discovered
+	// from AddressSource.
+	Address string `yaml:"address"`
+	// AddressSource is passed to `virsh domifaddr --source`: lease (default),
+	// agent, or arp.
+	AddressSource string `yaml:"addressSource"`
+	Virsh         string `yaml:"virsh"` // virsh binary, default: virsh
+	powerState
+	driver libvirtDriver
+}
+
+// libvirtDriver is the hypervisor API used by Libvirt. virshDriver talks to
+// a real hypervisor; tests substitute a fake.
+type libvirtDriver interface {
+	domainState(ctx context.Context, domain string) (string, error)
+	startDomain(ctx context.Context, domain string) error
+	resumeDomain(ctx context.Context, domain string) error
+	domainAddresses(ctx context.Context, domain, source string) ([]string, error)
+}
+
+// libvirtAwaitingAddress is reported while a running domain has not yet
+// obtained a DHCP lease or agent address.
+const libvirtAwaitingAddress = "running without address"
+
+func init() {
+	Register("libvirt", newLibvirtFromMetadata)
+}
+
+func NewLibvirtMachine() *Libvirt {
+	return &Libvirt{
+		AddressSource: "lease",
+		Virsh:         "virsh",
+		powerState:    newPowerState(),
+	}
+}
+
+func newLibvirtFromMetadata(metadata map[string]any) (Machine, error) {
+	domain := NewLibvirtMachine()
+	if err := decodeMetadata(metadata, domain); err != nil {
+		return nil, err
+	}
+	if domain.Domain == "" {
+		return nil, fmt.Errorf("libvirt machineMetadata requires domain")
+	}
+	switch domain.AddressSource {
+	case "lease", "agent", "arp":
+	default:
+		return nil, fmt.Errorf("libvirt addressSource must be lease, agent, or arp, got %q", domain.AddressSource)
+	}
+	domain.driver = &virshDriver{binary: domain.Virsh, uri: domain.URI}
+	slog.Debug("loaded libvirt config", "libvirt", domain)
+	return domain, nil
+}
+
+func (m *Libvirt) Describe() string {
+	if m.URI == "" {
+		return fmt.Sprintf("libvirt %s", m.Domain)
+	}
+	return fmt.Sprintf("libvirt %s/%s", m.URI, m.Domain)
+}
+
+func (m *Libvirt) cycle() powerCycle {
+	return powerCycle{powerState: &m.powerState, driver: m, name: m.Domain}
+}
+
+func (m *Libvirt) PowerOn(ctx context.Context) error {
+	return m.cycle().powerOn(ctx)
+}
+
+// Refresh re-reads the machine status and proxy target without starting it.
+func (m *Libvirt) Refresh(ctx context.Context) error {
+	return m.cycle().refresh(ctx)
+}
+
+// PowerOnWithCooldown attempts to start the domain if enough time has elapsed since the last attempt
+func (m *Libvirt) PowerOnWithCooldown(ctx context.Context, cooldownSeconds int) error {
+	return m.cycle().powerOnWithCooldown(ctx, cooldownSeconds)
+}
+
+func (m *Libvirt) observe(ctx context.Context) (observation, error) {
+	state, err := m.driver.domainState(ctx, m.Domain)
+	if err != nil {
+		return observation{}, fmt.Errorf("failed to get domain state: %w", err)
+	}
+	if state != "running" {
+		return observation{status: state}, nil
+	}
+
+	address := m.Address
+	if address == "" {
+		addresses, err := m.driver.domainAddresses(ctx, m.Domain, m.AddressSource)
+		if err != nil {
+			return observation{}, fmt.Errorf("failed to get domain addresses: %w", err)
+		}
+		if len(addresses) == 0 {
+			return observation{status: libvirtAwaitingAddress}, nil
+		}
+		address = addresses[0]
+	}
+	return observation{
+		status: state,
+		setTarget: func() error {
+			m.setHost(address)
+			slog.Debug("Found domain address", "ip", address, "source", m.AddressSource)
+			return nil
+		},
+	}, nil
+}
+
+func (m *Libvirt) classify(status string) (instanceStatusAction, error) {
+	return classifyDomainState(status)
+}
+
+func (m *Libvirt) start(ctx context.Context, status string) error {
+	switch status {
+	case "shut off":
+		if err := m.driver.startDomain(ctx, m.Domain); err != nil {
+			return fmt.Errorf("failed to start domain: %w", err)
+		}
+	case "paused":
+		if err := m.driver.resumeDomain(ctx, m.Domain); err != nil {
+			return fmt.Errorf("failed to resume domain: %w", err)
+		}
+	default:
+		return fmt.Errorf("unknown status: %s", status)
+	}
+	slog.Info("Power button pressed", "currentStatus", status, "instance", m.Domain)
+	return nil
+}
+
+// classifyDomainState maps `virsh domstate` output onto the shared power
+// cycle. Shut off and paused domains correspond to GCE's TERMINATED and
+// SUSPENDED states.
+func classifyDomainState(state string) (instanceStatusAction, error) {
+	switch state {
+	case "running":
+		return instanceReady, nil
+	case "shut off", "paused":
+		return instanceStart, nil
+	case "in shutdown", libvirtAwaitingAddress:
+		return instanceWait, nil
+	default:
+		return instanceWait, fmt.Errorf("unsupported domain state %q", state)
+	}
+}
+
+// virshDriver runs the virsh CLI, which keeps PPB free of cgo libvirt
+// bindings and works with remote connection URIs.
+type virshDriver struct {
+	binary string
+	uri    string
+}
+
+func (d *virshDriver) run(ctx context.Context, args ...string) (string, error) {
+	subcommand := args[0]
+	if d.uri != "" {
+		args = append([]string{"--connect", d.uri}, args...)
+	}
+	var stdout, stderr bytes.Buffer
+	// The binary and arguments come from trusted deployment configuration and
+	// are passed without a shell.
+	command := exec.CommandContext(ctx, d.binary, args...) // #nosec G204 -- trusted deployment configuration
+	command.Stdout = &stdout
+	command.Stderr = &stderr
+	if err := command.Run(); err != nil {
+		return "", fmt.Errorf("virsh %s: %w: %s", subcommand, err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+func (d *virshDriver) domainState(ctx context.Context, domain string) (string, error) {
+	output, err := d.run(ctx, "domstate", domain)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(output), nil
+}
+
+func (d *virshDriver) startDomain(ctx context.Context, domain string) error {
+	_, err := d.run(ctx, "start", domain)
+	return err
+}
+
+func (d *virshDriver) resumeDomain(ctx context.Context, domain string) error {
+	_, err := d.run(ctx, "resume", domain)
+	return err
+}
+
+func (d *virshDriver) domainAddresses(ctx context.Context, domain, source string) ([]string, error) {
+	output, err := d.run(ctx, "domifaddr", domain, "--source", source)
+	if err != nil {
+		return nil, err
+	}
+	return parseDomifaddr(output), nil
+}
+
+// parseDomifaddr extracts addresses from the `virsh domifaddr` table, IPv4
+// first, skipping loopback entries reported by the guest agent.
+func parseDomifaddr(output string) []string {
+	var ipv4, ipv6 []string
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 {
+			continue
+		}
+		address, _, _ := strings.Cut(fields[len(fields)-1], "/")
+		ip := net.ParseIP(address)
+		if ip == nil || ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+			continue
+		}
+		if ip.To4() != nil {
+			ipv4 = append(ipv4, address)
+		} else {
+			ipv6 = append(ipv6, address)
+		}
+	}
+	return append(ipv4, ipv6...)
+}
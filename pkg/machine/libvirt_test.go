@@ -0,0 +1,159 @@
+package machine
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeLibvirt is an in-memory libvirtDriver. Starting or resuming a domain
+// makes it running; addresses appear after leaseDelay state reads.
+type fakeLibvirt struct {
+	mu         sync.Mutex
+	state      string
+	addresses  []string
+	leaseDelay int
+	calls      []string
+	startErr   error
+}
+
+func (f *fakeLibvirt) domainState(context.Context, string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.state, nil
+}
+
+func (f *fakeLibvirt) startDomain(context.Context, string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, "start")
+	if f.startErr != nil {
+		return f.startErr
+	}
+	f.state = "running"
+	return nil
+}
+
+func (f *fakeLibvirt) resumeDomain(context.Context, string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, "resume")
+	f.state = "running"
+	return nil
+}
+
+func (f *fakeLibvirt) domainAddresses(context.Context, string, string) ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.leaseDelay > 0 {
+		f.leaseDelay--
+		return nil, nil
+	}
+	return f.addresses, nil
+}
+
+func newTestLibvirt(fake *fakeLibvirt) *Libvirt {
+	m := NewLibvirtMachine()
+	m.Domain = "jupyter"
+	m.driver = fake
+	m.pollInterval = time.Millisecond
+	m.joinTimeout = 20 * time.Millisecond
+	return m
+}
+
+func TestLibvirtStartsShutOffDomainAndWaitsForLease(t *testing.T) {
+	t.Parallel()
+
+	fake := &fakeLibvirt{state: "shut off", addresses: []string{"192.168.122.45"}, leaseDelay: 2}
+	m := newTestLibvirt(fake)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := m.PowerOnWithCooldown(ctx, 30); err != nil {
+		t.Fatalf("PowerOnWithCooldown() error = %v", err)
+	}
+	if host := m.Host(); host != "192.168.122.45" {
+		t.Fatalf("Host() = %q, want leased address", host)
+	}
+	if !slices.Equal(fake.calls, []string{"start"}) {
+		t.Fatalf("driver calls = %v, want one start", fake.calls)
+	}
+}
+
+func TestLibvirtResumesPausedDomainWithStaticAddress(t *testing.T) {
+	t.Parallel()
+
+	fake := &fakeLibvirt{state: "paused"}
+	m := newTestLibvirt(fake)
+	m.Address = "10.10.0.7"
+
+	if err := m.PowerOn(context.Background()); err != nil {
+		t.Fatalf("PowerOn() error = %v", err)
+	}
+	if host := m.Host(); host != "10.10.0.7" {
+		t.Fatalf("Host() = %q, want static address", host)
+	}
+	if !slices.Equal(fake.calls, []string{"resume"}) {
+		t.Fatalf("driver calls = %v, want one resume", fake.calls)
+	}
+}
+
+func TestLibvirtReturnsPermanentStartError(t *testing.T) {
+	t.Parallel()
+
+	fake := &fakeLibvirt{state: "shut off", startErr: errors.New("domain is not defined")}
+	m := newTestLibvirt(fake)
+
+	if err := m.PowerOn(context.Background()); err == nil {
+		t.Fatal("PowerOn() unexpectedly succeeded")
+	}
+}
+
+func TestParseDomifaddr(t *testing.T) {
+	t.Parallel()
+
+	output := ` Name       MAC address          Protocol     Address
+-------------------------------------------------------------------------------
+ lo         00:00:00:00:00:00    ipv4         127.0.0.1/8
+ vnet0      52:54:00:8e:35:0a    ipv6         fd00::45/64
+ -          -                    ipv4         192.168.122.45/24
+`
+	got := parseDomifaddr(output)
+	want := []string{"192.168.122.45", "fd00::45"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("parseDomifaddr() = %v, want %v", got, want)
+	}
+}
+
+func TestClassifyDomainState(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		state   string
+		action  instanceStatusAction
+		wantErr bool
+	}{
+		{state: "running", action: instanceReady},
+		{state: "shut off", action: instanceStart},
+		{state: "paused", action: instanceStart},
+		{state: "in shutdown", action: instanceWait},
+		{state: libvirtAwaitingAddress, action: instanceWait},
+		{state: "crashed", action: instanceWait, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.state, func(t *testing.T) {
+			t.Parallel()
+			action, err := classifyDomainState(test.state)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("classifyDomainState(%q) error = %v, wantErr %v", test.state, err, test.wantErr)
+			}
+			if action != test.action {
+				t.Fatalf("classifyDomainState(%q) = %v, want %v", test.state, action, test.action)
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+package machine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// Machine is a backend that PPB can power on before proxying traffic to it.
+type Machine interface {
+	// PowerOnWithCooldown ensures the machine is running and has a proxy target
+	// host. Provider mutations are rate limited by cooldownSeconds.
+	PowerOnWithCooldown(ctx context.Context, cooldownSeconds int) error
+	// Host returns the cached proxy target host, or "" when it is unknown.
+	Host() string
+	// Status returns the last provider status observed by PPB, or "" when the
+	// machine has not been checked yet.
+	Status() string
+	// Describe identifies the machine in logs and status output.
+	Describe() string
+	// LastAttempt returns when PPB last checked or started the machine, or the
+	// zero time.
+	LastAttempt() time.Time
+	// Wakes counts how often PPB found a host for the machine after having
+	// none: the first successful check and every start after a power-off or
+	// a stop PPB noticed. It changes even when the machine comes back on the
+	// same address.
+	Wakes() uint64
+	// Refresh re-reads the provider status and proxy target without starting
+	// the machine.
+	Refresh(ctx context.Context) error
+}
+
+// ErrNotIdle is returned by Stopper.PowerOff when traffic arrived before the
+// power-on lock was acquired.
+var ErrNotIdle = errors.New("machine is no longer idle")
+
+// ErrStartRefused is returned by PowerOnWithCooldown under a context from
+// RefuseStarts when the machine is not running and would have to be started.
+var ErrStartRefused = errors.New("machine is not running and starts are refused")
+
+type refuseStartsKey struct{}
+
+// RefuseStarts returns a context under which PowerOnWithCooldown still picks
+// up a machine that is running or already starting, but drops the cached
+// target and returns ErrStartRefused instead of starting a stopped one.
+func RefuseStarts(ctx context.Context) context.Context {
+	return context.WithValue(ctx, refuseStartsKey{}, true)
+}
+
+func startsRefused(ctx context.Context) bool {
+	refused, _ := ctx.Value(refuseStartsKey{}).(bool)
+	return refused
+}
+
+// Stopper is implemented by backends that PPB can power off after a quiet
+// period. PowerOff holds the power-on lock, so it never interleaves with a
+// wake, and only proceeds when stillIdle, called under that lock, is true.
+type Stopper interface {
+	Machine
+	PowerOff(ctx context.Context, suspend bool, stillIdle func() bool) error
+}
+
+// Balancer is implemented by backends with several interchangeable proxy
+// targets. Host stays the first target and has no side effects; the proxy
+// calls PickHost once per dial to spread requests, and HasHost to tell
+// whether a target that stopped answering is still current.
+type Balancer interface {
+	Machine
+	PickHost() string
+	HasHost(host string) bool
+}
+
+// Observer receives power cycle progress as PPB observes it. Calls are made
+// without machine locks held and must not block.
+type Observer interface {
+	// Status is called with every provider status read.
+	Status(status string)
+	// Stopped is called when PPB powers the machine off or finds it no longer
+	// running and drops its proxy target.
+	Stopped()
+}
+
+// Observable is implemented by backends that report their power cycle to an
+// Observer.
+type Observable interface {
+	Machine
+	Observe(o Observer)
+}
+
+// Factory builds a Machine from the machineMetadata section of the config.
+type Factory func(metadata map[string]any) (Machine, error)
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]Factory{}
+)
+
+// Register makes a backend available under the given config `type:` value.
+// It panics when the type is registered twice.
+func Register(machineType string, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if factory == nil {
+		panic("machine: Register factory is nil for " + machineType)
+	}
+	if _, exists := registry[machineType]; exists {
+		panic("machine: Register called twice for " + machineType)
+	}
+	registry[machineType] = factory
+}
+
+// Types returns the registered backend types in sorted order.
+func Types() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	types := make([]string, 0, len(registry))
+	for machineType := range registry {
+		types = append(types, machineType)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// New builds the backend registered for machineType.
+func New(machineType string, metadata map[string]any) (Machine, error) {
+	registryMu.RLock()
+	factory, ok := registry[machineType]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown machine type: %s (supported: %s)", machineType, strings.Join(Types(), ", "))
+	}
+	return factory(metadata)
+}
+
+// decodeMetadata copies the generic machineMetadata map into a backend's
+// typed configuration using its yaml tags.
+func decodeMetadata(metadata map[string]any, out any) error {
+	machineYAML, err := yaml.Marshal(metadata)
+	if err != nil {
+		return fmt.Errorf("encode machine metadata: %w", err)
+	}
+	if err := yaml.Unmarshal(machineYAML, out); err != nil {
+		return fmt.Errorf("decode machine metadata: %w", err)
+	}
+	return nil
+}
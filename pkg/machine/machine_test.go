@@ -0,0 +1,85 @@
+package machine
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+type stubMachine struct {
+	host string
+}
+
+func (s *stubMachine) PowerOnWithCooldown(context.Context, int) error { return nil }
+func (s *stubMachine) Host() string                                   { return s.host }
+func (s *stubMachine) Status() string                                 { return "RUNNING" }
+func (s *stubMachine) Describe() string                               { return "stub " + s.host }
+func (s *stubMachine) LastAttempt() time.Time                         { return time.Time{} }
+func (s *stubMachine) Wakes() uint64                                  { return 1 }
+func (s *stubMachine) Refresh(context.Context) error                  { return nil }
+
+func TestRegisterBuildsMachineFromMetadata(t *testing.T) {
+	Register("test_stub", func(metadata map[string]any) (Machine, error) {
+		var settings struct {
+			Host string `yaml:"host"`
+		}
+		if err := decodeMetadata(metadata, &settings); err != nil {
+			return nil, err
+		}
+		return &stubMachine{host: settings.Host}, nil
+	})
+
+	m, err := New("test_stub", map[string]any{"host": "10.0.0.9"})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if m.Host() != "10.0.0.9" {
+		t.Fatalf("Host() = %q, want 10.0.0.9", m.Host())
+	}
+	if !slices.Contains(Types(), "test_stub") {
+		t.Fatalf("Types() = %v, want test_stub registered", Types())
+	}
+}
+
+func TestRegisterRejectsDuplicateType(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("Register() did not panic for a duplicate type")
+		}
+	}()
+	Register("google_compute_engine", newGceFromMetadata)
+}
+
+func TestNewUnknownTypeListsSupportedBackends(t *testing.T) {
+	_, err := New("carrier_pigeon", nil)
+	if err == nil {
+		t.Fatal("New() unexpectedly succeeded for an unknown type")
+	}
+	if !strings.Contains(err.Error(), "google_compute_engine") {
+		t.Fatalf("New() error = %v, want supported types listed", err)
+	}
+}
+
+func TestNewGoogleComputeEngineFromMetadata(t *testing.T) {
+	m, err := New("google_compute_engine", map[string]any{
+		"project_id":   "test-project",
+		"zone":         "us-central1-a",
+		"name":         "test-instance",
+		"usePrivateIp": true,
+	})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	gce, ok := m.(*GoogleComputeEngine)
+	if !ok {
+		t.Fatalf("New() = %T, want *GoogleComputeEngine", m)
+	}
+	if gce.Lock == nil || !gce.UsePrivateIp || gce.ProjectId != "test-project" {
+		t.Fatalf("New() = %+v, want decoded metadata and initialized lock", gce)
+	}
+	if got := gce.Describe(); got != "google_compute_engine test-project/us-central1-a/test-instance" {
+		t.Fatalf("Describe() = %q", got)
+	}
+}
@@ -0,0 +1,440 @@
+package machine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+)
+
+type instanceStatusAction int
+
+const (
+	instanceReady instanceStatusAction = iota
+	instanceStart
+	instanceWait
+)
+
+// powerState is the power-on lock, cooldown, and cached target shared by
+// backends that are driven through powerCycle.
+type powerState struct {
+	Lock               *semaphore.Weighted
+	LastPowerOnAttempt time.Time
+	host               string
+	wakes              uint64
+	status             string
+	observer           Observer
+	hostMutex          sync.RWMutex
+	pollInterval       time.Duration
+	joinTimeout        time.Duration
+	now                func() time.Time
+}
+
+func newPowerState() powerState {
+	return powerState{
+		Lock: semaphore.NewWeighted(1),
+	}
+}
+
+func (s *powerState) Host() string {
+	s.hostMutex.RLock()
+	defer s.hostMutex.RUnlock()
+	return s.host
+}
+
+// Status returns the last provider status observed by the power cycle.
+func (s *powerState) Status() string {
+	s.hostMutex.RLock()
+	defer s.hostMutex.RUnlock()
+	return s.status
+}
+
+// SetHostForTesting sets the host IP for testing purposes
+func (s *powerState) SetHostForTesting(host string) {
+	s.setHost(host)
+}
+
+func (s *powerState) setHost(host string) {
+	s.hostMutex.Lock()
+	defer s.hostMutex.Unlock()
+	if s.host == "" && host != "" {
+		s.wakes++
+	}
+	s.host = host
+}
+
+func (s *powerState) Wakes() uint64 {
+	s.hostMutex.RLock()
+	defer s.hostMutex.RUnlock()
+	return s.wakes
+}
+
+// LastAttempt returns when the power cycle last checked or started the
+// machine, or the zero time.
+func (s *powerState) LastAttempt() time.Time {
+	s.hostMutex.RLock()
+	defer s.hostMutex.RUnlock()
+	return s.LastPowerOnAttempt
+}
+
+func (s *powerState) setLastAttempt(t time.Time) {
+	s.hostMutex.Lock()
+	defer s.hostMutex.Unlock()
+	s.LastPowerOnAttempt = t
+}
+
+// Observe reports every status read and dropped target to o.
+func (s *powerState) Observe(o Observer) {
+	s.hostMutex.Lock()
+	defer s.hostMutex.Unlock()
+	s.observer = o
+}
+
+// forgetTarget drops the cached target and cooldown of a machine that is no
+// longer running.
+func (s *powerState) forgetTarget() {
+	s.hostMutex.Lock()
+	s.host = ""
+	s.LastPowerOnAttempt = time.Time{}
+	observer := s.observer
+	s.hostMutex.Unlock()
+	if observer != nil {
+		observer.Stopped()
+	}
+}
+
+func (s *powerState) recordStatus(status string) {
+	s.hostMutex.Lock()
+	s.status = status
+	observer := s.observer
+	s.hostMutex.Unlock()
+	if observer != nil {
+		observer.Status(status)
+	}
+}
+
+func (s *powerState) effectivePollInterval() time.Duration {
+	if s.pollInterval > 0 {
+		return s.pollInterval
+	}
+	return 2 * time.Second
+}
+
+func (s *powerState) effectiveJoinTimeout() time.Duration {
+	if s.joinTimeout > 0 {
+		return s.joinTimeout
+	}
+	return 10 * time.Second
+}
+
+func (s *powerState) currentTime() time.Time {
+	if s.now != nil {
+		return s.now()
+	}
+	return time.Now()
+}
+
+// observation is one provider status read. setTarget records the proxy
+// target from the same read and is only called once the status is ready.
+type observation struct {
+	status    string
+	setTarget func() error
+}
+
+// powerDriver is the provider-specific half of a backend. powerCycle owns the
+// start/wait/join sequence and calls the driver for reads and mutations.
+type powerDriver interface {
+	observe(ctx context.Context) (observation, error)
+	classify(status string) (instanceStatusAction, error)
+	start(ctx context.Context, status string) error
+}
+
+type powerCycle struct {
+	*powerState
+	driver powerDriver
+	name   string
+}
+
+func (c powerCycle) read(ctx context.Context) (observation, error) {
+	obs, err := c.driver.observe(ctx)
+	if err != nil {
+		return observation{}, err
+	}
+	c.recordStatus(obs.status)
+	return obs, nil
+}
+
+func (c powerCycle) powerOn(ctx context.Context) error {
+	// get machine metadata
+	obs, err := c.read(ctx)
+	if err != nil {
+		return fmt.Errorf("could not fetch instance metadata: %v", err)
+	}
+
+	slog.Debug("Instance status", "status", obs.status, "instance", c.name)
+	action, err := c.driver.classify(obs.status)
+	if err != nil {
+		return err
+	}
+	startRequested := false
+	switch action {
+	case instanceReady:
+		return obs.setTarget()
+	case instanceStart:
+		if err := c.refuseStart(ctx, obs.status); err != nil {
+			return err
+		}
+		if err := c.driver.start(ctx, obs.status); err != nil {
+			return c.joinAfterPowerOnError(ctx, fmt.Errorf("could not power on: %w", err))
+		}
+		startRequested = true
+	case instanceWait:
+		// Another request or operator has already initiated a state change.
+		// Continue through the bounded state loop instead of returning without
+		// a usable target IP.
+	}
+
+	return c.waitForInstanceRunning(ctx, startRequested)
+}
+
+// Polls instance metadata until the VM is in the RUNNING state
+func (c powerCycle) waitForInstanceRunning(ctx context.Context, startRequested bool) error {
+	ticker := time.NewTicker(c.effectivePollInterval())
+	defer ticker.Stop()
+
+	seenTransition := false
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			obs, err := c.read(ctx)
+			if err != nil {
+				slog.Warn("Failed to fetch instance status, retrying...", "error", err)
+				continue
+			}
+
+			slog.Debug("Polling instance status", "status", obs.status, "instance", c.name)
+
+			action, err := c.driver.classify(obs.status)
+			if err != nil {
+				return err
+			}
+			switch action {
+			case instanceReady:
+				return obs.setTarget()
+			case instanceStart:
+				if startRequested && !seenTransition {
+					// The start/resume API can become visible before the instance
+					// status changes. Avoid issuing the same mutation twice.
+					continue
+				}
+				if err := c.refuseStart(ctx, obs.status); err != nil {
+					return err
+				}
+				if err := c.driver.start(ctx, obs.status); err != nil {
+					return c.joinAfterPowerOnError(ctx, fmt.Errorf("could not power on after transitional state: %w", err))
+				}
+				startRequested = true
+				seenTransition = false
+			case instanceWait:
+				seenTransition = true
+				continue
+			}
+		}
+	}
+}
+
+// refuseStart drops the cached target of a machine found stopped under a
+// context from RefuseStarts, so later requests see it is not running.
+func (c powerCycle) refuseStart(ctx context.Context, status string) error {
+	if !startsRefused(ctx) {
+		return nil
+	}
+	slog.Debug("Not starting machine; starts are refused", "status", status, "instance", c.name)
+	c.forgetTarget()
+	return ErrStartRefused
+}
+
+// operationFailure is implemented by errors for mutations the provider
+// accepted and then reported as failed. There is no competing start to join,
+// so they are returned immediately.
+type operationFailure interface {
+	error
+	operationFailed()
+}
+
+// joinAfterPowerOnError handles the cross-process race where another Cloud
+// Run revision starts or resumes the same VM after both observed a terminal
+// state. A conflicting mutation is successful from PPB's perspective once the
+// instance is observed transitioning or running. Permanent failures still
+// return within a short bounded window.
+func (c powerCycle) joinAfterPowerOnError(ctx context.Context, powerErr error) error {
+	var failed operationFailure
+	if errors.As(powerErr, &failed) {
+		return powerErr
+	}
+
+	timer := time.NewTimer(c.effectiveJoinTimeout())
+	defer timer.Stop()
+	ticker := time.NewTicker(c.effectivePollInterval())
+	defer ticker.Stop()
+
+	for {
+		obs, err := c.read(ctx)
+		if err == nil {
+			action, classifyErr := c.driver.classify(obs.status)
+			if classifyErr != nil {
+				return classifyErr
+			}
+			switch action {
+			case instanceReady:
+				return obs.setTarget()
+			case instanceWait:
+				return c.waitForInstanceRunning(ctx, false)
+			case instanceStart:
+				// The competing operation might not be visible yet.
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+			return powerErr
+		case <-ticker.C:
+		}
+	}
+}
+
+// powerOnWithCooldown attempts to power on the machine if enough time has elapsed since the last attempt
+func (c powerCycle) powerOnWithCooldown(ctx context.Context, cooldownSeconds int) error {
+	if c.Lock == nil {
+		return fmt.Errorf("machine power-on lock is not initialized")
+	}
+	if err := c.Lock.Acquire(ctx, 1); err != nil {
+		return fmt.Errorf("wait for concurrent power-on attempt: %w", err)
+	}
+	defer c.Lock.Release(1)
+
+	now := c.currentTime()
+	retryAt := c.LastPowerOnAttempt.Add(time.Duration(cooldownSeconds) * time.Second)
+	if !c.LastPowerOnAttempt.IsZero() && now.Before(retryAt) {
+		slog.Debug("Power-on attempt skipped due to cooldown", "instance", c.name, "cooldown", cooldownSeconds)
+		if c.Host() == "" {
+			return c.waitForCooldownTransition(ctx, retryAt)
+		}
+		return nil
+	}
+
+	// Update the last attempt time before making the API call
+	c.setLastAttempt(now)
+
+	slog.Debug("Attempting power-on check", "instance", c.name)
+	return c.powerOn(ctx)
+}
+
+// waitForCooldownTransition lets a caller join an accepted start whose state
+// change was not visible before the previous request was cancelled. It polls
+// without issuing another mutation until the cooldown expires, then makes one
+// fresh power-on attempt if the VM is still terminal.
+func (c powerCycle) waitForCooldownTransition(ctx context.Context, retryAt time.Time) error {
+	ticker := time.NewTicker(c.effectivePollInterval())
+	defer ticker.Stop()
+
+	for {
+		obs, err := c.read(ctx)
+		if err == nil {
+			action, classifyErr := c.driver.classify(obs.status)
+			if classifyErr != nil {
+				return classifyErr
+			}
+			switch action {
+			case instanceReady:
+				return obs.setTarget()
+			case instanceWait:
+				return c.waitForInstanceRunning(ctx, false)
+			case instanceStart:
+				// Wait out the mutation cooldown before retrying.
+			}
+		}
+
+		if !c.currentTime().Before(retryAt) {
+			c.setLastAttempt(c.currentTime())
+			return c.powerOn(ctx)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// powerOff runs stop when the machine is ready and then clears the cached
+// target and cooldown, so the next request performs a fresh power-on check
+// instead of proxying to a stopped machine.
+func (c powerCycle) powerOff(ctx context.Context, stillIdle func() bool, stop func(context.Context) error) error {
+	if c.Lock == nil {
+		return fmt.Errorf("machine power-on lock is not initialized")
+	}
+	if err := c.Lock.Acquire(ctx, 1); err != nil {
+		return fmt.Errorf("wait for concurrent power-on attempt: %w", err)
+	}
+	defer c.Lock.Release(1)
+
+	if !stillIdle() {
+		return ErrNotIdle
+	}
+	obs, err := c.read(ctx)
+	if err != nil {
+		return fmt.Errorf("could not fetch instance metadata: %v", err)
+	}
+	action, err := c.driver.classify(obs.status)
+	if err != nil {
+		return err
+	}
+	if action == instanceReady {
+		if err := stop(ctx); err != nil {
+			return err
+		}
+	} else {
+		slog.Debug("Skipping power-off of machine that is not running", "status", obs.status, "instance", c.name)
+	}
+
+	c.forgetTarget()
+	return nil
+}
+
+// refresh re-reads the provider state under the power-on lock without
+// mutating the machine. A machine that is not ready loses its cached target
+// and cooldown, so the next request wakes it immediately.
+func (c powerCycle) refresh(ctx context.Context) error {
+	if c.Lock == nil {
+		return fmt.Errorf("machine power-on lock is not initialized")
+	}
+	if err := c.Lock.Acquire(ctx, 1); err != nil {
+		return fmt.Errorf("wait for concurrent power-on attempt: %w", err)
+	}
+	defer c.Lock.Release(1)
+
+	obs, err := c.read(ctx)
+	if err != nil {
+		return fmt.Errorf("could not fetch instance metadata: %v", err)
+	}
+	action, err := c.driver.classify(obs.status)
+	if err != nil {
+		return err
+	}
+	if action == instanceReady {
+		return obs.setTarget()
+	}
+	c.forgetTarget()
+	return nil
+}
@@ -0,0 +1,156 @@
+package machine
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"time"
+)
+
+// WakeOnLan wakes a physical machine with a magic packet. The machine has no
+// provider API, so TCP reachability of Hostname:Port is the RUNNING signal.
+type WakeOnLan struct {
+	MAC string `yaml:"mac"`
+	// Broadcast is the UDP address the magic packet is sent to, default
+	// 255.255.255.255:9. Use the subnet broadcast address when PPB is routed.
+	Broadcast string `yaml:"broadcast"`
+	Hostname  string `yaml:"host"`
+	// Port is probed for reachability. It is usually the proxied app port.
+	Port         int `yaml:"port"`
+	ProbeTimeout int `yaml:"probeTimeout"` // seconds, default: 2
+	powerState
+	hardwareAddr net.HardwareAddr
+}
+
+const (
+	wolReachable   = "RUNNING"
+	wolUnreachable = "UNREACHABLE"
+)
+
+func init() {
+	Register("wake_on_lan", newWakeOnLanFromMetadata)
+}
+
+func NewWakeOnLanMachine() *WakeOnLan {
+	return &WakeOnLan{
+		Broadcast:  "255.255.255.255:9",
+		powerState: newPowerState(),
+	}
+}
+
+func newWakeOnLanFromMetadata(metadata map[string]any) (Machine, error) {
+	wol := NewWakeOnLanMachine()
+	if err := decodeMetadata(metadata, wol); err != nil {
+		return nil, err
+	}
+	if wol.Hostname == "" || wol.Port <= 0 {
+		return nil, fmt.Errorf("wake_on_lan machineMetadata requires host and port")
+	}
+	hardwareAddr, err := net.ParseMAC(wol.MAC)
+	if err != nil {
+		return nil, fmt.Errorf("wake_on_lan mac: %w", err)
+	}
+	if len(hardwareAddr) != 6 {
+		return nil, fmt.Errorf("wake_on_lan mac %s is not a 48-bit address", wol.MAC)
+	}
+	wol.hardwareAddr = hardwareAddr
+	slog.Debug("loaded wake-on-lan config", "wol", wol)
+	return wol, nil
+}
+
+func (m *WakeOnLan) Describe() string {
+	return fmt.Sprintf("wake_on_lan %s (%s)", m.MAC, m.address())
+}
+
+func (m *WakeOnLan) cycle() powerCycle {
+	return powerCycle{powerState: &m.powerState, driver: m, name: m.Hostname}
+}
+
+func (m *WakeOnLan) PowerOn(ctx context.Context) error {
+	return m.cycle().powerOn(ctx)
+}
+
+// Refresh re-reads the machine status and proxy target without starting it.
+func (m *WakeOnLan) Refresh(ctx context.Context) error {
+	return m.cycle().refresh(ctx)
+}
+
+// PowerOnWithCooldown sends a magic packet if enough time has elapsed since the last attempt
+func (m *WakeOnLan) PowerOnWithCooldown(ctx context.Context, cooldownSeconds int) error {
+	return m.cycle().powerOnWithCooldown(ctx, cooldownSeconds)
+}
+
+func (m *WakeOnLan) address() string {
+	return net.JoinHostPort(m.Hostname, strconv.Itoa(m.Port))
+}
+
+// observe reports RUNNING once a TCP connection to Hostname:Port succeeds.
+func (m *WakeOnLan) observe(ctx context.Context) (observation, error) {
+	timeout := time.Duration(m.ProbeTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = 2 * time.Second
+	}
+	probeCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	status := wolReachable
+	connection, err := (&net.Dialer{}).DialContext(probeCtx, "tcp", m.address())
+	if err != nil {
+		if ctx.Err() != nil {
+			return observation{}, ctx.Err()
+		}
+		slog.Debug("Machine is not reachable", "address", m.address(), "error", err)
+		status = wolUnreachable
+	} else {
+		_ = connection.Close()
+	}
+	return observation{
+		status: status,
+		setTarget: func() error {
+			m.setHost(m.Hostname)
+			return nil
+		},
+	}, nil
+}
+
+func (m *WakeOnLan) classify(status string) (instanceStatusAction, error) {
+	switch status {
+	case wolReachable:
+		return instanceReady, nil
+	case wolUnreachable:
+		return instanceStart, nil
+	default:
+		return instanceWait, fmt.Errorf("unsupported wake-on-lan status %q", status)
+	}
+}
+
+func (m *WakeOnLan) start(ctx context.Context, status string) error {
+	if err := sendMagicPacket(ctx, m.Broadcast, m.hardwareAddr); err != nil {
+		return fmt.Errorf("failed to send magic packet: %w", err)
+	}
+	slog.Info("Power button pressed", "currentStatus", status, "instance", m.Hostname, "mac", m.MAC)
+	return nil
+}
+
+// magicPacket builds the 102-byte wake-on-LAN payload: six 0xFF bytes
+// followed by the MAC address repeated sixteen times.
+func magicPacket(hardwareAddr net.HardwareAddr) []byte {
+	packet := bytes.Repeat([]byte{0xFF}, 6)
+	for range 16 {
+		packet = append(packet, hardwareAddr...)
+	}
+	return packet
+}
+
+func sendMagicPacket(ctx context.Context, broadcast string, hardwareAddr net.HardwareAddr) error {
+	connection, err := (&net.Dialer{}).DialContext(ctx, "udp", broadcast)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = connection.Close() }()
+	_, err = connection.Write(magicPacket(hardwareAddr))
+	return err
+}
@@ -0,0 +1,107 @@
+package machine
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestMagicPacketLayout(t *testing.T) {
+	t.Parallel()
+
+	hardwareAddr, err := net.ParseMAC("01:23:45:67:89:ab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet := magicPacket(hardwareAddr)
+	if len(packet) != 102 {
+		t.Fatalf("len(packet) = %d, want 102", len(packet))
+	}
+	if !bytes.Equal(packet[:6], bytes.Repeat([]byte{0xFF}, 6)) {
+		t.Fatalf("packet header = %x, want six 0xFF bytes", packet[:6])
+	}
+	for i := range 16 {
+		offset := 6 + i*6
+		if !bytes.Equal(packet[offset:offset+6], hardwareAddr) {
+			t.Fatalf("repetition %d = %x, want %x", i, packet[offset:offset+6], hardwareAddr)
+		}
+	}
+}
+
+func TestWakeOnLanWaitsForReachabilityAfterMagicPacket(t *testing.T) {
+	t.Parallel()
+
+	packets, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = packets.Close() })
+
+	// Reserve a port for the workstation, then close it until it "boots".
+	reserved, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := reserved.Addr().String()
+	_ = reserved.Close()
+	_, portText, _ := net.SplitHostPort(address)
+	port, _ := strconv.Atoi(portText)
+
+	booted := make(chan net.Listener, 1)
+	go func() {
+		buffer := make([]byte, 256)
+		n, _, err := packets.ReadFrom(buffer)
+		if err != nil || n != 102 {
+			close(booted)
+			return
+		}
+		listener, err := net.Listen("tcp", address)
+		if err != nil {
+			close(booted)
+			return
+		}
+		booted <- listener
+	}()
+	t.Cleanup(func() {
+		if listener, ok := <-booted; ok {
+			_ = listener.Close()
+		}
+	})
+
+	m, err := New("wake_on_lan", map[string]any{
+		"mac":          "01:23:45:67:89:ab",
+		"broadcast":    packets.LocalAddr().String(),
+		"host":         "127.0.0.1",
+		"port":         port,
+		"probeTimeout": 1,
+	})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	wol := m.(*WakeOnLan)
+	wol.pollInterval = 10 * time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := wol.PowerOnWithCooldown(ctx, 30); err != nil {
+		t.Fatalf("PowerOnWithCooldown() error = %v", err)
+	}
+	if host := wol.Host(); host != "127.0.0.1" {
+		t.Fatalf("Host() = %q, want 127.0.0.1", host)
+	}
+	if status := wol.Status(); status != wolReachable {
+		t.Fatalf("Status() = %q, want %s", status, wolReachable)
+	}
+}
+
+func TestWakeOnLanRejectsInvalidMAC(t *testing.T) {
+	t.Parallel()
+
+	_, err := New("wake_on_lan", map[string]any{"mac": "not-a-mac", "host": "10.0.0.8", "port": 22})
+	if err == nil {
+		t.Fatal("New() unexpectedly accepted an invalid MAC")
+	}
+}
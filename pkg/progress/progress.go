@@ -0,0 +1,188 @@
+// Package progress follows a machine through a wake, from the provider
+// statuses the power cycle reads to the backend accepting connections and
+// passing its readiness probe, and streams it as Server-Sent Events.
+package progress
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Phases of a wake, in the order they normally occur.
+const (
+	// PhaseStopped means PPB powered the machine off or found it no longer
+	// running and dropped its proxy target.
+	PhaseStopped = "stopped"
+	// PhaseStatus is a provider status read, e.g. TERMINATED, STAGING, or
+	// RUNNING on Compute Engine.
+	PhaseStatus = "status"
+	// PhaseReachable means the proxy connected to the backend port.
+	PhaseReachable = "reachable"
+	// PhaseReady means the backend passed the readiness probe, or was
+	// reachable when there is none.
+	PhaseReady = "ready"
+	// PhaseFailed means the wake failed or timed out. It ends the wake. It is
+	// not named error, which EventSource reserves for connection errors.
+	PhaseFailed = "failed"
+)
+
+// maxHistory bounds the events kept for subscribers that join mid-wake.
+const maxHistory = 32
+
+// subscriberBuffer is how many events a slow subscriber may fall behind
+// before it misses some.
+const subscriberBuffer = 16
+
+// Event is one step of a wake. Elapsed is measured from the first event after
+// the machine stopped, so it shows how long each step of a boot took.
+type Event struct {
+	Phase  string `json:"phase"`
+	Status string `json:"status,omitempty"`
+	// Code and Message describe a PhaseFailed event. Code is the provider's
+	// error code, e.g. ZONE_RESOURCE_POOL_EXHAUSTED, when there is one.
+	Code    string        `json:"code,omitempty"`
+	Message string        `json:"message,omitempty"`
+	At      time.Time     `json:"at"`
+	Elapsed time.Duration `json:"-"`
+}
+
+// Tracker records the progress of one machine and fans it out to
+// subscribers. It is shared by every target that shares the machine. Repeated
+// reports of the same state are dropped, so callers can report on every poll
+// or connection.
+type Tracker struct {
+	mu          sync.Mutex
+	status      string
+	stopped     bool
+	reachable   bool
+	ready       bool
+	failed      bool
+	started     time.Time
+	history     []Event
+	subscribers map[chan Event]struct{}
+	now         func() time.Time
+}
+
+// NewTracker returns a tracker with no progress yet.
+func NewTracker() *Tracker {
+	return &Tracker{now: time.Now, subscribers: map[chan Event]struct{}{}}
+}
+
+// Status records a provider status read. A change after the backend was
+// reachable starts a new wake.
+func (t *Tracker) Status(status string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if status == t.status {
+		return
+	}
+	t.status = status
+	if t.reachable || t.failed {
+		t.history, t.started = nil, time.Time{}
+	}
+	t.stopped, t.reachable, t.ready, t.failed = false, false, false, false
+	t.publish(Event{Phase: PhaseStatus, Status: status})
+}
+
+// Stopped records that the machine's proxy target was dropped and starts a
+// new wake.
+func (t *Tracker) Stopped() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stopped {
+		return
+	}
+	// Forget the status too, so the first read of the next wake is reported
+	// even when it matches the last one.
+	t.status = ""
+	t.history, t.started = nil, time.Time{}
+	t.stopped, t.reachable, t.ready, t.failed = true, false, false, false
+	t.publish(Event{Phase: PhaseStopped})
+}
+
+// Reachable records that the proxy connected to the backend.
+func (t *Tracker) Reachable() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.reachable {
+		return
+	}
+	t.stopped, t.reachable, t.failed = false, true, false
+	t.publish(Event{Phase: PhaseReachable, Status: t.status})
+}
+
+// Ready records that the backend is serving.
+func (t *Tracker) Ready() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.ready {
+		return
+	}
+	t.stopped, t.reachable, t.ready, t.failed = false, true, true, false
+	t.publish(Event{Phase: PhaseReady, Status: t.status})
+}
+
+// Failed records that the wake failed with err. When err carries provider
+// error codes, such as a Compute Engine operation error, the first one is
+// reported as the event's code. Only the first failure of a wake is reported,
+// and the next status read starts a new wake.
+func (t *Tracker) Failed(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.failed {
+		return
+	}
+	event := Event{Phase: PhaseFailed, Status: t.status, Message: err.Error()}
+	var coded interface{ Codes() []string }
+	if errors.As(err, &coded) {
+		if codes := coded.Codes(); len(codes) > 0 {
+			event.Code = codes[0]
+		}
+	}
+	// Forget the status, so the first read of the next wake is reported even
+	// when it matches the last one.
+	t.status = ""
+	t.stopped, t.reachable, t.ready, t.failed = false, false, false, true
+	t.publish(event)
+}
+
+// publish stamps event, appends it to the current wake, and sends it to
+// subscribers. The caller holds t.mu.
+func (t *Tracker) publish(event Event) {
+	event.At = t.now()
+	if event.Phase != PhaseStopped {
+		if t.started.IsZero() {
+			t.started = event.At
+		}
+		event.Elapsed = event.At.Sub(t.started)
+	}
+	if len(t.history) == maxHistory {
+		t.history = append(t.history[:0], t.history[1:]...)
+	}
+	t.history = append(t.history, event)
+	for subscriber := range t.subscribers {
+		select {
+		case subscriber <- event:
+		default:
+			// The subscriber fell behind; it sees the next event instead.
+		}
+	}
+}
+
+// Subscribe returns the events of the current wake so far and a channel of
+// the ones that follow. cancel releases the channel.
+func (t *Tracker) Subscribe() (history []Event, events <-chan Event, cancel func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	subscriber := make(chan Event, subscriberBuffer)
+	t.subscribers[subscriber] = struct{}{}
+	var once sync.Once
+	return append([]Event(nil), t.history...), subscriber, func() {
+		once.Do(func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			delete(t.subscribers, subscriber)
+		})
+	}
+}
@@ -0,0 +1,217 @@
+package progress
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func phases(events []Event) string {
+	names := make([]string, 0, len(events))
+	for _, event := range events {
+		name := event.Phase
+		if event.Phase == PhaseStatus {
+			name = event.Status
+		}
+		names = append(names, name)
+	}
+	return strings.Join(names, " ")
+}
+
+func TestTrackerFollowsAWake(t *testing.T) {
+	t.Parallel()
+
+	tracker := NewTracker()
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+	tracker.now = func() time.Time { return now }
+
+	tracker.Stopped()
+	now = now.Add(time.Hour)
+	for _, status := range []string{"TERMINATED", "TERMINATED", "STAGING", "RUNNING"} {
+		now = now.Add(10 * time.Second)
+		tracker.Status(status)
+	}
+	tracker.Reachable()
+	tracker.Reachable()
+	tracker.Ready()
+
+	history, _, cancel := tracker.Subscribe()
+	defer cancel()
+	if got := phases(history); got != "stopped TERMINATED STAGING RUNNING reachable ready" {
+		t.Fatalf("history = %q", got)
+	}
+	if got := history[len(history)-1].Elapsed; got != 30*time.Second {
+		t.Fatalf("ready elapsed = %s, want 30s from the first status read", got)
+	}
+
+	// The next status change after the backend was up starts a new wake.
+	tracker.Status("STOPPING")
+	history, _, cancel = tracker.Subscribe()
+	defer cancel()
+	if got := phases(history); got != "STOPPING" {
+		t.Fatalf("history after the wake = %q, want a new wake", got)
+	}
+}
+
+func TestTrackerDeliversEventsToSubscribers(t *testing.T) {
+	t.Parallel()
+
+	tracker := NewTracker()
+	_, events, cancel := tracker.Subscribe()
+	tracker.Status("STAGING")
+	if event := <-events; event.Phase != PhaseStatus || event.Status != "STAGING" {
+		t.Fatalf("event = %+v, want the STAGING status", event)
+	}
+
+	cancel()
+	tracker.Ready()
+	select {
+	case event := <-events:
+		t.Fatalf("cancelled subscriber received %+v", event)
+	default:
+	}
+}
+
+// codedError stands in for a provider error that carries error codes.
+type codedError struct{}
+
+func (codedError) Error() string   { return "start failed: ZONE_RESOURCE_POOL_EXHAUSTED" }
+func (codedError) Codes() []string { return []string{"ZONE_RESOURCE_POOL_EXHAUSTED"} }
+
+func TestTrackerReportsFailure(t *testing.T) {
+	t.Parallel()
+
+	tracker := NewTracker()
+	tracker.Status("TERMINATED")
+	tracker.Failed(codedError{})
+	tracker.Failed(errors.New("timed out"))
+
+	history, _, cancel := tracker.Subscribe()
+	defer cancel()
+	if got := phases(history); got != "TERMINATED failed" {
+		t.Fatalf("history = %q, want one failure ending the wake", got)
+	}
+	if failure := history[1]; failure.Code != "ZONE_RESOURCE_POOL_EXHAUSTED" || failure.Message != (codedError{}).Error() {
+		t.Fatalf("failure = %+v, want the provider code and message", failure)
+	}
+
+	// The next status read starts a new wake, even with the same status.
+	tracker.Status("TERMINATED")
+	history, _, cancel = tracker.Subscribe()
+	defer cancel()
+	if got := phases(history); got != "TERMINATED" {
+		t.Fatalf("history after the failure = %q, want a new wake", got)
+	}
+}
+
+func TestServeStreamEndsAfterFailure(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		name     string
+		replayed bool
+	}{
+		{name: "replayed failure", replayed: true},
+		{name: "live failure"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			tracker := NewTracker()
+			tracker.Status("STAGING")
+			if test.replayed {
+				tracker.Failed(codedError{})
+			}
+			request := httptest.NewRequest(http.MethodGet, StreamPath, nil)
+			recorder := httptest.NewRecorder()
+			served := make(chan struct{})
+			go func() {
+				defer close(served)
+				ServeStream(recorder, request, tracker, "gce vm", make(chan struct{}))
+			}()
+			if !test.replayed {
+				// Fail once the stream has subscribed.
+				for {
+					tracker.mu.Lock()
+					subscribed := len(tracker.subscribers) > 0
+					tracker.mu.Unlock()
+					if subscribed {
+						break
+					}
+					time.Sleep(time.Millisecond)
+				}
+				tracker.Failed(codedError{})
+			}
+
+			select {
+			case <-served:
+			case <-time.After(5 * time.Second):
+				t.Fatal("stream stayed open after the wake failed")
+			}
+			if body := recorder.Body.String(); !strings.Contains(body, "event: failed\ndata: ") || !strings.Contains(body, `"code":"ZONE_RESOURCE_POOL_EXHAUSTED"`) {
+				t.Fatalf("body = %q, want a failed event with the code", body)
+			}
+		})
+	}
+}
+
+func TestServeStream(t *testing.T) {
+	t.Parallel()
+
+	tracker := NewTracker()
+	tracker.Status("STAGING")
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ServeStream(w, r, tracker, "gce vm", done)
+	}))
+	defer server.Close()
+	defer close(done)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := server.Client().Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = response.Body.Close() }()
+	if got := response.Header.Get("Content-Type"); got != "text/event-stream" {
+		t.Fatalf("Content-Type = %q", got)
+	}
+
+	lines := bufio.NewScanner(response.Body)
+	next := func() (string, string) {
+		var name, data string
+		for lines.Scan() {
+			line := lines.Text()
+			if line == "" && name != "" {
+				return name, data
+			}
+			if value, ok := strings.CutPrefix(line, "event: "); ok {
+				name = value
+			}
+			if value, ok := strings.CutPrefix(line, "data: "); ok {
+				data = value
+			}
+		}
+		t.Fatalf("stream ended: %v", lines.Err())
+		return "", ""
+	}
+
+	if name, data := next(); name != PhaseStatus || !strings.Contains(data, `"status":"STAGING"`) || !strings.Contains(data, `"machine":"gce vm"`) {
+		t.Fatalf("replayed event = %s %s", name, data)
+	}
+	tracker.Ready()
+	if name, data := next(); name != PhaseReady || !strings.Contains(data, `"phase":"ready"`) {
+		t.Fatalf("live event = %s %s", name, data)
+	}
+}
@@ -0,0 +1,101 @@
+package progress
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// StreamPath is where the progress stream is served on the proxy listener.
+const StreamPath = "/.ppb/status/stream"
+
+// keepAliveInterval is how often an idle stream sends a comment, so
+// intermediaries do not close it.
+const keepAliveInterval = 15 * time.Second
+
+// streamEvent is the data of one Server-Sent Event.
+type streamEvent struct {
+	Machine        string    `json:"machine"`
+	Phase          string    `json:"phase"`
+	Status         string    `json:"status,omitempty"`
+	Code           string    `json:"code,omitempty"`
+	Message        string    `json:"message,omitempty"`
+	At             time.Time `json:"at"`
+	ElapsedSeconds float64   `json:"elapsedSeconds"`
+}
+
+// ServeStream streams t to w as Server-Sent Events named after their phase,
+// starting with the events of the current wake. It returns when the client
+// disconnects, done is closed, or after sending a failed event, since a
+// failed wake has nothing more to report.
+func ServeStream(w http.ResponseWriter, r *http.Request, t *Tracker, machine string, done <-chan struct{}) {
+	history, events, cancel := t.Subscribe()
+	defer cancel()
+
+	controller := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	// Ask buffering reverse proxies such as nginx to pass events through.
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	write := func(event Event) error {
+		data, err := json.Marshal(streamEvent{
+			Machine:        machine,
+			Phase:          event.Phase,
+			Status:         event.Status,
+			Code:           event.Code,
+			Message:        event.Message,
+			At:             event.At,
+			ElapsedSeconds: event.Elapsed.Seconds(),
+		})
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Phase, data)
+		return err
+	}
+	failed := false
+	for _, event := range history {
+		if err := write(event); err != nil {
+			return
+		}
+		failed = event.Phase == PhaseFailed
+	}
+	if err := controller.Flush(); err != nil {
+		slog.Debug("Unable to flush progress stream", "err", err)
+		return
+	}
+	if failed {
+		return
+	}
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		var err error
+		select {
+		case <-r.Context().Done():
+			return
+		case <-done:
+			return
+		case event := <-events:
+			err = write(event)
+			failed = event.Phase == PhaseFailed
+		case <-keepAlive.C:
+			_, err = fmt.Fprint(w, ": keep-alive\n\n")
+		}
+		if err == nil {
+			err = controller.Flush()
+		}
+		if err != nil {
+			slog.Debug("Progress stream closed", "err", err)
+			return
+		}
+		if failed {
+			return
+		}
+	}
+}
@@ -17,7 +17,10 @@ import (
 	"time"
 
 	"github.com/libops/ppb/pkg/config"
+	"github.com/libops/ppb/pkg/gcetest"
 	"github.com/libops/ppb/pkg/machine"
+	"github.com/libops/ppb/pkg/progress"
+	"github.com/libops/ppb/pkg/schedule"
 )
 
 func TestNew_UsesConfiguredTimeouts(t *testing.T) {
@@ -709,3 +712,611 @@ func TestReverseProxyDoesNotRetryHTTPStatus(t *testing.T) {
 		t.Fatalf("backend request count = %d, want 1", requestCount)
 	}
 }
+
+func TestReverseProxyStripsRoutePrefix(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, "%s|%s|%s", r.URL.EscapedPath(), r.URL.RawQuery, r.Header.Get("X-Forwarded-Prefix"))
+	}))
+	t.Cleanup(backend.Close)
+	backendURL, err := url.Parse(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backendHost, backendPortText, err := net.SplitHostPort(backendURL.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backendPort, err := strconv.Atoi(backendPortText)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newProxy := func(strip bool) *ReverseProxy {
+		return New(&config.Config{
+			Scheme:      "http",
+			ProxyTarget: &config.ProxyTarget{Host: backendHost, Port: backendPort},
+			PathPrefix:  "/jupyter",
+			StripPrefix: strip,
+			ProxyTimeouts: config.ProxyTimeouts{
+				DialTimeout:        1,
+				DialAttemptTimeout: 1,
+				DialRetryInterval:  1,
+			},
+			Machine: machine.NewGceMachine(),
+		})
+	}
+
+	tests := []struct {
+		name  string
+		strip bool
+		path  string
+		want  string
+	}{
+		{name: "nested path", strip: true, path: "/jupyter/lab/tree%2Fa?token=x", want: "/lab/tree%2Fa|token=x|/jupyter"},
+		{name: "prefix only", strip: true, path: "/jupyter", want: "/||/jupyter"},
+		{name: "without strip", path: "/jupyter/lab", want: "/jupyter/lab||"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "http://workspace.example"+test.path, nil)
+			request.Header.Set("X-Forwarded-Prefix", "/spoofed")
+			recorder := httptest.NewRecorder()
+
+			newProxy(test.strip).ServeHTTP(recorder, request)
+
+			if got := recorder.Body.String(); got != test.want {
+				t.Fatalf("backend saw %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRetryingDialerDialsRecoveredHost(t *testing.T) {
+	t.Parallel()
+
+	clientConnection, serverConnection := net.Pipe()
+	t.Cleanup(func() {
+		_ = clientConnection.Close()
+		_ = serverConnection.Close()
+	})
+
+	var dialed []string
+	recoveries := 0
+	dialer := &retryingDialer{
+		totalTimeout:   time.Second,
+		attemptTimeout: 100 * time.Millisecond,
+		retryInterval:  time.Millisecond,
+		dial: func(_ context.Context, _, address string) (net.Conn, error) {
+			dialed = append(dialed, address)
+			if address != "10.0.0.9:8080" {
+				return nil, &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+			}
+			return clientConnection, nil
+		},
+		recover: func(_ context.Context, host string) (string, error) {
+			recoveries++
+			if host != "10.0.0.8" {
+				t.Errorf("recover host = %q, want the dialed host", host)
+			}
+			return "10.0.0.9", nil
+		},
+	}
+
+	connection, err := dialer.DialContext(context.Background(), "tcp", "10.0.0.8:8080")
+	if err != nil {
+		t.Fatalf("DialContext() error = %v", err)
+	}
+	if connection != clientConnection {
+		t.Fatal("DialContext() did not return the recovered connection")
+	}
+	if recoveries != 1 || strings.Join(dialed, ",") != "10.0.0.8:8080,10.0.0.9:8080" {
+		t.Fatalf("recoveries = %d dialed = %v, want one recovery then the new host", recoveries, dialed)
+	}
+}
+
+func TestReverseProxyWakesMachineSuspendedBehindItsBack(t *testing.T) {
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("awake"))
+	}))
+	defer app.Close()
+	appURL, err := url.Parse(app.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := strconv.Atoi(appURL.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	emulator := gcetest.New(gcetest.Options{}, gcetest.Instance{
+		Project: "p", Zone: "z", Name: "vm", Status: "SUSPENDED", NetworkIP: "127.0.0.1",
+	})
+	api := httptest.NewServer(emulator)
+	defer api.Close()
+	m, err := machine.New("google_compute_engine", map[string]any{
+		"project_id": "p", "zone": "z", "name": "vm", "usePrivateIp": true, "endpoint": api.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The cached host is from before the suspend; nothing listens there now.
+	m.(*machine.GoogleComputeEngine).SetHostForTesting("127.0.0.2")
+
+	proxyHandler := New(&config.Config{
+		Scheme:          "http",
+		Port:            port,
+		PowerOnCooldown: 30,
+		PowerOnTimeout:  30,
+		ProxyTimeouts: config.ProxyTimeouts{
+			DialTimeout:        5,
+			DialAttemptTimeout: 1,
+			DialRetryInterval:  1,
+			MaxIdleConns:       10,
+		},
+		Machine: m,
+	})
+	proxyHandler.reachedWake.Store(m.Wakes())
+	recorder := httptest.NewRecorder()
+	proxyHandler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "http://site.example.test/", nil))
+
+	if recorder.Code != http.StatusOK || recorder.Body.String() != "awake" {
+		t.Fatalf("response = %d %q, want the resumed backend", recorder.Code, recorder.Body.String())
+	}
+	if vm, _ := emulator.Instance("p", "z", "vm"); vm.Status != "RUNNING" {
+		t.Fatalf("emulated status = %s, want RUNNING", vm.Status)
+	}
+	if host := m.Host(); host != "127.0.0.1" {
+		t.Fatalf("Host() = %q, want the address observed after resuming", host)
+	}
+}
+
+func TestReverseProxyDoesNotWakeStaleMachineWhileClosed(t *testing.T) {
+	emulator := gcetest.New(gcetest.Options{}, gcetest.Instance{
+		Project: "p", Zone: "z", Name: "vm", Status: "TERMINATED", NetworkIP: "127.0.0.1",
+	})
+	api := httptest.NewServer(emulator)
+	defer api.Close()
+	m, err := machine.New("google_compute_engine", map[string]any{
+		"project_id": "p", "zone": "z", "name": "vm", "usePrivateIp": true, "endpoint": api.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The cached host is from before a stop PPB did not see.
+	m.(*machine.GoogleComputeEngine).SetHostForTesting("127.0.0.2")
+	closed := &schedule.Schedule{Closed: []string{"* * * * *"}}
+	if err := closed.Compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	proxyHandler := New(&config.Config{
+		Scheme:          "http",
+		Port:            1,
+		PowerOnCooldown: 30,
+		PowerOnTimeout:  30,
+		Schedule:        closed,
+		ProxyTimeouts: config.ProxyTimeouts{
+			DialTimeout:        30,
+			DialAttemptTimeout: 1,
+			DialRetryInterval:  1,
+		},
+		Machine: m,
+	})
+	proxyHandler.reachedWake.Store(m.Wakes())
+	started := time.Now()
+	recorder := httptest.NewRecorder()
+	proxyHandler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "http://site.example.test/", nil))
+
+	if recorder.Code != http.StatusServiceUnavailable || recorder.Header().Get("Retry-After") != "5" {
+		t.Fatalf("response = %d Retry-After %q, want a retryable 503", recorder.Code, recorder.Header().Get("Retry-After"))
+	}
+	if elapsed := time.Since(started); elapsed > 10*time.Second {
+		t.Fatalf("request took %s, want it to stop dialing once the wake was refused", elapsed)
+	}
+	if vm, _ := emulator.Instance("p", "z", "vm"); vm.Status != "TERMINATED" {
+		t.Fatalf("emulated status = %s, want the machine left stopped during the closed window", vm.Status)
+	}
+	if m.Host() != "" {
+		t.Fatal("the stale host was kept after the machine was found stopped")
+	}
+}
+
+func TestReverseProxyDoesNotRecoverBootingBackend(t *testing.T) {
+	emulator := gcetest.New(gcetest.Options{}, gcetest.Instance{
+		Project: "p", Zone: "z", Name: "vm", Status: "RUNNING", NetworkIP: "127.0.0.2",
+	})
+	var mu sync.Mutex
+	reads := 0
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		reads++
+		mu.Unlock()
+		emulator.ServeHTTP(w, r)
+	}))
+	defer api.Close()
+	m, err := machine.New("google_compute_engine", map[string]any{
+		"project_id": "p", "zone": "z", "name": "vm", "usePrivateIp": true, "endpoint": api.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The machine was just woken and nothing listens on it yet, so every dial
+	// is refused without the host ever having answered in this wake.
+	m.(*machine.GoogleComputeEngine).SetHostForTesting("127.0.0.2")
+	proxyHandler := New(&config.Config{
+		Scheme: "http",
+		Port:   1,
+		ProxyTimeouts: config.ProxyTimeouts{
+			DialTimeout:        2,
+			DialAttemptTimeout: 1,
+			DialRetryInterval:  1,
+		},
+		Machine: m,
+	})
+
+	recorder := httptest.NewRecorder()
+	proxyHandler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "http://site.example.test/", nil))
+
+	if recorder.Code != http.StatusServiceUnavailable || recorder.Header().Get("Retry-After") != "5" {
+		t.Fatalf("response = %d Retry-After %q, want a retryable 503", recorder.Code, recorder.Header().Get("Retry-After"))
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if reads != 1 {
+		t.Fatalf("provider reads = %d, want one re-check after the dial window ran out rather than one per refused dial", reads)
+	}
+}
+
+func TestReverseProxyDialExhaustionForgetsStoppedMachine(t *testing.T) {
+	emulator := gcetest.New(gcetest.Options{}, gcetest.Instance{
+		Project: "p", Zone: "z", Name: "vm", Status: "TERMINATED", NetworkIP: "127.0.0.1",
+	})
+	api := httptest.NewServer(emulator)
+	defer api.Close()
+	m, err := machine.New("google_compute_engine", map[string]any{
+		"project_id": "p", "zone": "z", "name": "vm", "usePrivateIp": true, "endpoint": api.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gce := m.(*machine.GoogleComputeEngine)
+	gce.SetHostForTesting("10.0.0.8")
+	gce.LastPowerOnAttempt = time.Now()
+
+	proxyHandler := New(&config.Config{Scheme: "http", Port: 8080, Machine: m})
+	proxyHandler.Transport.DialContext = (&retryingDialer{
+		totalTimeout:   10 * time.Millisecond,
+		attemptTimeout: 5 * time.Millisecond,
+		retryInterval:  time.Millisecond,
+		dial: func(context.Context, string, string) (net.Conn, error) {
+			return nil, &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+		},
+	}).DialContext
+	recorder := httptest.NewRecorder()
+	proxyHandler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "http://site.example.test/", nil))
+
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want %d", recorder.Code, http.StatusServiceUnavailable)
+	}
+	if m.Host() != "" || !m.LastAttempt().IsZero() {
+		t.Fatal("dial exhaustion kept the target and cooldown of a stopped machine")
+	}
+}
+
+func TestReverseProxyHoldsRequestsUntilReadinessProbePasses(t *testing.T) {
+	var mu sync.Mutex
+	probes, requests := 0, 0
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.URL.Path != "/healthz" {
+			requests++
+			_, _ = fmt.Fprint(w, "app")
+			return
+		}
+		probes++
+		switch probes % 3 {
+		case 1:
+			http.Error(w, "bad gateway", http.StatusBadGateway)
+		case 2:
+			_, _ = fmt.Fprint(w, "starting")
+		default:
+			_, _ = fmt.Fprint(w, "status: ok")
+		}
+	}))
+	t.Cleanup(backend.Close)
+	backendURL, err := url.Parse(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backendHost, backendPortText, err := net.SplitHostPort(backendURL.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backendPort, err := strconv.Atoi(backendPortText)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := machine.NewGceMachine()
+	m.SetHostForTesting(backendHost)
+	proxyHandler := New(&config.Config{
+		Scheme:    "http",
+		Port:      backendPort,
+		Readiness: &config.ReadinessProbe{Path: "/healthz", Status: http.StatusOK, Body: "ok", Interval: 1, Timeout: 10},
+		ProxyTimeouts: config.ProxyTimeouts{
+			DialTimeout:        1,
+			DialAttemptTimeout: 1,
+			DialRetryInterval:  1,
+		},
+		Machine: m,
+	})
+	get := func() string {
+		t.Helper()
+		recorder := httptest.NewRecorder()
+		proxyHandler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "http://site.example/", nil))
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("status = %d, want %d", recorder.Code, http.StatusOK)
+		}
+		return recorder.Body.String()
+	}
+	counts := func() (int, int) {
+		mu.Lock()
+		defer mu.Unlock()
+		return probes, requests
+	}
+
+	if body := get(); body != "app" {
+		t.Fatalf("body = %q, want app", body)
+	}
+	if p, r := counts(); p != 3 || r != 1 {
+		t.Fatalf("probes = %d requests = %d, want the request released after the third probe", p, r)
+	}
+
+	get()
+	if p, _ := counts(); p != 3 {
+		t.Fatalf("probes = %d, want no probe while the machine stays up", p)
+	}
+
+	// A wake on the same address must be probed again.
+	m.SetHostForTesting("")
+	m.SetHostForTesting(backendHost)
+	get()
+	if p, r := counts(); p != 6 || r != 3 {
+		t.Fatalf("probes = %d requests = %d, want a fresh probe after the wake", p, r)
+	}
+}
+
+func TestReverseProxyReadinessTimeoutReturnsRetryAfter(t *testing.T) {
+	var mu sync.Mutex
+	requests := 0
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" {
+			http.Error(w, "bad gateway", http.StatusBadGateway)
+			return
+		}
+		mu.Lock()
+		requests++
+		mu.Unlock()
+	}))
+	t.Cleanup(backend.Close)
+	backendURL, err := url.Parse(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backendHost, backendPortText, err := net.SplitHostPort(backendURL.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backendPort, err := strconv.Atoi(backendPortText)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := machine.NewGceMachine()
+	m.SetHostForTesting(backendHost)
+	proxyHandler := New(&config.Config{
+		Scheme:    "http",
+		Port:      backendPort,
+		Readiness: &config.ReadinessProbe{Path: "/healthz", Status: http.StatusOK, Interval: 1, Timeout: 1},
+		ProxyTimeouts: config.ProxyTimeouts{
+			DialTimeout:        1,
+			DialAttemptTimeout: 1,
+			DialRetryInterval:  1,
+		},
+		Machine: m,
+	})
+	recorder := httptest.NewRecorder()
+	proxyHandler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "http://site.example/", nil))
+
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want %d", recorder.Code, http.StatusServiceUnavailable)
+	}
+	if got := recorder.Header().Get("Retry-After"); got != "5" {
+		t.Fatalf("Retry-After = %q, want 5", got)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if requests != 0 {
+		t.Fatalf("backend received %d requests before it was ready", requests)
+	}
+}
+
+func TestReverseProxyWarmReportsProgress(t *testing.T) {
+	var mu sync.Mutex
+	var paths []string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		paths = append(paths, r.URL.Path)
+	}))
+	t.Cleanup(backend.Close)
+	backendURL, err := url.Parse(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backendHost, backendPortText, err := net.SplitHostPort(backendURL.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backendPort, err := strconv.Atoi(backendPortText)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name      string
+		readiness *config.ReadinessProbe
+		wantPaths string
+	}{
+		{name: "connection"},
+		{name: "readiness probe", readiness: &config.ReadinessProbe{Path: "/healthz", Status: http.StatusOK, Interval: 1, Timeout: 5}, wantPaths: "/healthz"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			mu.Lock()
+			paths = nil
+			mu.Unlock()
+			m := machine.NewGceMachine()
+			m.SetHostForTesting(backendHost)
+			tracker := progress.NewTracker()
+			proxyHandler := New(&config.Config{
+				Scheme:    "http",
+				Port:      backendPort,
+				Readiness: test.readiness,
+				ProxyTimeouts: config.ProxyTimeouts{
+					DialTimeout:        1,
+					DialAttemptTimeout: 1,
+					DialRetryInterval:  1,
+				},
+				Machine:  m,
+				Progress: tracker,
+			})
+
+			if err := proxyHandler.Warm(context.Background()); err != nil {
+				t.Fatalf("Warm() error = %v", err)
+			}
+			history, _, cancel := tracker.Subscribe()
+			defer cancel()
+			if len(history) != 2 || history[0].Phase != progress.PhaseReachable || history[1].Phase != progress.PhaseReady {
+				t.Fatalf("progress = %+v, want reachable then ready", history)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if got := strings.Join(paths, " "); got != test.wantPaths {
+				t.Fatalf("backend paths = %q, want %q", got, test.wantPaths)
+			}
+		})
+	}
+}
+
+func TestReverseProxyProbesRecoveredBackendBeforeForwarding(t *testing.T) {
+	var mu sync.Mutex
+	var paths []string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		paths = append(paths, r.URL.Path)
+		if r.URL.Path == "/healthz" && len(paths) < 3 {
+			http.Error(w, "booting", http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = fmt.Fprint(w, "app")
+	}))
+	t.Cleanup(backend.Close)
+	backendURL, err := url.Parse(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := strconv.Atoi(backendURL.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	emulator := gcetest.New(gcetest.Options{}, gcetest.Instance{
+		Project: "p", Zone: "z", Name: "vm", Status: "SUSPENDED", NetworkIP: "127.0.0.1",
+	})
+	api := httptest.NewServer(emulator)
+	defer api.Close()
+	m, err := machine.New("google_compute_engine", map[string]any{
+		"project_id": "p", "zone": "z", "name": "vm", "usePrivateIp": true, "endpoint": api.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The cached host passed the probe before a suspend PPB did not see.
+	m.(*machine.GoogleComputeEngine).SetHostForTesting("127.0.0.2")
+	proxyHandler := New(&config.Config{
+		Scheme:          "http",
+		Port:            port,
+		PowerOnCooldown: 30,
+		PowerOnTimeout:  30,
+		Readiness:       &config.ReadinessProbe{Path: "/healthz", Status: http.StatusOK, Interval: 1, Timeout: 10},
+		ProxyTimeouts: config.ProxyTimeouts{
+			DialTimeout:        5,
+			DialAttemptTimeout: 1,
+			DialRetryInterval:  1,
+			MaxIdleConns:       10,
+		},
+		Machine: m,
+	})
+	proxyHandler.readiness.setReady(m.Wakes())
+	proxyHandler.reachedWake.Store(m.Wakes())
+
+	recorder := httptest.NewRecorder()
+	proxyHandler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "http://site.example.test/", nil))
+
+	if recorder.Code != http.StatusOK || recorder.Body.String() != "app" {
+		t.Fatalf("response = %d %q, want the resumed backend", recorder.Code, recorder.Body.String())
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if got := strings.Join(paths, ","); got != "/healthz,/healthz,/healthz,/" {
+		t.Fatalf("backend paths = %s, want the request held until the resumed backend passed the probe", got)
+	}
+}
+
+func TestReverseProxyReadinessProbeDoesNotRecoverTarget(t *testing.T) {
+	emulator := gcetest.New(gcetest.Options{}, gcetest.Instance{
+		Project: "p", Zone: "z", Name: "vm", Status: "RUNNING", NetworkIP: "127.0.0.2",
+	})
+	var mu sync.Mutex
+	reads := 0
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		reads++
+		mu.Unlock()
+		emulator.ServeHTTP(w, r)
+	}))
+	defer api.Close()
+	m, err := machine.New("google_compute_engine", map[string]any{
+		"project_id": "p", "zone": "z", "name": "vm", "usePrivateIp": true, "endpoint": api.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Nothing listens on the booting backend yet, so every probe is refused.
+	m.(*machine.GoogleComputeEngine).SetHostForTesting("127.0.0.2")
+	proxyHandler := New(&config.Config{
+		Scheme:    "http",
+		Port:      1,
+		Readiness: &config.ReadinessProbe{Path: "/healthz", Status: http.StatusOK, Interval: 1, Timeout: 3},
+		ProxyTimeouts: config.ProxyTimeouts{
+			DialTimeout:        1,
+			DialAttemptTimeout: 1,
+			DialRetryInterval:  1,
+		},
+		Machine: m,
+	})
+
+	recorder := httptest.NewRecorder()
+	proxyHandler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "http://site.example.test/", nil))
+
+	if recorder.Code != http.StatusServiceUnavailable || recorder.Header().Get("Retry-After") != "5" {
+		t.Fatalf("response = %d Retry-After %q, want a retryable 503", recorder.Code, recorder.Header().Get("Retry-After"))
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if reads != 1 {
+		t.Fatalf("provider reads = %d, want one re-check after the probe gave up rather than one per refused probe", reads)
+	}
+}
@@ -0,0 +1,176 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libops/ppb/pkg/config"
+	"golang.org/x/sync/semaphore"
+)
+
+// readinessProbeTimeout bounds one probe request, including waiting for the
+// backend to accept the connection.
+const readinessProbeTimeout = 5 * time.Second
+
+// readinessBodyLimit is how much of a probe response is searched for the
+// expected body text.
+const readinessBodyLimit = 64 << 10
+
+// readinessGate holds requests until the backend passes the readiness probe.
+// It remembers the machine wake that last passed, so only requests after a
+// wake wait; one of them probes while the others queue.
+type readinessGate struct {
+	probe  *config.ReadinessProbe
+	client *http.Client
+	lock   *semaphore.Weighted
+	mu     sync.Mutex
+	probed bool
+	ready  uint64
+	// onReady, when set, is called each time the probe passes.
+	onReady func()
+	// onTimeout, when set, is called with the error when the probe does not
+	// pass within its timeout.
+	onTimeout func(error)
+}
+
+// newProbeTransport dials the backend once per probe, without the proxy's
+// dial retries or stale-target recovery, so a probe refused while the backend
+// boots is just a failed probe rather than a provider status read.
+// connected, when set, is called after every successful dial.
+func newProbeTransport(tlsHandshakeTimeout time.Duration, connected func()) *http.Transport {
+	dialer := &net.Dialer{Timeout: readinessProbeTimeout}
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			connection, err := dialer.DialContext(ctx, network, address)
+			if err == nil && connected != nil {
+				connected()
+			}
+			return connection, err
+		},
+		TLSHandshakeTimeout: tlsHandshakeTimeout,
+		DisableKeepAlives:   true,
+	}
+}
+
+func newReadinessGate(probe *config.ReadinessProbe, transport http.RoundTripper) *readinessGate {
+	return &readinessGate{
+		probe:  probe,
+		client: &http.Client{Transport: transport},
+		lock:   semaphore.NewWeighted(1),
+	}
+}
+
+func (g *readinessGate) passed(wake uint64) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.probed && g.ready == wake
+}
+
+func (g *readinessGate) setReady(wake uint64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.probed, g.ready = true, wake
+}
+
+// wait returns once target has passed the probe since the machine's wake,
+// probing every interval until it does or the probe timeout runs out.
+func (g *readinessGate) wait(ctx context.Context, target *url.URL, wake uint64) error {
+	if g.passed(wake) {
+		return nil
+	}
+	if err := g.lock.Acquire(ctx, 1); err != nil {
+		return err
+	}
+	defer g.lock.Release(1)
+	if g.passed(wake) {
+		// Another request probed the backend while this one queued.
+		return nil
+	}
+
+	timeout := time.Duration(g.probe.Timeout) * time.Second
+	probeCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	ticker := time.NewTicker(time.Duration(g.probe.Interval) * time.Second)
+	defer ticker.Stop()
+
+	started := time.Now()
+	var lastErr error
+	for {
+		err := g.check(probeCtx, target)
+		if err == nil {
+			slog.Info("Backend passed readiness probe", "target", target.Redacted(), "waited", time.Since(started).Round(time.Millisecond))
+			g.setReady(wake)
+			if g.onReady != nil {
+				g.onReady()
+			}
+			return nil
+		}
+		slog.Debug("Backend is not ready yet", "target", target.Redacted(), "error", err)
+		if lastErr == nil || probeCtx.Err() == nil {
+			// Keep the last real answer rather than the cut-off final probe.
+			lastErr = err
+		}
+
+		select {
+		case <-probeCtx.Done():
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
+			err := fmt.Errorf("backend %s did not pass the readiness probe within %s: %w", target.Host, timeout, lastErr)
+			if g.onTimeout != nil {
+				g.onTimeout(err)
+			}
+			return err
+		case <-ticker.C:
+		}
+	}
+}
+
+// check sends one probe request to target.
+func (g *readinessGate) check(ctx context.Context, target *url.URL) error {
+	ctx, cancel := context.WithTimeout(ctx, readinessProbeTimeout)
+	defer cancel()
+
+	path, err := url.Parse(g.probe.Path)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, target.ResolveReference(path).String(), nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("User-Agent", "ppb-readiness")
+	response, err := g.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := response.Body.Close(); err != nil {
+			slog.Debug("Unable to close readiness response body", "error", err)
+		}
+	}()
+
+	if response.StatusCode != g.probe.Status {
+		return fmt.Errorf("status %d, want %d", response.StatusCode, g.probe.Status)
+	}
+	if g.probe.Body == "" {
+		return nil
+	}
+	body, err := io.ReadAll(io.LimitReader(response.Body, readinessBodyLimit))
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(string(body), g.probe.Body) {
+		return fmt.Errorf("response body does not contain %q", g.probe.Body)
+	}
+	return nil
+}
@@ -11,19 +11,30 @@ import (
 	"net/http/httputil"
 	"net/url"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/libops/ppb/pkg/config"
+	"github.com/libops/ppb/pkg/machine"
 )
 
 type ReverseProxy struct {
 	Transport *http.Transport
 	Config    *config.Config
+	readiness *readinessGate
+	// reachedWake is the machine wake in which its host last accepted a
+	// connection, or 0 before the first.
+	reachedWake atomic.Uint64
 }
 
 var errProxyTargetUnavailable = errors.New("machine does not have a proxy target IP")
 
+// errBackendNotReady means a recovered backend did not pass the readiness
+// probe, so the request was not sent to it.
+var errBackendNotReady = errors.New("recovered backend is not ready")
+
 // dialExhaustedError means every failure happened before an origin connection
 // was established, so it is safe to tell the caller that the request can be
 // retried. Other RoundTrip errors can occur after a request was delivered.
@@ -51,6 +62,15 @@ type retryingDialer struct {
 	keepAlive      time.Duration
 	dial           func(context.Context, string, string) (net.Conn, error)
 	jitter         func(time.Duration) time.Duration
+	// recover, when set, is called at most once per dial after a failed
+	// attempt with the host being dialed. It returns the host to keep dialing,
+	// and the retry window starts over.
+	recover func(ctx context.Context, host string) (string, error)
+	// stale, when set, limits recover to failures it reports true for, so a
+	// host that is still booting is dialed on instead of re-checked.
+	stale func() bool
+	// connected, when set, is called after every successful dial.
+	connected func()
 }
 
 func New(c *config.Config) *ReverseProxy {
@@ -69,7 +89,7 @@ func New(c *config.Config) *ReverseProxy {
 		retryInterval:  dialRetryInterval,
 		keepAlive:      keepAlive,
 	}
-	return &ReverseProxy{
+	p := &ReverseProxy{
 		Config: c,
 		Transport: &http.Transport{
 			Proxy:                 http.ProxyFromEnvironment,
@@ -81,17 +101,120 @@ func New(c *config.Config) *ReverseProxy {
 			ExpectContinueTimeout: expectContinueTimeout,
 		},
 	}
+	// Only a machine target can go stale; a proxyTarget override is dialed as
+	// configured.
+	if c.ProxyTarget == nil || c.ProxyTarget.Host == "" {
+		dialer.recover = p.recoverTarget
+		dialer.stale = p.answeredThisWake
+	}
+	dialer.connected = p.connected
+	if c.Readiness != nil {
+		p.readiness = newReadinessGate(c.Readiness, newProbeTransport(tlsHandshakeTimeout, dialer.connected))
+		if c.Progress != nil {
+			p.readiness.onReady = c.Progress.Ready
+			p.readiness.onTimeout = c.Progress.Failed
+		}
+	}
+	return p
 }
 
-func (p *ReverseProxy) targetURL() (*url.URL, error) {
-	scheme := p.Config.Scheme
-	if p.Config.ProxyTarget != nil && p.Config.ProxyTarget.Scheme != "" {
-		scheme = p.Config.ProxyTarget.Scheme
+// connected records that the machine's host accepted a connection in its
+// current wake and reports the progress. Without a readiness probe,
+// accepting connections is being ready.
+func (p *ReverseProxy) connected() {
+	p.reachedWake.Store(p.Config.Machine.Wakes())
+	if progress := p.Config.Progress; progress != nil {
+		progress.Reachable()
+		if p.Config.Readiness == nil {
+			progress.Ready()
+		}
 	}
-	if scheme != "http" && scheme != "https" {
-		return nil, fmt.Errorf("unsupported proxy target scheme %q", scheme)
+}
+
+// answeredThisWake reports whether the machine's host already accepted a
+// connection in its current wake. Only then does a refused dial mean the
+// machine stopped behind PPB's back; before that it is still booting.
+func (p *ReverseProxy) answeredThisWake() bool {
+	reached := p.reachedWake.Load()
+	return reached != 0 && reached == p.Config.Machine.Wakes()
+}
+
+// recoverTarget re-checks a machine whose cached host stopped answering, e.g.
+// because it was suspended behind PPB's back. A machine that is no longer
+// running loses its cached host and cooldown and is powered on again within
+// the request. The host it returns has passed the readiness probe for the
+// machine's current wake.
+func (p *ReverseProxy) recoverTarget(ctx context.Context, dialedHost string) (string, error) {
+	m := p.Config.Machine
+	if m.Host() != "" && !p.isTarget(dialedHost) {
+		// Another request already recovered the machine.
+		return p.ready(ctx, p.pickHost())
+	}
+	if err := m.Refresh(ctx); err != nil {
+		return "", err
+	}
+	if host := p.pickHost(); host != "" {
+		return p.ready(ctx, host)
+	}
+	// The schedule refuses wakes now, as it would for a new request.
+	if s := p.Config.Schedule; s != nil && s.IsClosed(time.Now()) {
+		slog.Info("Proxy target stopped answering during a closed schedule window; not powering on", "machine", m.Describe(), "status", m.Status(), "host", dialedHost)
+		return "", errProxyTargetUnavailable
+	}
+
+	slog.Warn("Proxy target stopped answering and the machine is not running; powering on", "machine", m.Describe(), "status", m.Status(), "host", dialedHost)
+	powerCtx, cancel := context.WithTimeout(ctx, time.Duration(p.Config.PowerOnTimeout)*time.Second)
+	defer cancel()
+	if err := m.PowerOnWithCooldown(powerCtx, p.Config.PowerOnCooldown); err != nil {
+		if p.Config.Progress != nil && ctx.Err() == nil {
+			p.Config.Progress.Failed(err)
+		}
+		return "", err
 	}
+	if host := p.pickHost(); host != "" {
+		return p.ready(ctx, host)
+	}
+	return "", errProxyTargetUnavailable
+}
 
+// ready holds a recovered host until it passes the readiness probe, as
+// ServeHTTP does before the first dial, since a recovery usually means a new
+// wake the earlier probe did not cover.
+func (p *ReverseProxy) ready(ctx context.Context, host string) (string, error) {
+	if p.readiness == nil || host == "" {
+		return host, nil
+	}
+	target, err := p.hostURL(host)
+	if err != nil {
+		return "", err
+	}
+	if err := p.readiness.wait(ctx, target, p.Config.Machine.Wakes()); err != nil {
+		return "", fmt.Errorf("%w: %w", errBackendNotReady, err)
+	}
+	return host, nil
+}
+
+// pickHost returns the machine host to dial for one request.
+func (p *ReverseProxy) pickHost() string {
+	if balancer, ok := p.Config.Machine.(machine.Balancer); ok {
+		return balancer.PickHost()
+	}
+	return p.Config.Machine.Host()
+}
+
+// isTarget reports whether host is still a current target of the machine.
+func (p *ReverseProxy) isTarget(host string) bool {
+	if balancer, ok := p.Config.Machine.(machine.Balancer); ok {
+		return balancer.HasHost(host)
+	}
+	return p.Config.Machine.Host() == host
+}
+
+func (p *ReverseProxy) targetURL() (*url.URL, error) {
+	scheme, err := p.scheme()
+	if err != nil {
+		return nil, err
+	}
 	if p.Config.ProxyTarget != nil && p.Config.ProxyTarget.Host != "" {
 		port := p.Config.ProxyTarget.Port
 		if port == 0 {
@@ -103,16 +226,54 @@ func (p *ReverseProxy) targetURL() (*url.URL, error) {
 		}, nil
 	}
 
-	host := p.Config.Machine.Host()
+	host := p.pickHost()
 	if host == "" {
 		return nil, errProxyTargetUnavailable
 	}
+	return p.hostURL(host)
+}
+
+// hostURL returns the URL of one of the machine's hosts.
+func (p *ReverseProxy) hostURL(host string) (*url.URL, error) {
+	scheme, err := p.scheme()
+	if err != nil {
+		return nil, err
+	}
 	return &url.URL{
 		Scheme: scheme,
 		Host:   net.JoinHostPort(host, strconv.Itoa(p.Config.Port)),
 	}, nil
 }
 
+func (p *ReverseProxy) scheme() (string, error) {
+	scheme := p.Config.Scheme
+	if p.Config.ProxyTarget != nil && p.Config.ProxyTarget.Scheme != "" {
+		scheme = p.Config.ProxyTarget.Scheme
+	}
+	if scheme != "http" && scheme != "https" {
+		return "", fmt.Errorf("unsupported proxy target scheme %q", scheme)
+	}
+	return scheme, nil
+}
+
+// Warm returns once the backend would be proxied to: when it has passed the
+// readiness probe, or accepts a connection when there is none. It lets a wake
+// that no request is waiting on report its progress through to ready.
+func (p *ReverseProxy) Warm(ctx context.Context) error {
+	target, err := p.targetURL()
+	if err != nil {
+		return err
+	}
+	if p.readiness != nil {
+		return p.readiness.wait(ctx, target, p.Config.Machine.Wakes())
+	}
+	connection, err := p.Transport.DialContext(ctx, "tcp", target.Host)
+	if err != nil {
+		return err
+	}
+	return connection.Close()
+}
+
 func (p *ReverseProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	target, err := p.targetURL()
 	if err != nil {
@@ -124,6 +285,20 @@ func (p *ReverseProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if p.readiness != nil {
+		if err := p.readiness.wait(r.Context(), target, p.Config.Machine.Wakes()); err != nil {
+			slog.Warn("Backend is not ready", "target", target.Redacted(), "error", err)
+			// The probe does not recover a stale target itself; re-check the
+			// machine once it gives up, as after dial exhaustion.
+			if r.Context().Err() == nil {
+				p.forgetStaleTarget(r.Context(), target.Hostname())
+			}
+			w.Header().Set("Retry-After", "5")
+			http.Error(w, "Backend not available", http.StatusServiceUnavailable)
+			return
+		}
+	}
+
 	forwardedFor := r.Header.Get("X-Forwarded-For")
 	forwardedHost := r.Host
 	trace := r.Header.Get("X-Cloud-Trace-Context")
@@ -131,17 +306,26 @@ func (p *ReverseProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	rp := &httputil.ReverseProxy{
 		Transport: p.Transport,
 		Rewrite: func(pr *httputil.ProxyRequest) {
+			forwardedPrefix := ""
+			if p.Config.StripPrefix {
+				forwardedPrefix = p.Config.PathPrefix
+				stripPathPrefix(pr.Out.URL, forwardedPrefix)
+			}
 			pr.SetURL(target)
+			setOrDeleteHeader(pr.Out.Header, "X-Forwarded-Prefix", forwardedPrefix)
 			setOrDeleteHeader(pr.Out.Header, "X-Cloud-Trace-Context", trace)
 			setOrDeleteHeader(pr.Out.Header, "X-Forwarded-For", forwardedFor)
 			setOrDeleteHeader(pr.Out.Header, "X-Forwarded-Host", forwardedHost)
 			pr.Out.Header.Set("X-Forwarded-Proto", "https")
 		},
-		ErrorHandler: func(w http.ResponseWriter, _ *http.Request, err error) {
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
 			slog.Warn("Backend proxy request failed", "target", target.Redacted(), "error", err)
 			var exhausted *dialExhaustedError
 			if errors.As(err, &exhausted) {
 				w.Header().Set("Retry-After", "5")
+				p.forgetStaleTarget(r.Context(), target.Hostname())
+			} else if errors.Is(err, errProxyTargetUnavailable) || errors.Is(err, errBackendNotReady) {
+				w.Header().Set("Retry-After", "5")
 			}
 			http.Error(w, "Backend not available", http.StatusServiceUnavailable)
 		},
@@ -150,6 +334,34 @@ func (p *ReverseProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	rp.ServeHTTP(w, r)
 }
 
+// forgetStaleTarget re-checks the machine after the dial window ran out, so a
+// machine that stopped meanwhile is woken by the next request instead of
+// being dialed again until its cooldown expires.
+func (p *ReverseProxy) forgetStaleTarget(ctx context.Context, host string) {
+	if p.Config.ProxyTarget != nil && p.Config.ProxyTarget.Host != "" {
+		return
+	}
+	if !p.isTarget(host) {
+		return
+	}
+	if err := p.Config.Machine.Refresh(ctx); err != nil {
+		slog.Warn("Unable to re-check unreachable machine", "machine", p.Config.Machine.Describe(), "error", err)
+	}
+}
+
+// stripPathPrefix removes a route prefix so the backend sees paths relative
+// to its own root.
+func stripPathPrefix(u *url.URL, prefix string) {
+	u.Path = strings.TrimPrefix(u.Path, prefix)
+	u.RawPath = strings.TrimPrefix(u.RawPath, prefix)
+	if !strings.HasPrefix(u.Path, "/") {
+		u.Path = "/" + u.Path
+		if u.RawPath != "" {
+			u.RawPath = "/" + u.RawPath
+		}
+	}
+}
+
 func setOrDeleteHeader(header http.Header, name, value string) {
 	if value == "" {
 		header.Del(name)
@@ -159,6 +371,17 @@ func setOrDeleteHeader(header http.Header, name, value string) {
 }
 
 func (d *retryingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	connection, recoveredAddress, err := d.dialWindow(ctx, network, address, d.recover != nil)
+	if recoveredAddress != "" {
+		connection, _, err = d.dialWindow(ctx, network, recoveredAddress, false)
+	}
+	return connection, err
+}
+
+// dialWindow retries address until it connects or the retry window ends. When
+// recoverable, it stops after the first failed attempt that recover answers
+// and returns the address to dial in a fresh window instead.
+func (d *retryingDialer) dialWindow(ctx context.Context, network, address string, recoverable bool) (net.Conn, string, error) {
 	retryCtx, cancel := context.WithTimeout(ctx, d.totalTimeout)
 	defer cancel()
 
@@ -176,24 +399,39 @@ func (d *retryingDialer) DialContext(ctx context.Context, network, address strin
 			attemptTimeout = time.Until(deadline)
 		}
 		if attemptTimeout <= 0 {
-			return nil, d.exhaustedError(ctx, address, lastErr)
+			return nil, "", d.exhaustedError(ctx, address, lastErr)
 		}
 
 		attemptCtx, attemptCancel := context.WithTimeout(retryCtx, attemptTimeout)
 		connection, err := dial(attemptCtx, network, address)
 		attemptCancel()
 		if err == nil {
-			return connection, nil
+			if d.connected != nil {
+				d.connected()
+			}
+			return connection, "", nil
 		}
 		lastErr = err
 		if retryCtx.Err() != nil {
-			return nil, d.exhaustedError(ctx, address, lastErr)
+			return nil, "", d.exhaustedError(ctx, address, lastErr)
 		}
 		if !isRetryableDialError(err) {
-			return nil, err
+			return nil, "", err
 		}
 
 		slog.Debug("Backend connection attempt failed; retrying", "address", address, "attempt", attempt, "error", err)
+		if recoverable && (d.stale == nil || d.stale()) {
+			recoverable = false
+			recoveredAddress, err := d.recoverAddress(ctx, address)
+			if err == nil {
+				return nil, recoveredAddress, nil
+			}
+			if errors.Is(err, errProxyTargetUnavailable) || errors.Is(err, errBackendNotReady) {
+				// The machine is down and will not be woken, or its new host
+				// is not ready; dialing on is pointless.
+				return nil, "", err
+			}
+		}
 		jitter := d.jitter
 		if jitter == nil {
 			jitter = jitteredDelay
@@ -207,7 +445,7 @@ func (d *retryingDialer) DialContext(ctx context.Context, network, address strin
 				default:
 				}
 			}
-			return nil, d.exhaustedError(ctx, address, lastErr)
+			return nil, "", d.exhaustedError(ctx, address, lastErr)
 		case <-timer.C:
 		}
 		if retryDelay < 5*time.Second {
@@ -219,6 +457,22 @@ func (d *retryingDialer) DialContext(ctx context.Context, network, address strin
 	}
 }
 
+// recoverAddress asks recover for the address to dial after a failed
+// attempt. When recovery fails, dialing continues as before unless the
+// machine has no target left.
+func (d *retryingDialer) recoverAddress(ctx context.Context, address string) (string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", err
+	}
+	recoveredHost, err := d.recover(ctx, host)
+	if err != nil {
+		slog.Warn("Unable to recover unreachable backend", "address", address, "error", err)
+		return "", err
+	}
+	return net.JoinHostPort(recoveredHost, port), nil
+}
+
 func (d *retryingDialer) exhaustedError(parent context.Context, address string, lastErr error) error {
 	if err := parent.Err(); err != nil {
 		return err
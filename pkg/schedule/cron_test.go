@@ -0,0 +1,61 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronMatches(t *testing.T) {
+	t.Parallel()
+
+	// 2026-01-05 is a Monday.
+	monday := time.Date(2026, 1, 5, 7, 45, 0, 0, time.UTC)
+	tests := []struct {
+		expression string
+		at         time.Time
+		want       bool
+	}{
+		{expression: "45 7 * * MON-FRI", at: monday, want: true},
+		{expression: "45 7 * * MON-FRI", at: monday.Add(time.Minute), want: false},
+		{expression: "45 7 * * sat,sun", at: monday, want: false},
+		{expression: "*/15 6-8 * * *", at: monday, want: true},
+		{expression: "*/15 6-8 * * *", at: monday.Add(5 * time.Minute), want: false},
+		{expression: "0 0 * * 7", at: time.Date(2026, 1, 4, 0, 0, 0, 0, time.UTC), want: true},
+		{expression: "30/10 * * * *", at: monday.Add(-5 * time.Minute), want: true},
+		{expression: "* * 1 JAN *", at: time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC), want: true},
+		// Both day fields restricted: either one matching is enough.
+		{expression: "* * 1 * MON", at: monday, want: true},
+		{expression: "* * 1 * TUE", at: monday, want: false},
+		// Only one day field restricted: the other must not widen the match.
+		{expression: "* * 1 * *", at: monday, want: false},
+	}
+	for _, test := range tests {
+		cron, err := Parse(test.expression)
+		if err != nil {
+			t.Fatalf("Parse(%q) error = %v", test.expression, err)
+		}
+		if got := cron.Matches(test.at); got != test.want {
+			t.Errorf("Parse(%q).Matches(%s) = %v, want %v", test.expression, test.at, got, test.want)
+		}
+	}
+}
+
+func TestParseRejectsInvalidExpressions(t *testing.T) {
+	t.Parallel()
+
+	for _, expression := range []string{
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"* * * * FUNDAY",
+	} {
+		if _, err := Parse(expression); err == nil {
+			t.Errorf("Parse(%q) unexpectedly succeeded", expression)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package schedule
+
+import (
+	"fmt"
+	"time"
+)
+
+// reopenSearch bounds how far ahead ReopensAt looks for the end of a closed
+// window.
+const reopenSearch = 8 * 24 * time.Hour
+
+// Schedule keeps a machine warm at set times and refuses wakes while closed.
+type Schedule struct {
+	// Timezone is an IANA zone name used to evaluate every expression.
+	Timezone string `yaml:"timezone"` // default: UTC
+	// KeepWarm expressions power the machine on in the minutes they select.
+	KeepWarm []string `yaml:"keepWarm"`
+	// Closed expressions select every minute during which wakes are refused,
+	// e.g. "* * * * SAT,SUN" for weekends.
+	Closed        []string `yaml:"closed"`
+	ClosedMessage string   `yaml:"closedMessage"`
+	location      *time.Location
+	keepWarm      []*Cron
+	closed        []*Cron
+}
+
+// Compile parses the time zone and expressions. It must be called before the
+// schedule is evaluated.
+func (s *Schedule) Compile() error {
+	var err error
+	s.location = time.UTC
+	if s.Timezone != "" {
+		if s.location, err = time.LoadLocation(s.Timezone); err != nil {
+			return fmt.Errorf("schedule timezone: %w", err)
+		}
+	}
+	if s.keepWarm, err = parseAll(s.KeepWarm); err != nil {
+		return fmt.Errorf("schedule keepWarm: %w", err)
+	}
+	if s.closed, err = parseAll(s.Closed); err != nil {
+		return fmt.Errorf("schedule closed: %w", err)
+	}
+	if s.ClosedMessage == "" {
+		s.ClosedMessage = "This service is closed right now."
+	}
+	return nil
+}
+
+func parseAll(expressions []string) ([]*Cron, error) {
+	crons := make([]*Cron, 0, len(expressions))
+	for _, expression := range expressions {
+		cron, err := Parse(expression)
+		if err != nil {
+			return nil, err
+		}
+		crons = append(crons, cron)
+	}
+	return crons, nil
+}
+
+// IsClosed reports whether wakes are refused at now.
+func (s *Schedule) IsClosed(now time.Time) bool {
+	return anyMatch(s.closed, now.In(s.location))
+}
+
+// KeepWarmDue reports whether a keep-warm expression selects the minute of now.
+func (s *Schedule) KeepWarmDue(now time.Time) bool {
+	return anyMatch(s.keepWarm, now.In(s.location))
+}
+
+// ReopensAt returns the first minute after now that is not closed. It
+// reports false when the schedule stays closed for more than eight days.
+func (s *Schedule) ReopensAt(now time.Time) (time.Time, bool) {
+	local := now.In(s.location).Truncate(time.Minute)
+	for next := local.Add(time.Minute); next.Sub(local) <= reopenSearch; next = next.Add(time.Minute) {
+		if !anyMatch(s.closed, next) {
+			return next, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func anyMatch(crons []*Cron, t time.Time) bool {
+	for _, cron := range crons {
+		if cron.Matches(t) {
+			return true
+		}
+	}
+	return false
+}
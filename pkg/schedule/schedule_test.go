@@ -0,0 +1,64 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleClosedWindowUsesTimezone(t *testing.T) {
+	t.Parallel()
+
+	s := &Schedule{
+		Timezone: "America/New_York",
+		KeepWarm: []string{"45 7 * * MON-FRI"},
+		Closed:   []string{"* * * * SAT,SUN"},
+	}
+	if err := s.Compile(); err != nil {
+		t.Fatalf("Compile() error = %v", err)
+	}
+
+	// 2026-01-10 03:00 UTC is still Friday evening in New York.
+	fridayEvening := time.Date(2026, 1, 10, 3, 0, 0, 0, time.UTC)
+	if s.IsClosed(fridayEvening) {
+		t.Fatal("IsClosed() = true on Friday evening in New York")
+	}
+	saturday := time.Date(2026, 1, 10, 15, 30, 20, 0, time.UTC)
+	if !s.IsClosed(saturday) {
+		t.Fatal("IsClosed() = false on Saturday")
+	}
+	reopens, ok := s.ReopensAt(saturday)
+	want := time.Date(2026, 1, 12, 5, 0, 0, 0, time.UTC) // Monday 00:00 in New York
+	if !ok || !reopens.Equal(want) {
+		t.Fatalf("ReopensAt() = %s, %v, want %s", reopens, ok, want)
+	}
+
+	if !s.KeepWarmDue(time.Date(2026, 1, 12, 12, 45, 30, 0, time.UTC)) {
+		t.Fatal("KeepWarmDue() = false at 07:45 Monday in New York")
+	}
+	if s.KeepWarmDue(time.Date(2026, 1, 12, 7, 45, 0, 0, time.UTC)) {
+		t.Fatal("KeepWarmDue() evaluated the expression in UTC")
+	}
+}
+
+func TestScheduleAlwaysClosedHasNoReopenTime(t *testing.T) {
+	t.Parallel()
+
+	s := &Schedule{Closed: []string{"* * * * *"}}
+	if err := s.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.ReopensAt(time.Now()); ok {
+		t.Fatal("ReopensAt() found a reopen time for a schedule that is always closed")
+	}
+	if s.ClosedMessage == "" {
+		t.Fatal("Compile() did not set a default closed message")
+	}
+}
+
+func TestScheduleRejectsUnknownTimezone(t *testing.T) {
+	t.Parallel()
+
+	if err := (&Schedule{Timezone: "Mars/Olympus_Mons"}).Compile(); err == nil {
+		t.Fatal("Compile() accepted an unknown time zone")
+	}
+}